@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		line    string
+	}{
+		{
+			name:    "implicit ok",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) },
+			line:    `method=POST path="/e" status=200 bytes=5 duration=`,
+		},
+		{
+			name:    "error",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.Error(w, "no", http.StatusTeapot) },
+			line:    `method=POST path="/e" status=418 bytes=3 duration=`,
+		},
+		{
+			name:    "no body",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			line:    `method=POST path="/e" status=200 bytes=0 duration=`,
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		submit(AccessLog(&out, tt.handler), http.MethodPost, "/e", "")
+		pattern := regexp.MustCompile(`^time=\S+ ` + regexp.QuoteMeta(tt.line) + `\S+\n$`)
+		if !pattern.Match(out.Bytes()) {
+			t.Errorf("%s: line %q, expected %q", tt.name, out.String(), tt.line)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminAuthorized checks the bearer token of an admin request
+func adminAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// adminHandler restricts an admin handler to POST requests bearing the admin
+// token
+func adminHandler(token string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL.Path)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		if !adminAuthorized(r, token) {
+			log.Printf("%s %s: 401 Unauthorized", r.Method, r.URL.Path)
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// ReloadHandler reloads the configuration, reporting parse errors to the
+// client
+func (h *ConfigHolder) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	err := h.Reload()
+	if err != nil {
+		logError("Failed to reload configuration, %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("Configuration reloaded.\n"))
+}
+
+// MaintenanceHandler enables the maintenance mode with on=1 and disables it
+// with on=0
+func (h *ConfigHolder) MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+	if err != nil {
+		http.Error(w, "Expected on=1 or on=0.", http.StatusBadRequest)
+		return
+	}
+	h.SetMaintenance(on)
+	fmt.Fprintf(w, "Maintenance mode: %v\n", on)
+}
+
+// HealthHandler reports the server is up, even during maintenance
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
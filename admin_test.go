@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "datamgr.yaml")
+	write := func(text string) {
+		err := ioutil.WriteFile(file, []byte(text), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("receive:\n  /a: {action: none}\n")
+	h, err := NewConfigHolder(func() (*Config, error) { return LoadConfig(file, Options{}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := adminHandler("secret", h.ReloadHandler)
+
+	tests := []struct {
+		name     string
+		config   string
+		method   string
+		token    string
+		status   int
+		endpoint string
+	}{
+		{"get", "receive:\n  /b: {action: none}\n", http.MethodGet, "secret", http.StatusMethodNotAllowed, "/a"},
+		{"no token", "receive:\n  /b: {action: none}\n", http.MethodPost, "", http.StatusUnauthorized, "/a"},
+		{"bad token", "receive:\n  /b: {action: none}\n", http.MethodPost, "secrets", http.StatusUnauthorized, "/a"},
+		{"parse error", "receive:\n  /b: {action: nope}\n", http.MethodPost, "secret", http.StatusBadRequest, "/a"},
+		{"reload", "receive:\n  /b: {action: none}\n", http.MethodPost, "secret", http.StatusOK, "/b"},
+	}
+	for _, tt := range tests {
+		write(tt.config)
+		var headers []string
+		if tt.token != "" {
+			headers = []string{"Authorization", "Bearer " + tt.token}
+		}
+		w := submit(handler, tt.method, "/admin/reload", "", headers...)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+		}
+		if _, ok := h.Get().Receive[tt.endpoint]; !ok || len(h.Get().Receive) != 1 {
+			t.Errorf("%s: live endpoints %v, expected %s", tt.name, h.Get().Receive, tt.endpoint)
+		}
+		if tt.status == http.StatusBadRequest && !strings.Contains(w.Body.String(), "receive[/b].action") {
+			t.Errorf("%s: body %q does not report the error", tt.name, w.Body.String())
+		}
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	config := parseConfig(t, "receive:\n  /e: {action: none}\n")
+	h := &ConfigHolder{config: config}
+	maintenance := adminHandler("secret", h.MaintenanceHandler)
+	health := http.HandlerFunc(HealthHandler)
+	auth := []string{"Authorization", "Bearer secret"}
+
+	tests := []struct {
+		target      string
+		status      int
+		maintenance bool
+		endpoint    int
+	}{
+		{"/admin/maintenance?on=1", http.StatusOK, true, http.StatusServiceUnavailable},
+		{"/admin/maintenance?on=maybe", http.StatusBadRequest, true, http.StatusServiceUnavailable},
+		{"/admin/maintenance?on=0", http.StatusOK, false, http.StatusSeeOther},
+		{"/admin/maintenance", http.StatusBadRequest, false, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		w := submit(maintenance, http.MethodPost, tt.target, "", auth...)
+		if w.Code != tt.status || h.Maintenance() != tt.maintenance {
+			t.Errorf("%s: status %d maintenance %v, expected %d %v", tt.target, w.Code, h.Maintenance(), tt.status, tt.maintenance)
+		}
+		w = submit(h, http.MethodPost, "/e", "")
+		if w.Code != tt.endpoint {
+			t.Errorf("%s: endpoint status %d, expected %d", tt.target, w.Code, tt.endpoint)
+		}
+		if tt.maintenance && w.Header().Get("Retry-After") != MaintenanceRetryAfter {
+			t.Errorf("%s: Retry-After %q", tt.target, w.Header().Get("Retry-After"))
+		}
+		if w := submit(health, http.MethodGet, "/healthz", ""); w.Code != http.StatusOK {
+			t.Errorf("%s: health status %d", tt.target, w.Code)
+		}
+	}
+	if w := submit(maintenance, http.MethodPost, "/admin/maintenance?on=1", ""); w.Code != http.StatusUnauthorized || h.Maintenance() {
+		t.Errorf("unauthenticated request: status %d, maintenance %v", w.Code, h.Maintenance())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"text/template"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/mildred/datamgr/util"
+)
+
+// ConfigAppendFile is the append_file action, appending each submission to a
+// shared file
+type ConfigAppendFile struct {
+	Name         string `yaml:"name"`
+	nameTemplate *template.Template
+	Format       string `yaml:"format"`
+	IncludeMeta  bool   `yaml:"include_meta"`
+	storage      Storage
+}
+
+func (c *ConfigAppendFile) parse(key string) (err error) {
+	var e error
+	c.nameTemplate, e = parseProcessTemplate("append_file.name", c.Name)
+	if e != nil {
+		err = multierror.Append(err, fmt.Errorf("%s.name template error, %v", key, e)).ErrorOrNil()
+	}
+	switch c.Format {
+	case "ndjson", "":
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.format unexpected format %v, expected \"ndjson\"", key, c.Format)).ErrorOrNil()
+	}
+	return err
+}
+
+// Perform appends the submission as a JSON line
+func (c *ConfigAppendFile) Perform(w http.ResponseWriter, r *Process) bool {
+	fileName, err := r.render(c.nameTemplate)
+	if err != nil {
+		logError("Failed to build file name from template %+v, %v", c.Name, err)
+		http.Error(w, "Could not process request due to misconfiguration.", http.StatusInternalServerError)
+		return false
+	}
+	log.Printf("[DEBUG] Append to file %v", fileName)
+
+	line, err := json.Marshal(r.record(c.IncludeMeta))
+	if err != nil {
+		logError("Failed to encode line for file %v, %v", fileName, err)
+		http.Error(w, "Could not process request because of data error.", http.StatusInternalServerError)
+		return false
+	}
+
+	dir := path.Dir(fileName)
+	err = c.storage.MkdirAll(r.ctx, dir, 0755)
+	if err != nil {
+		storageError(w, fmt.Sprintf("create directory %v", dir), err)
+		return false
+	}
+	err = appendFile(r.ctx, c.storage, fileName, func(out io.Writer, empty bool) error {
+		_, err := out.Write(append(line, '\n'))
+		return err
+	})
+	if err != nil {
+		storageError(w, fmt.Sprintf("append to file %v", fileName), err)
+		return false
+	}
+	return true
+}
+
+// appendLocks serializes the appends to the same file within the process,
+// the storage locks the file against other processes
+var appendLocks util.KeyedMutex
+
+// appendFile appends to fileName what write produces, write is told if the
+// file was empty to add a header if needed
+func appendFile(ctx context.Context, storage Storage, fileName string, write func(out io.Writer, empty bool) error) error {
+	unlock := appendLocks.Lock(fileName)
+	defer unlock()
+
+	f, size, err := storage.Append(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(f)
+	err = write(buf, size == 0)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if syncer, ok := f.(interface{ Sync() error }); ok && err == nil {
+		err = syncer.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
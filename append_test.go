@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// submitConcurrently posts n forms built by form at the same time, failing
+// the test unless they are all redirected
+func submitConcurrently(t *testing.T, h http.Handler, n int, form func(i int) string) {
+	t.Helper()
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = submit(h, http.MethodPost, "/e", form(i)).Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusSeeOther {
+			t.Fatalf("submission %d: status %d", i, code)
+		}
+	}
+}
+
+func TestCreateFileCSV(t *testing.T) {
+	const n = 50
+	dir := t.TempDir()
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {name: {}, note: {}}
+    create_file: {name: %s/rows.csv, format: csv}
+`, dir))
+	// The note is long enough for a row to be written in several pieces if
+	// the appends were not serialized
+	note := strings.Repeat("x", 8<<10)
+	submitConcurrently(t, c, n, func(i int) string {
+		return fmt.Sprintf("field.name=%d&field.note=%s", i, note)
+	})
+
+	f, err := os.Open(filepath.Join(dir, "rows.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("reading rows: %v", err)
+	}
+	if len(rows) != n+1 || strings.Join(rows[0], ",") != "name,note" {
+		t.Fatalf("%d rows, header %q", len(rows), rows[0])
+	}
+	seen := map[string]bool{}
+	for _, row := range rows[1:] {
+		if row[1] != note {
+			t.Errorf("row %s: note of %d bytes", row[0], len(row[1]))
+		}
+		seen[row[0]] = true
+	}
+	if len(seen) != n {
+		t.Errorf("%d distinct rows, expected %d", len(seen), n)
+	}
+
+	errors := []struct {
+		config  string
+		message string
+	}{
+		{"{name: x.csv, format: csv, include_meta: true}", "receive[/e].create_file.format csv appends rows and cannot be used with include_meta"},
+		{"{name: x.csv, format: csv, mode: merge}", "receive[/e].create_file.format csv cannot be merged into"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    create_file: "+tt.config+"\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.config, msg, tt.message)
+		}
+	}
+}
+
+func TestAppendFile(t *testing.T) {
+	const n = 50
+	dir := t.TempDir()
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {name: {}, note: {}}
+    append_file: {name: '%s/{{ .Meta.Endpoint }}.ndjson', include_meta: true}
+`, dir))
+	note := strings.Repeat("x", 8<<10)
+	submitConcurrently(t, c, n, func(i int) string {
+		return fmt.Sprintf("field.name=%d&field.note=%s", i, note)
+	})
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "e.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != n {
+		t.Fatalf("%d lines, expected %d", len(lines), n)
+	}
+	seen := map[string]bool{}
+	for i, line := range lines {
+		var record struct {
+			Data map[string]string `json:"data"`
+			Meta ProcessMeta       `json:"meta"`
+		}
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil || record.Data["note"] != note || record.Meta.Endpoint != "/e" {
+			t.Errorf("line %d of %d bytes: %v", i, len(line), err)
+		}
+		seen[record.Data["name"]] = true
+	}
+	if len(seen) != n {
+		t.Errorf("%d distinct lines, expected %d", len(seen), n)
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    append_file: {name: x, format: csv}\n")
+	if !strings.Contains(msg, `receive[/e].append_file.format unexpected format csv, expected "ndjson"`) {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mildred/datamgr/util"
+)
+
+// AuditLog appends a JSON line per successful submission, whatever the
+// endpoint output format
+type AuditLog struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+}
+
+// OpenAuditLog writes the audit log in dir, one file per day
+func OpenAuditLog(dir string) (*AuditLog, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{out: &util.DailyFile{Dir: dir, Prefix: "audit-", Suffix: ".jsonl"}}, nil
+}
+
+// Log writes the audit line of the process. It is best effort, errors are
+// logged and do not fail the request.
+func (a *AuditLog) Log(p *Process) {
+	if a == nil {
+		return
+	}
+	line, err := json.Marshal(Record{
+		{Key: "timestamp", Value: time.Now().UTC()},
+		{Key: "endpoint", Value: p.Meta.Endpoint},
+		{Key: "fields", Value: p.fieldRecord()},
+		{Key: "meta", Value: p.Meta},
+	})
+	if err != nil {
+		logError("Failed to encode audit log for request %s, %v", p.Meta.RequestID, err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.out.Write(append(line, '\n'))
+	if err != nil {
+		logError("Failed to write audit log for request %s, %v", p.Meta.RequestID, err)
+	}
+}
+
+func (a *AuditLog) Close() error {
+	return a.out.Close()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	audit, err := OpenAuditLog(filepath.Join(dir, "audit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := parseConfigWith(t, Options{Audit: audit}, fmt.Sprintf(`
+receive:
+  /yaml:
+    fields: {name: {}, age: {type: int}}
+    create_file: {name: %s/rec.yaml}
+  /toml:
+    fields: {name: {}}
+    create_file: {name: %s/rec.toml, format: toml}
+  /invalid:
+    fields: {age: {type: int}}
+    action: none
+`, dir, dir))
+	tests := []struct {
+		target string
+		form   string
+		status int
+		fields string
+	}{
+		{"/yaml", "field.name=x&field.age=3", http.StatusSeeOther, `{"name":"x","age":3}`},
+		{"/toml", "field.name=y", http.StatusSeeOther, `{"name":"y"}`},
+		{"/invalid", "field.age=x", http.StatusBadRequest, ""},
+		{"/yaml", "field.name=x&dry_run=1", http.StatusOK, ""},
+	}
+	var expected []string
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, tt.target, tt.form, "X-Request-Id", tt.target)
+		if w.Code != tt.status {
+			t.Fatalf("%s: status %d, %s", tt.target, w.Code, w.Body.String())
+		}
+		if tt.fields != "" {
+			expected = append(expected, tt.target+" "+tt.fields)
+		}
+	}
+	audit.Close()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit", "audit-"+time.Now().UTC().Format("2006-01-02")+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("audit log %q, expected %d lines", data, len(expected))
+	}
+	for i, line := range lines {
+		var entry struct {
+			Timestamp time.Time       `json:"timestamp"`
+			Endpoint  string          `json:"endpoint"`
+			Fields    json.RawMessage `json:"fields"`
+			Meta      ProcessMeta     `json:"meta"`
+		}
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if got := entry.Endpoint + " " + string(entry.Fields); got != expected[i] {
+			t.Errorf("line %d: %s, expected %s", i, got, expected[i])
+		}
+		if entry.Meta.RequestID != entry.Endpoint || entry.Timestamp.IsZero() {
+			t.Errorf("line %d: unexpected entry %s", i, line)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	DefaultAPIKeyHeader = "X-API-Key"
+	DefaultRealm        = "datamgr"
+)
+
+// ConfigAuth restricts an endpoint to the requests bearing one of the API
+// keys, in a header or a query parameter, the credentials of one of the
+// basic auth users, a bearer token of the OIDC issuer or an HMAC signature
+// of the body
+type ConfigAuth struct {
+	APIKeys    []string `yaml:"api_keys"`
+	APIKeysEnv string   `yaml:"api_keys_env"`
+	Header     string   `yaml:"header"`
+	QueryParam string   `yaml:"query_param"`
+	// Basic maps the user names to bcrypt password hashes
+	Basic map[string]string `yaml:"basic"`
+	Realm string            `yaml:"realm"`
+	OIDC  *ConfigOIDC       `yaml:"oidc"`
+	HMAC  *ConfigHMAC       `yaml:"hmac"`
+}
+
+func (c *ConfigAuth) parse(key string) (err error) {
+	if c.APIKeysEnv != "" {
+		for _, k := range strings.Split(os.Getenv(c.APIKeysEnv), ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				c.APIKeys = append(c.APIKeys, k)
+			}
+		}
+	}
+	if len(c.APIKeys) == 0 && len(c.Basic) == 0 && c.OIDC == nil && c.HMAC == nil {
+		err = multierror.Append(err, fmt.Errorf("%s has no credentials, set api_keys, api_keys_env, basic, oidc or hmac", key)).ErrorOrNil()
+	}
+	if c.HMAC != nil {
+		err = multierror.Append(err, c.HMAC.parse(key+".hmac")).ErrorOrNil()
+	}
+	if c.OIDC != nil {
+		err = multierror.Append(err, c.OIDC.parse(key+".oidc")).ErrorOrNil()
+	}
+	for _, k := range c.APIKeys {
+		if k == "" {
+			err = multierror.Append(err, fmt.Errorf("%s.api_keys contains an empty key", key)).ErrorOrNil()
+		}
+	}
+	for user, hash := range c.Basic {
+		if _, e := bcrypt.Cost([]byte(hash)); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s.basic.%s is not a bcrypt hash, %v", key, user, e)).ErrorOrNil()
+		}
+	}
+	if c.Header == "" {
+		c.Header = DefaultAPIKeyHeader
+	}
+	if c.Realm == "" {
+		c.Realm = DefaultRealm
+	}
+	return err
+}
+
+// apiKey returns the key given with the request, the header taking
+// precedence over the query parameter
+func (c *ConfigAuth) apiKey(r *http.Request) string {
+	if k := r.Header.Get(c.Header); k != "" {
+		return k
+	}
+	if c.QueryParam != "" {
+		return r.URL.Query().Get(c.QueryParam)
+	}
+	return ""
+}
+
+// authorized checks the basic auth credentials or compares the request key
+// with each of the API keys in constant time
+func (c *ConfigAuth) authorized(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok && len(c.Basic) > 0 {
+		hash, known := c.Basic[user]
+		return known && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	if len(c.APIKeys) == 0 {
+		return false
+	}
+	given := []byte(c.apiKey(r))
+	ok := false
+	for _, k := range c.APIKeys {
+		ok = subtle.ConstantTimeCompare(given, []byte(k)) == 1 || ok
+	}
+	return ok && len(given) > 0
+}
+
+// Authorize checks the request credentials and returns the claims of a
+// bearer token, on failure it responds 401 and returns false
+func (c *ConfigAuth) Authorize(w http.ResponseWriter, r *http.Request) (map[string]interface{}, bool) {
+	if c.HMAC != nil && r.Header.Get(c.HMAC.Header) != "" {
+		ok, err := c.HMAC.verify(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading body: %v", err), http.StatusBadRequest)
+			return nil, false
+		} else if ok {
+			return nil, true
+		}
+		log.Printf("[DEBUG] Invalid %s signature", c.HMAC.Header)
+	} else if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); c.OIDC != nil && token != r.Header.Get("Authorization") {
+		claims, err := c.OIDC.Verify(r.Context(), token)
+		if err == nil {
+			return claims, true
+		}
+		log.Printf("[DEBUG] Invalid bearer token, %v", err)
+	} else if c.authorized(r) {
+		return nil, true
+	}
+	log.Printf("%s %s: 401 Unauthorized", r.Method, r.URL.Path)
+	if len(c.Basic) > 0 {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", c.Realm))
+	} else if c.OIDC != nil {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", c.Realm))
+	}
+	http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+	return nil, false
+}
+
+const DefaultSignatureHeader = "X-Hub-Signature-256"
+
+// ConfigHMAC authenticates the requests whose body is signed with a shared
+// secret, such as the GitHub webhooks signing in X-Hub-Signature-256 the
+// sha256= prefixed hex HMAC of the body
+type ConfigHMAC struct {
+	SecretEnv string  `yaml:"secret_env"`
+	Header    string  `yaml:"header"`
+	Algorithm string  `yaml:"algorithm"`
+	Prefix    *string `yaml:"prefix"`
+	Encoding  string  `yaml:"encoding"`
+	MaxSize   int64   `yaml:"max_size"`
+}
+
+func (c *ConfigHMAC) parse(key string) (err error) {
+	if c.SecretEnv == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.secret_env is required", key)).ErrorOrNil()
+	} else if os.Getenv(c.SecretEnv) == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.secret_env: $%s is not set", key, c.SecretEnv)).ErrorOrNil()
+	}
+	if c.Header == "" {
+		c.Header = DefaultSignatureHeader
+	}
+	if c.Algorithm == "" {
+		c.Algorithm = "sha256"
+	}
+	if _, ok := checksumAlgorithms[c.Algorithm]; !ok {
+		err = multierror.Append(err, fmt.Errorf("%s.algorithm unexpected algorithm %v, expected \"sha256\" or \"sha512\"", key, c.Algorithm)).ErrorOrNil()
+	}
+	if c.Prefix == nil {
+		prefix := c.Algorithm + "="
+		c.Prefix = &prefix
+	}
+	switch c.Encoding {
+	case "", "hex", "base64":
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.encoding unexpected encoding %v, expected \"hex\" or \"base64\"", key, c.Encoding)).ErrorOrNil()
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = DefaultMaxRaw
+	}
+	return err
+}
+
+// verify reads the request body to check its signature, the body is then
+// restored for the form parsing
+func (c *ConfigHMAC) verify(r *http.Request) (bool, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, c.MaxSize+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(body)) > c.MaxSize {
+		return false, fmt.Errorf("signed body exceeds %d bytes", c.MaxSize)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// Anyone can sign with an empty key, should the variable be unset
+	// after the configuration was parsed
+	secret := os.Getenv(c.SecretEnv)
+	if secret == "" {
+		logError("Rejected signed request, $%s is not set", c.SecretEnv)
+		return false, nil
+	}
+	given := strings.TrimPrefix(r.Header.Get(c.Header), *c.Prefix)
+	var signature []byte
+	if c.Encoding == "base64" {
+		signature, err = base64.StdEncoding.DecodeString(given)
+	} else {
+		signature, err = hex.DecodeString(given)
+	}
+	if err != nil {
+		return false, nil
+	}
+	mac := hmac.New(checksumAlgorithms[c.Algorithm], []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil)), nil
+}
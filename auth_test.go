@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAPIKey(t *testing.T) {
+	t.Setenv("API_KEYS", " k3 , ,k4")
+	tests := []struct {
+		name    string
+		auth    string
+		target  string
+		headers []string
+		status  int
+	}{
+		{"header", "{api_keys: [k1, k2]}", "/e", []string{"X-API-Key", "k2"}, http.StatusOK},
+		{"wrong key", "{api_keys: [k1, k2]}", "/e", []string{"X-API-Key", "k"}, http.StatusUnauthorized},
+		{"prefix of a key", "{api_keys: [k1, k2]}", "/e", []string{"X-API-Key", "k1x"}, http.StatusUnauthorized},
+		{"missing key", "{api_keys: [k1, k2]}", "/e", nil, http.StatusUnauthorized},
+		{"custom header", "{api_keys: [k1], header: Authorization}", "/e", []string{"Authorization", "k1"}, http.StatusOK},
+		{"query parameter", "{api_keys: [k1], query_param: key}", "/e?key=k1", nil, http.StatusOK},
+		{"query parameter disabled", "{api_keys: [k1]}", "/e?key=k1", nil, http.StatusUnauthorized},
+		// The header takes precedence over the query parameter
+		{"header and query parameter", "{api_keys: [k1], query_param: key}", "/e?key=k1", []string{"X-API-Key", "k"}, http.StatusUnauthorized},
+		{"environment", "{api_keys_env: API_KEYS}", "/e", []string{"X-API-Key", "k4"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		// The query parameter is not an unexpected field
+		c := parseConfig(t, "receive:\n  /e:\n    strict_fields: true\n    field_prefix: ''\n    auth: "+tt.auth+"\n    action: echo\n")
+		w := submit(c, http.MethodPost, tt.target, "", tt.headers...)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.name, w.Code, tt.status, w.Body.String())
+		}
+		if tt.status == http.StatusUnauthorized && (w.Body.String() != "Unauthorized.\n" || w.Header().Get("WWW-Authenticate") != "") {
+			t.Errorf("%s: body %q, WWW-Authenticate %q", tt.name, w.Body.String(), w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	errors := []struct {
+		auth    string
+		message string
+	}{
+		{"{}", "receive[/e].auth has no credentials, set api_keys, api_keys_env, basic, oidc or hmac"},
+		{"{api_keys_env: UNSET_KEYS}", "receive[/e].auth has no credentials"},
+		{"{api_keys: [k1, '']}", "receive[/e].auth.api_keys contains an empty key"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    auth: "+tt.auth+"\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.auth, msg, tt.message)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := parseConfig(t, fmt.Sprintf("receive:\n  /e:\n    auth: {basic: {alice: '%s'}, api_keys: [k1], realm: Forms}\n    action: echo\n", hash))
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		headers  []string
+		status   int
+	}{
+		{"valid", "alice", "secret", nil, http.StatusOK},
+		{"wrong password", "alice", "Secret", nil, http.StatusUnauthorized},
+		{"unknown user", "bob", "secret", nil, http.StatusUnauthorized},
+		{"api key", "", "", []string{"X-API-Key", "k1"}, http.StatusOK},
+		// Wrong credentials are not rescued by a valid key
+		{"wrong password and api key", "alice", "x", []string{"X-API-Key", "k1"}, http.StatusUnauthorized},
+		{"missing", "", "", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/e", strings.NewReader(""))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.password)
+		}
+		for i := 0; i+1 < len(tt.headers); i += 2 {
+			r.Header.Set(tt.headers[i], tt.headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.name, w.Code, tt.status, w.Body.String())
+		}
+		// The browsers prompt for the credentials
+		if challenge := w.Header().Get("WWW-Authenticate"); tt.status == http.StatusUnauthorized && challenge != `Basic realm="Forms", charset="UTF-8"` {
+			t.Errorf("%s: WWW-Authenticate %q", tt.name, challenge)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    auth: {basic: {alice: secret}}\n")
+	if expected := "receive[/e].auth.basic.alice is not a bcrypt hash"; !strings.Contains(msg, expected) {
+		t.Errorf("error %q, expected %q", msg, expected)
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "secret")
+	sign := func(secret, body string, h func() hash.Hash) []byte {
+		mac := hmac.New(h, []byte(secret))
+		mac.Write([]byte(body))
+		return mac.Sum(nil)
+	}
+	body := "field.name=a"
+	valid := "sha256=" + hex.EncodeToString(sign("secret", body, sha256.New))
+	tests := []struct {
+		name      string
+		auth      string
+		body      string
+		signature []string
+		status    int
+	}{
+		{"valid", "{}", body, []string{"X-Hub-Signature-256", valid}, http.StatusOK},
+		{"tampered body", "{}", "field.name=b", []string{"X-Hub-Signature-256", valid}, http.StatusUnauthorized},
+		{"wrong secret", "{}", body, []string{"X-Hub-Signature-256", "sha256=" + hex.EncodeToString(sign("other", body, sha256.New))}, http.StatusUnauthorized},
+		{"missing", "{}", body, nil, http.StatusUnauthorized},
+		{"malformed", "{}", body, []string{"X-Hub-Signature-256", "sha256=xyz"}, http.StatusUnauthorized},
+		{"truncated", "{}", body, []string{"X-Hub-Signature-256", valid[:len(valid)-2]}, http.StatusUnauthorized},
+		{"sha512 base64", "{header: X-Signature, algorithm: sha512, prefix: '', encoding: base64}", body, []string{"X-Signature", base64.StdEncoding.EncodeToString(sign("secret", body, sha512.New))}, http.StatusOK},
+		{"too large", "{max_size: 4}", body, []string{"X-Hub-Signature-256", valid}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, "receive:\n  /e:\n    fields: {name: {}}\n    auth: {hmac: "+strings.Replace(tt.auth, "{", "{secret_env: WEBHOOK_SECRET, ", 1)+"}\n    action: echo\n")
+		// The body is still parsed once its signature is checked
+		status, fields, response := echoFields(t, c, "/e", tt.body, tt.signature...)
+		if status != tt.status || (status == http.StatusOK && fields["name"] != "a") {
+			t.Errorf("%s: status %d, fields %v, expected %d (%s)", tt.name, status, fields, tt.status, response)
+		}
+	}
+
+	// The requests are rejected should the secret be unset after parsing
+	c := parseConfig(t, "receive:\n  /e:\n    auth: {hmac: {secret_env: WEBHOOK_SECRET}}\n    action: echo\n")
+	t.Setenv("WEBHOOK_SECRET", "")
+	empty := "sha256=" + hex.EncodeToString(sign("", body, sha256.New))
+	if w := submit(c, http.MethodPost, "/e", body, "X-Hub-Signature-256", empty); w.Code != http.StatusUnauthorized {
+		t.Errorf("unset secret: status %d", w.Code)
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    auth: {hmac: {algorithm: md5, encoding: base32}}\n")
+	for _, expected := range []string{
+		"receive[/e].auth.hmac.secret_env is required",
+		`receive[/e].auth.hmac.algorithm unexpected algorithm md5, expected "sha256" or "sha512"`,
+		`receive[/e].auth.hmac.encoding unexpected encoding base32, expected "hex" or "base64"`,
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q, expected %q", msg, expected)
+		}
+	}
+	if msg := parseError(t, "receive:\n  /e:\n    auth: {hmac: {secret_env: UNSET_SECRET}}\n"); !strings.Contains(msg, "receive[/e].auth.hmac.secret_env: $UNSET_SECRET is not set") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// captchaProviders are the siteverify endpoints and the form parameter
+// holding the token inserted by the provider widget
+var captchaProviders = map[string]struct {
+	verifyURL  string
+	tokenField string
+}{
+	"recaptcha": {"https://www.google.com/recaptcha/api/siteverify", "g-recaptcha-response"},
+	"hcaptcha":  {"https://api.hcaptcha.com/siteverify", "h-captcha-response"},
+	"turnstile": {"https://challenges.cloudflare.com/turnstile/v0/siteverify", "cf-turnstile-response"},
+}
+
+// ConfigCaptcha verifies the captcha token of the submission with the
+// provider before any action runs
+type ConfigCaptcha struct {
+	Provider   string        `yaml:"provider"`
+	SecretEnv  string        `yaml:"secret_env"`
+	TokenField string        `yaml:"token_field"`
+	VerifyURL  string        `yaml:"verify_url"`
+	MinScore   float64       `yaml:"min_score"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+func (c *ConfigCaptcha) parse(key string) (err error) {
+	provider, ok := captchaProviders[c.Provider]
+	if !ok {
+		err = multierror.Append(err, fmt.Errorf("%s.provider unexpected provider %v, expected \"recaptcha\", \"hcaptcha\" or \"turnstile\"", key, c.Provider)).ErrorOrNil()
+	}
+	if c.SecretEnv == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.secret_env is required", key)).ErrorOrNil()
+	} else if os.Getenv(c.SecretEnv) == "" {
+		log.Printf("[WARN] %s.secret_env: $%s is not set", key, c.SecretEnv)
+	}
+	if c.TokenField == "" {
+		c.TokenField = provider.tokenField
+	}
+	if c.VerifyURL == "" {
+		c.VerifyURL = provider.verifyURL
+	}
+	if c.MinScore < 0 || c.MinScore > 1 {
+		err = multierror.Append(err, fmt.Errorf("%s.min_score must be between 0 and 1 (got %v)", key, c.MinScore)).ErrorOrNil()
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultForwardTimeout
+	}
+	return err
+}
+
+// captchaResponse is the siteverify response common to the providers, the
+// score is only returned by reCAPTCHA v3
+type captchaResponse struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// Verify checks the token with the provider, on failure the response is
+// written and false is returned
+func (c *ConfigCaptcha) Verify(w http.ResponseWriter, r *Process) bool {
+	token := r.request.Form.Get(c.TokenField)
+	if token == "" {
+		http.Error(w, "Captcha verification failed.", http.StatusForbidden)
+		return false
+	}
+	res, err := c.verify(r.ctx, token, r.Meta.RemoteAddr)
+	if err != nil {
+		logError("Captcha verification with %s, %v", c.Provider, err)
+		http.Error(w, "Error verifying captcha", http.StatusBadGateway)
+		return false
+	}
+	if !res.Success || (c.MinScore > 0 && res.Score != nil && *res.Score < c.MinScore) {
+		log.Printf("[WARN] %s %s: captcha rejected for %s, %s", r.request.Method, r.request.URL.Path, r.Meta.RemoteAddr, strings.Join(res.ErrorCodes, ", "))
+		http.Error(w, "Captcha verification failed.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (c *ConfigCaptcha) verify(ctx context.Context, token, remoteAddr string) (*captchaResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	form := url.Values{
+		"secret":   {os.Getenv(c.SecretEnv)},
+		"response": {token},
+		"remoteip": {remoteAddr},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.VerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	var result captchaResponse
+	err = json.NewDecoder(res.Body).Decode(&result)
+	return &result, err
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCaptcha(t *testing.T) {
+	t.Setenv("CAPTCHA_SECRET", "secret")
+	var mu sync.Mutex
+	var verified []url.Values
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		verified = append(verified, r.PostForm)
+		mu.Unlock()
+		switch r.PostForm.Get("response") {
+		case "good":
+			fmt.Fprint(w, `{"success": true}`)
+		case "bot":
+			fmt.Fprint(w, `{"success": true, "score": 0.1}`)
+		case "down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, `{"success": false, "error-codes": ["invalid-input-response"]}`)
+		}
+	}))
+	defer provider.Close()
+
+	tests := []struct {
+		name     string
+		provider string
+		form     string
+		status   int
+		body     string
+		verified string
+	}{
+		{"valid", "recaptcha", "g-recaptcha-response=good", http.StatusSeeOther, "", "good"},
+		{"hcaptcha field", "hcaptcha", "h-captcha-response=good", http.StatusSeeOther, "", "good"},
+		{"turnstile field", "turnstile", "cf-turnstile-response=good", http.StatusSeeOther, "", "good"},
+		{"missing token", "recaptcha", "h-captcha-response=good", http.StatusForbidden, "Captcha verification failed.\n", ""},
+		{"invalid token", "recaptcha", "g-recaptcha-response=forged", http.StatusForbidden, "Captcha verification failed.\n", "forged"},
+		{"low score", "recaptcha", "g-recaptcha-response=bot", http.StatusForbidden, "Captcha verification failed.\n", "bot"},
+		{"provider error", "recaptcha", "g-recaptcha-response=down", http.StatusBadGateway, "Error verifying captcha\n", "down"},
+		// The single use token is left for the real submission
+		{"dry run", "recaptcha", "g-recaptcha-response=good&dry_run=1", http.StatusOK, "", ""},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    captcha: {provider: %s, secret_env: CAPTCHA_SECRET, verify_url: '%s', min_score: 0.5}
+`, tt.provider, provider.URL))
+		mu.Lock()
+		verified = nil
+		mu.Unlock()
+		w := submit(c, http.MethodPost, "/e", tt.form)
+		if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.name, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+		mu.Lock()
+		switch {
+		case tt.verified == "" && len(verified) != 0:
+			t.Errorf("%s: verified %v", tt.name, verified)
+		case tt.verified != "" && (len(verified) != 1 || verified[0].Get("response") != tt.verified || verified[0].Get("secret") != "secret" || verified[0].Get("remoteip") != "192.0.2.1"):
+			t.Errorf("%s: verified %v, expected %s", tt.name, verified, tt.verified)
+		}
+		mu.Unlock()
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    captcha: {provider: friendly, min_score: 2}\n")
+	for _, expected := range []string{
+		`receive[/e].captcha.provider unexpected provider friendly, expected "recaptcha", "hcaptcha" or "turnstile"`,
+		"receive[/e].captcha.secret_env is required",
+		"receive[/e].captcha.min_score must be between 0 and 1 (got 2)",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q, expected %q", msg, expected)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// baseDir returns the directory holding the created files: base_dir if set,
+// or else the directory part of the name template before its first action
+func (c *ConfigCreateFile) baseDir() string {
+	if c.BaseDir != "" {
+		return c.BaseDir
+	}
+	static := c.Name
+	if i := strings.Index(static, "{{"); i >= 0 {
+		static = static[:i]
+	}
+	return path.Dir(static + "x")
+}
+
+// CleanupTempFiles removes the temporary files older than maxAge left in
+// the directories of the create_file actions by an interrupted write
+func (c *Config) CleanupTempFiles(maxAge time.Duration) {
+	dirs := map[string]bool{}
+	for _, r := range c.Receive {
+		if r.CreateFile != nil && r.CreateFile.S3 == nil {
+			dirs[r.CreateFile.baseDir()] = true
+		}
+	}
+	for dir := range dirs {
+		err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() || !strings.HasPrefix(info.Name(), TempPrefix) || time.Since(info.ModTime()) < maxAge {
+				return nil
+			}
+			log.Printf("Remove stale temporary file %s", name)
+			err = os.Remove(name)
+			if err != nil {
+				log.Printf("[ERROR] Failed to remove stale temporary file %s, %v", name, err)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed to clean up temporary files in %s, %v", dir, err)
+		}
+	}
+}
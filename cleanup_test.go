@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBaseDir(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseDir  string
+		expected string
+	}{
+		{"data/contact.yaml", "", "data"},
+		{"data/{{ field.id }}/contact.yaml", "", "data"},
+		{"data/sub-{{ field.id }}.yaml", "", "data"},
+		{"{{ field.id }}.yaml", "", "."},
+		{"/srv/data/{{ field.id }}.yaml", "", "/srv/data"},
+		{"{{ field.dir }}/x.yaml", "/srv", "/srv"},
+	}
+	for _, tt := range tests {
+		c := &ConfigCreateFile{Name: tt.name, BaseDir: tt.baseDir}
+		if dir := c.baseDir(); dir != tt.expected {
+			t.Errorf("%s: base dir %q, expected %q", tt.name, dir, tt.expected)
+		}
+	}
+}
+
+func TestCleanupTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {id: {}}
+    create_file: {name: '%s/{{ field.id }}/rec.yaml'}
+  /missing:
+    create_file: {name: '%s/missing/rec.yaml'}
+`, dir, dir))
+	old := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		name    string
+		modTime time.Time
+		kept    bool
+	}{
+		{TempPrefix + "stale", old, false},
+		{"sub/" + TempPrefix + "stale", old, false},
+		{TempPrefix + "recent", time.Now(), true},
+		{"rec.yaml", old, true},
+		{"sub/rec.yaml", old, true},
+	}
+	for _, tt := range tests {
+		name := filepath.Join(dir, tt.name)
+		os.MkdirAll(filepath.Dir(name), 0755)
+		ioutil.WriteFile(name, nil, 0644)
+		os.Chtimes(name, tt.modTime, tt.modTime)
+	}
+	c.CleanupTempFiles(time.Hour)
+	for _, tt := range tests {
+		_, err := os.Stat(filepath.Join(dir, tt.name))
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s: kept %v, expected %v", tt.name, kept, tt.kept)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mildred/datamgr/util"
+)
+
+// clientIP returns the IP address of the client. When the direct peer is a
+// trusted proxy, the address is taken from the -client-ip-header or else the
+// X-Forwarded-For or X-Real-IP headers it sets.
+func clientIP(r *http.Request, options *Options) string {
+	trustedProxies := options.TrustedProxies
+	forwardedHeader := "X-Forwarded-For"
+	if options.ClientIPHeader != "" {
+		forwardedHeader = options.ClientIPHeader
+	}
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil || !util.ContainsIP(trustedProxies, peerIP) {
+		return peer
+	}
+
+	// Walk the forwarded chain from the nearest hop, the client is the first
+	// address that is not a trusted proxy
+	var forwarded []string
+	for _, header := range r.Header.Values(forwardedHeader) {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwarded = append(forwarded, addr)
+			}
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(forwarded[i])
+		if ip == nil {
+			break
+		}
+		if i == 0 || !util.ContainsIP(trustedProxies, ip) {
+			return ip.String()
+		}
+	}
+
+	if options.ClientIPHeader != "" {
+		return peer
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mildred/datamgr/util"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := util.ParseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		peer     string
+		header   string
+		headers  []string
+		expected string
+	}{
+		{"direct", "192.0.2.1:1234", "", nil, "192.0.2.1"},
+		{"untrusted peer", "192.0.2.1:1234", "", []string{"X-Forwarded-For", "198.51.100.7"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "", []string{"X-Forwarded-For", "198.51.100.7"}, "198.51.100.7"},
+		{"proxy chain", "10.0.0.1:1234", "", []string{"X-Forwarded-For", "203.0.113.9, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"spoofed chain", "10.0.0.1:1234", "", []string{"X-Forwarded-For", "garbage, 198.51.100.7"}, "198.51.100.7"},
+		{"only proxies", "10.0.0.1:1234", "", []string{"X-Forwarded-For", "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"real ip", "10.0.0.1:1234", "", []string{"X-Real-IP", "198.51.100.7"}, "198.51.100.7"},
+		{"no header", "10.0.0.1:1234", "", nil, "10.0.0.1"},
+		{"custom header", "10.0.0.1:1234", "CF-Connecting-IP", []string{"CF-Connecting-IP", "198.51.100.7"}, "198.51.100.7"},
+		{"custom header ignores others", "10.0.0.1:1234", "CF-Connecting-IP", []string{"X-Real-IP", "198.51.100.7"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = tt.peer
+		for i := 0; i+1 < len(tt.headers); i += 2 {
+			r.Header.Set(tt.headers[i], tt.headers[i+1])
+		}
+		ip := clientIP(r, &Options{TrustedProxies: proxies, ClientIPHeader: tt.header})
+		if ip != tt.expected {
+			t.Errorf("%s: client %s, expected %s", tt.name, ip, tt.expected)
+		}
+	}
+}
+
+func TestClientIPField(t *testing.T) {
+	proxies, _ := util.ParseCIDRs([]string{"192.0.2.1"})
+	c := parseConfigWith(t, Options{TrustedProxies: proxies}, `
+receive:
+  /e:
+    fields: {client: {source: remote_addr}}
+    action: echo
+`)
+	_, fields, body := echoFields(t, c, "/e", "", "X-Forwarded-For", "198.51.100.7")
+	if fields["client"] != "198.51.100.7" {
+		t.Errorf("client %#v (%s), expected the forwarded address", fields["client"], body)
+	}
+}
+
+func TestGenerateRemoteAddr(t *testing.T) {
+	proxies, _ := util.ParseCIDRs([]string{"192.0.2.1"})
+	tests := []struct {
+		name     string
+		options  Options
+		form     string
+		headers  []string
+		expected string
+	}{
+		{"peer", Options{}, "", []string{"X-Forwarded-For", "198.51.100.7"}, "192.0.2.1"},
+		{"trusted proxy", Options{TrustedProxies: proxies}, "", []string{"X-Forwarded-For", "198.51.100.7"}, "198.51.100.7"},
+		{"proxy header", Options{TrustedProxies: proxies, ClientIPHeader: "CF-Connecting-IP"}, "", []string{"X-Forwarded-For", "198.51.100.7", "CF-Connecting-IP", "203.0.113.9"}, "203.0.113.9"},
+		// The generated address overrides the submitted one
+		{"submitted", Options{}, "field.client=203.0.113.9", nil, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		c := parseConfigWith(t, tt.options, "receive:\n  /e:\n    fields: {client: {generate: remote_addr}}\n    action: echo\n")
+		_, fields, body := echoFields(t, c, "/e", tt.form, tt.headers...)
+		if fields["client"] != tt.expected {
+			t.Errorf("%s: client %#v (%s), expected %s", tt.name, fields["client"], body, tt.expected)
+		}
+	}
+}
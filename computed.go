@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"text/template/parse"
+)
+
+// templateFieldRefs returns the names of the fields referenced with .name in
+// a template
+func templateFieldRefs(node parse.Node, refs map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			templateFieldRefs(child, refs)
+		}
+	case *parse.ActionNode:
+		templateFieldRefs(n.Pipe, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			templateFieldRefs(cmd, refs)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			templateFieldRefs(arg, refs)
+		}
+	case *parse.ChainNode:
+		templateFieldRefs(n.Node, refs)
+	case *parse.FieldNode:
+		refs[n.Ident[0]] = true
+	case *parse.IfNode:
+		templateFieldRefs(n.Pipe, refs)
+		templateFieldRefs(n.List, refs)
+		templateFieldRefs(n.ElseList, refs)
+	case *parse.RangeNode:
+		templateFieldRefs(n.Pipe, refs)
+		templateFieldRefs(n.List, refs)
+		templateFieldRefs(n.ElseList, refs)
+	case *parse.WithNode:
+		templateFieldRefs(n.Pipe, refs)
+		templateFieldRefs(n.List, refs)
+		templateFieldRefs(n.ElseList, refs)
+	}
+}
+
+// parseComputed compiles the template of a template field and checks that it
+// only references other declared fields
+func (f *ConfigField) parseComputed(key, name string, fields map[string]ConfigField) (err error) {
+	f.template, err = parseFieldTemplate(key+".template", f.Template, name, fields)
+	return err
+}
+
+// parseFieldTemplate compiles a template rendered against the field values
+// and checks that it only references other declared fields
+func parseFieldTemplate(key, text, name string, fields map[string]ConfigField) (*template.Template, error) {
+	tmpl, err := template.New(key).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s error, %v", key, err)
+	}
+	refs := map[string]bool{}
+	templateFieldRefs(tmpl.Tree.Root, refs)
+	for ref := range refs {
+		if _, ok := fields[ref]; !ok || ref == name {
+			return nil, fmt.Errorf("%s references undeclared field %s", key, ref)
+		}
+	}
+	return tmpl, nil
+}
+
+// checkHashFields checks that a hash field only digests other declared
+// fields
+func (f *ConfigField) checkHashFields(key, name string, fields map[string]ConfigField) error {
+	for _, ref := range f.HashFields {
+		if _, ok := fields[ref]; !ok || ref == name {
+			return fmt.Errorf("%s.hash_fields references undeclared field %s", key, ref)
+		}
+	}
+	return nil
+}
+
+// hashFields returns the hex digest of the JSON encoded values of the
+// hash_fields, in the listed order
+func (f *ConfigField) hashFields(fields map[string]ConfigField) (string, error) {
+	values := make([]interface{}, 0, len(f.HashFields))
+	for _, ref := range f.HashFields {
+		values = append(values, jsonValue(fields[ref].Value))
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	digest := checksumAlgorithms[f.Algorithm]()
+	digest.Write(data)
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// computeFields renders the template and hash fields in configuration
+// order, each one seeing the values of the other fields
+func (c *Process) computeFields() error {
+	for _, name := range c.fieldNames() {
+		field := c.Fields[name]
+		if field.generateCode == GenerateCodeHash && field.Value == nil {
+			value, err := field.hashFields(c.Fields)
+			if err != nil {
+				return fmt.Errorf("cannot compute field field.%s, %v", name, err)
+			}
+			field.Value = value
+			c.Fields[name] = field
+			continue
+		}
+		if field.valueTemplate != nil && field.Value == nil {
+			s, err := c.renderFieldTemplate(field.valueTemplate)
+			if err != nil {
+				return fmt.Errorf("cannot compute field field.%s, %v", name, err)
+			}
+			field.Value, err = field.parseValue(c.ctx, name, s)
+			if err != nil {
+				return err
+			}
+			c.Fields[name] = field
+			continue
+		}
+		if field.typeCode != TypeCodeTemplate {
+			continue
+		}
+		s, err := c.renderFieldTemplate(field.template)
+		if err != nil {
+			return fmt.Errorf("cannot compute field field.%s, %v", name, err)
+		}
+		field.Value = s
+		c.Fields[name] = field
+	}
+	return nil
+}
+
+// renderFieldTemplate executes a template parsed with parseFieldTemplate,
+// unset fields are seen as empty strings
+func (c *Process) renderFieldTemplate(tmpl *template.Template) (string, error) {
+	data := map[string]interface{}{}
+	for other, f := range c.Fields {
+		if f.Value == nil {
+			data[other] = ""
+		} else {
+			data[other] = f.Value
+		}
+	}
+	var b bytes.Buffer
+	err := tmpl.Execute(&b, data)
+	return b.String(), err
+}
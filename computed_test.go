@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestComputedFields(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      first: {}
+      last: {}
+      full: {type: template, template: "{{ .first }} {{ .last }}"}
+      title: {type: template, template: "{{ if .last }}Dear {{ .full }}{{ else }}Hello{{ end }}"}
+      key: {generate: hash, hash_fields: [last, first]}
+      slug: {value: "{{ .first }}-{{ .last }}"}
+    action: echo
+`)
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	tests := []struct {
+		form     string
+		expected map[string]interface{}
+	}{
+		{
+			form: "field.first=Ada&field.last=Lovelace",
+			expected: map[string]interface{}{
+				"full":  "Ada Lovelace",
+				"title": "Dear Ada Lovelace",
+				"key":   hash(`["Lovelace","Ada"]`),
+				"slug":  "Ada-Lovelace",
+			},
+		},
+		{
+			form: "field.first=Ada",
+			expected: map[string]interface{}{
+				"full":  "Ada ",
+				"title": "Hello",
+				"key":   hash(`[null,"Ada"]`),
+				"slug":  "Ada-",
+			},
+		},
+		{
+			form:     "field.first=Ada&field.full=forged&field.slug=mine",
+			expected: map[string]interface{}{"full": "Ada ", "slug": "mine"},
+		},
+	}
+	for _, tt := range tests {
+		_, fields, body := echoFields(t, c, "/e", tt.form)
+		for name, value := range tt.expected {
+			if fields[name] != value {
+				t.Errorf("%s: field %s = %#v, expected %#v (%s)", tt.form, name, fields[name], value, body)
+			}
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{`{type: template, template: "{{ .missing }}"}`, "receive[/e].fields.a.template references undeclared field missing"},
+		{`{type: template, template: "{{ .a }}"}`, "receive[/e].fields.a.template references undeclared field a"},
+		{`{type: template, template: "{{ .b"}`, "receive[/e].fields.a.template error"},
+		{`{value: "{{ .missing }}"}`, "receive[/e].fields.a.value references undeclared field missing"},
+		{`{generate: hash, hash_fields: [missing]}`, "receive[/e].fields.a.hash_fields references undeclared field missing"},
+		{`{generate: hash}`, "receive[/e].fields.a.hash_fields is required for hash fields"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    action: none\n    fields: {b: {}, a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestFieldValueTemplate(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      count: {}
+      total: {type: int, value: "{{ .count }}00"}
+      label: {value: "{{ .count }} items"}
+      fixed: {value: plain}
+    action: echo
+`)
+	tests := []struct {
+		form     string
+		status   int
+		expected map[string]interface{}
+		message  string
+	}{
+		// The rendered value is parsed with the type of the field
+		{"field.count=3", http.StatusOK, map[string]interface{}{"total": 300.0, "label": "3 items", "fixed": "plain"}, ""},
+		{"field.count=3&field.total=7", http.StatusOK, map[string]interface{}{"total": 7.0, "label": "3 items"}, ""},
+		{"field.count=x", http.StatusBadRequest, nil, "cannot parse field field.total"},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status || !strings.Contains(body, tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, status, body, tt.status, tt.message)
+		}
+		for name, value := range tt.expected {
+			if fields[name] != value {
+				t.Errorf("%s: field %s = %#v, expected %#v", tt.form, name, fields[name], value)
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+var unknownFieldError = regexp.MustCompile(`^line (\d+): field (\S+) not found in type (\S+)$`)
+
+// yamlTypeNames maps the configuration types to their place in the YAML file
+var yamlTypeNames = map[string]string{
+	"main.Config":        "top level",
+	"main.ConfigReceive": "receive endpoint",
+	// ConfigReceive is decoded as plainConfigReceive by its UnmarshalYAML
+	"main.plainConfigReceive": "receive endpoint",
+	"main.ConfigField":        "field",
+	"main.ConfigCreateFile":   "create_file",
+}
+
+// yamlError splits YAML decoding errors, which already carry their line
+// numbers, and rewords unknown option errors
+func yamlError(err error) error {
+	var typeError *yaml.TypeError
+	if !errors.As(err, &typeError) {
+		return err
+	}
+	var res error
+	for _, e := range typeError.Errors {
+		if m := unknownFieldError.FindStringSubmatch(e); m != nil {
+			where, ok := yamlTypeNames[m[3]]
+			if !ok {
+				where = m[3]
+			}
+			e = fmt.Sprintf("line %s: unknown %s option %q", m[1], where, m[2])
+		}
+		res = multierror.Append(res, errors.New(e))
+	}
+	return res
+}
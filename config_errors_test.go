@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		messages []string
+	}{
+		{
+			name:     "top level",
+			config:   "recieve:\n  /e: {action: none}\n",
+			messages: []string{`line 1: unknown top level option "recieve"`},
+		},
+		{
+			name:     "endpoint",
+			config:   "receive:\n  /e:\n    action: none\n    methdos: [POST]\n",
+			messages: []string{`line 4: unknown receive endpoint option "methdos"`},
+		},
+		{
+			name:     "field",
+			config:   "receive:\n  /e:\n    action: none\n    fields:\n      a: {requried: true}\n",
+			messages: []string{`line 5: unknown field option "requried"`},
+		},
+		{
+			name:     "create_file",
+			config:   "receive:\n  /e:\n    create_file:\n      name: x.yaml\n      fromat: json\n",
+			messages: []string{`line 5: unknown create_file option "fromat"`},
+		},
+		{
+			name:   "several options",
+			config: "foo: 1\nreceive:\n  /e:\n    bar: 2\n",
+			messages: []string{
+				`line 1: unknown top level option "foo"`,
+				`line 4: unknown receive endpoint option "bar"`,
+			},
+		},
+		{
+			name:     "type mismatch",
+			config:   "receive:\n  /e:\n    action: none\n    max_concurrent: many\n",
+			messages: []string{"line 4: cannot unmarshal"},
+		},
+	}
+	for _, tt := range tests {
+		msg := parseError(t, tt.config)
+		for _, expected := range tt.messages {
+			if !strings.Contains(msg, expected) {
+				t.Errorf("%s: error %q, expected %q", tt.name, msg, expected)
+			}
+		}
+	}
+}
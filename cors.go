@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// ConfigCORS lets pages of other origins submit to the endpoint with fetch()
+// or XMLHttpRequest. Origins are exact like "https://example.com", patterns
+// like "https://*.example.com" or "*" for any origin.
+type ConfigCORS struct {
+	Origins       []string      `yaml:"origins"`
+	Methods       []string      `yaml:"methods"`
+	Headers       []string      `yaml:"headers"`
+	ExposeHeaders []string      `yaml:"expose_headers"`
+	Credentials   bool          `yaml:"credentials"`
+	MaxAge        time.Duration `yaml:"max_age"`
+}
+
+// parse checks the origins and defaults the methods to those of the endpoint
+// and the headers to those its auth and csrf blocks read
+func (c *ConfigCORS) parse(key string, r *ConfigReceive) (err error) {
+	if len(c.Origins) == 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.origins is required", key)).ErrorOrNil()
+	}
+	for _, origin := range c.Origins {
+		if _, e := path.Match(origin, ""); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s.origins: invalid pattern %q, %v", key, origin, e)).ErrorOrNil()
+		}
+		if origin == "*" && c.Credentials {
+			err = multierror.Append(err, fmt.Errorf("%s.credentials is not allowed with any origin \"*\"", key)).ErrorOrNil()
+		}
+	}
+	if c.MaxAge < 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.max_age must be positive", key)).ErrorOrNil()
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = r.Methods
+	}
+	if len(c.Methods) == 0 {
+		c.Methods = []string{http.MethodGet, http.MethodPost}
+	}
+	if len(c.Headers) == 0 {
+		c.Headers = []string{"Accept", "Content-Type", "Content-Encoding"}
+		if r.Auth != nil {
+			c.Headers = append(c.Headers, "Authorization", r.Auth.Header)
+			if r.Auth.HMAC != nil {
+				c.Headers = append(c.Headers, r.Auth.HMAC.Header)
+			}
+		}
+		if r.CSRF != nil {
+			c.Headers = append(c.Headers, r.CSRF.Header)
+		}
+	}
+	return err
+}
+
+func (c *ConfigCORS) allowsOrigin(origin string) bool {
+	for _, o := range c.Origins {
+		if ok, _ := path.Match(o, origin); ok || o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ConfigCORS) anyOrigin() bool {
+	for _, o := range c.Origins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle adds the CORS headers to the response of a cross origin request and
+// answers the preflight requests, it returns true if the response is written
+func (c *ConfigCORS) Handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if origin == "" {
+		return false
+	}
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if !c.allowsOrigin(origin) {
+		if preflight {
+			log.Printf("%s %s: 403 Origin %s not allowed", r.Method, r.URL.Path, origin)
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+	if c.anyOrigin() {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(c.ExposeHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+		}
+		return false
+	}
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+	h.Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ", "))
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
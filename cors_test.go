@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name     string
+		cors     string
+		method   string
+		headers  []string
+		status   int
+		expected map[string]string
+	}{
+		{
+			name:    "preflight",
+			cors:    "{origins: ['https://example.com'], max_age: 10m}",
+			method:  http.MethodOptions,
+			headers: []string{"Origin", "https://example.com", "Access-Control-Request-Method", "POST"},
+			status:  http.StatusNoContent,
+			expected: map[string]string{
+				"Access-Control-Allow-Origin":      "https://example.com",
+				"Access-Control-Allow-Methods":     "PUT, POST",
+				"Access-Control-Allow-Headers":     "Accept, Content-Type, Content-Encoding, Authorization, X-API-Key",
+				"Access-Control-Max-Age":           "600",
+				"Access-Control-Allow-Credentials": "",
+				"Vary":                             "Origin, Access-Control-Request-Method, Access-Control-Request-Headers",
+			},
+		},
+		{
+			name:     "pattern",
+			cors:     "{origins: ['https://*.example.com'], methods: [POST], headers: [X-Custom]}",
+			method:   http.MethodOptions,
+			headers:  []string{"Origin", "https://www.example.com", "Access-Control-Request-Method", "POST"},
+			status:   http.StatusNoContent,
+			expected: map[string]string{"Access-Control-Allow-Origin": "https://www.example.com", "Access-Control-Allow-Methods": "POST", "Access-Control-Allow-Headers": "X-Custom"},
+		},
+		{
+			name:     "disallowed preflight",
+			cors:     "{origins: ['https://*.example.com']}",
+			method:   http.MethodOptions,
+			headers:  []string{"Origin", "https://example.com.evil.org", "Access-Control-Request-Method", "POST"},
+			status:   http.StatusForbidden,
+			expected: map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"},
+		},
+		{
+			// The submission is processed, the browser hides the response
+			name:     "disallowed origin",
+			cors:     "{origins: ['https://example.com']}",
+			method:   http.MethodPost,
+			headers:  []string{"Origin", "https://evil.org", "X-API-Key", "k"},
+			status:   http.StatusOK,
+			expected: map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"},
+		},
+		{
+			name:     "credentials",
+			cors:     "{origins: ['https://example.com'], credentials: true, expose_headers: [Location]}",
+			method:   http.MethodPost,
+			headers:  []string{"Origin", "https://example.com", "X-API-Key", "k"},
+			status:   http.StatusOK,
+			expected: map[string]string{"Access-Control-Allow-Origin": "https://example.com", "Access-Control-Allow-Credentials": "true", "Access-Control-Expose-Headers": "Location", "Vary": "Origin"},
+		},
+		{
+			name:     "any origin",
+			cors:     "{origins: ['*']}",
+			method:   http.MethodPost,
+			headers:  []string{"Origin", "https://example.com", "X-API-Key", "k"},
+			status:   http.StatusOK,
+			expected: map[string]string{"Access-Control-Allow-Origin": "*"},
+		},
+		{
+			name:     "same origin",
+			cors:     "{origins: ['https://example.com']}",
+			method:   http.MethodPost,
+			headers:  []string{"X-API-Key", "k"},
+			status:   http.StatusOK,
+			expected: map[string]string{"Access-Control-Allow-Origin": "", "Vary": ""},
+		},
+		{
+			// The preflight requests carry no credentials
+			name:     "preflight before auth",
+			cors:     "{origins: ['https://example.com']}",
+			method:   http.MethodOptions,
+			headers:  []string{"Origin", "https://example.com", "Access-Control-Request-Method", "PUT"},
+			status:   http.StatusNoContent,
+			expected: map[string]string{"Access-Control-Allow-Origin": "https://example.com"},
+		},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, "receive:\n  /e:\n    methods: [PUT, POST]\n    auth: {api_keys: [k]}\n    cors: "+tt.cors+"\n    action: echo\n")
+		w := submit(c, tt.method, "/e", "", tt.headers...)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.name, w.Code, tt.status, w.Body.String())
+		}
+		for header, expected := range tt.expected {
+			if got := strings.Join(w.Header().Values(header), ", "); got != expected {
+				t.Errorf("%s: %s %q, expected %q", tt.name, header, got, expected)
+			}
+		}
+	}
+
+	// The headers default to those read by the auth and csrf blocks
+	t.Setenv("WEBHOOK_SECRET", "secret")
+	c := parseConfig(t, "receive:\n  /e:\n    auth: {hmac: {secret_env: WEBHOOK_SECRET}}\n    csrf: {header: X-Token}\n    cors: {origins: ['*']}\n")
+	if headers := strings.Join(c.Receive["/e"].CORS.Headers, ", "); headers != "Accept, Content-Type, Content-Encoding, Authorization, X-API-Key, X-Hub-Signature-256, X-Token" {
+		t.Errorf("headers %s", headers)
+	}
+	if methods := strings.Join(c.Receive["/e"].CORS.Methods, ", "); methods != "GET, POST" {
+		t.Errorf("methods %s", methods)
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    cors: {origins: ['*', 'https://[x'], credentials: true, max_age: -1s}\n")
+	for _, expected := range []string{
+		`receive[/e].cors.origins: invalid pattern "https://[x"`,
+		`receive[/e].cors.credentials is not allowed with any origin "*"`,
+		"receive[/e].cors.max_age must be positive",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q, expected %q", msg, expected)
+		}
+	}
+	if msg := parseError(t, "receive:\n  /e:\n    cors: {}\n"); !strings.Contains(msg, "receive[/e].cors.origins is required") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	DefaultCSRFCookie = "datamgr_csrf"
+	DefaultCSRFField  = "csrf_token"
+	DefaultCSRFHeader = "X-CSRF-Token"
+	DefaultCSRFMaxAge = 24 * time.Hour
+)
+
+// csrfSecret is the key signing the CSRF tokens of the endpoints without
+// secret_env, it is generated once per process so the tokens survive the
+// configuration reloads but not the restarts
+var csrfSecret = sync.OnceValue(func() []byte {
+	var b [32]byte
+	rand.Read(b[:])
+	return b[:]
+})
+
+// ConfigCSRF requires the submissions to carry the token issued with a GET
+// on the endpoint with ?csrf=1. The token is the HMAC of a random session
+// identifier kept in a cookie, so that another site cannot forge it, and of
+// its issue time so that it expires after max_age.
+type ConfigCSRF struct {
+	SecretEnv string        `yaml:"secret_env"`
+	Cookie    string        `yaml:"cookie"`
+	Field     string        `yaml:"field"`
+	Header    string        `yaml:"header"`
+	MaxAge    time.Duration `yaml:"max_age"`
+}
+
+func (c *ConfigCSRF) parse(key string) (err error) {
+	if c.SecretEnv != "" && os.Getenv(c.SecretEnv) == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.secret_env: $%s is not set", key, c.SecretEnv)).ErrorOrNil()
+	}
+	if c.Cookie == "" {
+		c.Cookie = DefaultCSRFCookie
+	}
+	if c.Field == "" {
+		c.Field = DefaultCSRFField
+	}
+	if c.Header == "" {
+		c.Header = DefaultCSRFHeader
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = DefaultCSRFMaxAge
+	}
+	if c.MaxAge < 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.max_age must be positive", key)).ErrorOrNil()
+	}
+	return err
+}
+
+// token returns the issue time in Unix seconds followed by the signature of
+// the session and the issue time
+func (c *ConfigCSRF) token(session string, issued int64) string {
+	secret := csrfSecret()
+	if c.SecretEnv != "" {
+		secret = []byte(os.Getenv(c.SecretEnv))
+	}
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s.%d", session, issued)
+	return fmt.Sprintf("%d.%s", issued, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// valid tells if the token was issued for the session less than max_age ago
+func (c *ConfigCSRF) valid(given, session string) bool {
+	issued, err := strconv.ParseInt(strings.SplitN(given, ".", 2)[0], 10, 64)
+	if err != nil || time.Since(time.Unix(issued, 0)) > c.MaxAge {
+		return false
+	}
+	return hmac.Equal([]byte(given), []byte(c.token(session, issued)))
+}
+
+// Issue responds with the token of the session, starting a new session if
+// the request has none
+func (c *ConfigCSRF) Issue(w http.ResponseWriter, r *http.Request, endpoint string) {
+	var session string
+	if cookie, err := r.Cookie(c.Cookie); err == nil && len(cookie.Value) == 32 {
+		session = cookie.Value
+	} else {
+		var b [16]byte
+		rand.Read(b[:])
+		session = hex.EncodeToString(b[:])
+		http.SetCookie(w, &http.Cookie{
+			Name:     c.Cookie,
+			Value:    session,
+			Path:     endpoint,
+			MaxAge:   int(c.MaxAge.Seconds()),
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(map[string]string{"token": c.token(session, time.Now().Unix()), "field": c.Field})
+	if err != nil {
+		logError("Failed to encode response, %v", err)
+	}
+}
+
+// Check verifies the token of the submission in the header or the form
+// field, whatever the method since GET submissions are accepted too. On
+// failure it responds 403 and returns false.
+func (c *ConfigCSRF) Check(w http.ResponseWriter, r *http.Request) bool {
+	given := r.Header.Get(c.Header)
+	if given == "" {
+		given = r.Form.Get(c.Field)
+	}
+	cookie, err := r.Cookie(c.Cookie)
+	if err != nil || given == "" || !c.valid(given, cookie.Value) {
+		log.Printf("%s %s: 403 Invalid CSRF token", r.Method, r.URL.Path)
+		http.Error(w, "Invalid CSRF token.", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueCSRF fetches a token, in the session of cookie if not empty, and
+// returns it along with the session cookie
+func issueCSRF(t *testing.T, h http.Handler, cookie string) (string, string) {
+	var headers []string
+	if cookie != "" {
+		headers = []string{"Cookie", cookie}
+	}
+	w := submit(h, http.MethodGet, "/e?csrf=1", "", headers...)
+	var res struct {
+		Token string `json:"token"`
+		Field string `json:"field"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK || res.Field != "csrf_token" {
+		t.Fatalf("status %d %q, %v", w.Code, w.Body.String(), err)
+	}
+	if set := w.Result().Cookies(); len(set) > 0 {
+		cookie = set[0].Name + "=" + set[0].Value
+	}
+	return res.Token, cookie
+}
+
+func TestCSRF(t *testing.T) {
+	c := parseConfig(t, "receive:\n  /e:\n    strict_fields: true\n    fields: {name: {}}\n    csrf: {max_age: 1h}\n    action: echo\n")
+	token, cookie := issueCSRF(t, c, "")
+	w := submit(c, http.MethodGet, "/e?csrf=1", "")
+	if set := w.Result().Cookies(); len(set) != 1 || set[0].Name != "datamgr_csrf" || set[0].Path != "/e" || !set[0].HttpOnly || set[0].SameSite != http.SameSiteLaxMode || set[0].MaxAge != 3600 {
+		t.Errorf("session cookie %v", set)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("Cache-Control %q", w.Header().Get("Cache-Control"))
+	}
+
+	// The session is kept by the later requests
+	if _, kept := issueCSRF(t, c, cookie); kept != cookie {
+		t.Errorf("new session %s", kept)
+	}
+	other, otherCookie := issueCSRF(t, c, "")
+	session := strings.TrimPrefix(cookie, "datamgr_csrf=")
+	expired := c.Receive["/e"].CSRF.token(session, time.Now().Add(-2*time.Hour).Unix())
+	// The issue time cannot be changed without the signature
+	parts := strings.SplitN(expired, ".", 2)
+	postdated := fmt.Sprint(time.Now().Unix()) + "." + parts[1]
+
+	tests := []struct {
+		name    string
+		form    string
+		headers []string
+		status  int
+	}{
+		{"form field", "field.name=a&csrf_token=" + token, []string{"Cookie", cookie}, http.StatusOK},
+		{"header", "field.name=a", []string{"Cookie", cookie, "X-CSRF-Token", token}, http.StatusOK},
+		{"missing token", "field.name=a", []string{"Cookie", cookie}, http.StatusForbidden},
+		{"missing cookie", "field.name=a&csrf_token=" + token, nil, http.StatusForbidden},
+		{"other session", "field.name=a&csrf_token=" + other, []string{"Cookie", cookie}, http.StatusForbidden},
+		{"other session cookie", "field.name=a&csrf_token=" + token, []string{"Cookie", otherCookie}, http.StatusForbidden},
+		{"expired", "field.name=a&csrf_token=" + expired, []string{"Cookie", cookie}, http.StatusForbidden},
+		{"postdated", "field.name=a&csrf_token=" + postdated, []string{"Cookie", cookie}, http.StatusForbidden},
+		{"malformed", "field.name=a&csrf_token=token", []string{"Cookie", cookie}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", tt.form, tt.headers...)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.name, w.Code, tt.status, w.Body.String())
+		}
+		if tt.status == http.StatusForbidden && w.Body.String() != "Invalid CSRF token.\n" {
+			t.Errorf("%s: body %q", tt.name, w.Body.String())
+		}
+	}
+
+	// The tokens survive the reloads unless the secret changes
+	t.Setenv("CSRF_SECRET", "secret")
+	reloaded := parseConfig(t, "receive:\n  /e:\n    fields: {name: {}}\n    csrf: {}\n    action: echo\n")
+	if w := submit(reloaded, http.MethodPost, "/e", "csrf_token="+token, "Cookie", cookie); w.Code != http.StatusOK {
+		t.Errorf("reloaded: status %d", w.Code)
+	}
+	signed := parseConfig(t, "receive:\n  /e:\n    fields: {name: {}}\n    csrf: {secret_env: CSRF_SECRET}\n    action: echo\n")
+	if w := submit(signed, http.MethodPost, "/e", "csrf_token="+token, "Cookie", cookie); w.Code != http.StatusForbidden {
+		t.Errorf("other secret: status %d", w.Code)
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    csrf: {secret_env: UNSET_SECRET, max_age: -1s}\n")
+	for _, expected := range []string{"receive[/e].csrf.secret_env: $UNSET_SECRET is not set", "receive[/e].csrf.max_age must be positive"} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q, expected %q", msg, expected)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/hashicorp/go-multierror"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	sqlIdentifier    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	sqlNonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+)
+
+// databases are the opened databases, shared across configuration reloads
+var databases sync.Map
+
+// createdTables remembers the tables known to exist
+var createdTables sync.Map
+
+// sqlDialect holds what differs between the supported databases
+type sqlDialect struct {
+	quote       func(name string) string
+	placeholder func(i int) string
+	types       map[string]string
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"sqlite3": {
+		quote:       quoteIdentifier,
+		placeholder: func(int) string { return "?" },
+		types:       map[string]string{},
+	},
+	"postgres": {
+		quote:       quoteIdentifier,
+		placeholder: func(i int) string { return fmt.Sprintf("$%d", i+1) },
+		types:       map[string]string{"INTEGER": "BIGINT", "REAL": "DOUBLE PRECISION", "TIMESTAMP": "TIMESTAMPTZ"},
+	},
+	"mysql": {
+		quote:       func(name string) string { return "`" + strings.ReplaceAll(name, "`", "``") + "`" },
+		placeholder: func(int) string { return "?" },
+		types:       map[string]string{"INTEGER": "BIGINT", "REAL": "DOUBLE", "TIMESTAMP": "DATETIME(6)"},
+	},
+}
+
+// ConfigCreateRecord is the create_record action, inserting each submission
+// as a row of a SQL table. Columns are derived from the fields, along with
+// the request id and reception time.
+type ConfigCreateRecord struct {
+	Driver   string `yaml:"driver"`
+	DSN      string `yaml:"dsn"`
+	Database string `yaml:"database"` // SQLite file, shorthand for the dsn
+	Table    string `yaml:"table"`
+	dialect  *sqlDialect
+	columns  []string
+	types    []string
+}
+
+func (c *ConfigCreateRecord) parse(key, endpoint string, r *ConfigReceive) (err error) {
+	if c.Driver == "" {
+		c.Driver = "sqlite3"
+	}
+	c.dialect = sqlDialects[c.Driver]
+	if c.dialect == nil {
+		err = multierror.Append(err, fmt.Errorf("%s.driver unexpected driver %v, expected \"sqlite3\", \"postgres\" or \"mysql\"", key, c.Driver)).ErrorOrNil()
+		c.dialect = sqlDialects["sqlite3"]
+	}
+	if c.DSN == "" && c.Driver == "sqlite3" {
+		c.DSN = c.Database
+	} else if c.Database != "" {
+		err = multierror.Append(err, fmt.Errorf("%s.database is only allowed for sqlite3 without dsn", key)).ErrorOrNil()
+	}
+	if c.DSN == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.dsn is required", key)).ErrorOrNil()
+	}
+	if c.Table == "" {
+		c.Table = strings.Trim(sqlNonIdentifier.ReplaceAllString(endpoint, "_"), "_")
+	}
+	if !sqlIdentifier.MatchString(c.Table) {
+		err = multierror.Append(err, fmt.Errorf("%s.table %q is not a valid table name", key, c.Table)).ErrorOrNil()
+	}
+	c.columns = []string{"_request_id", "_received_at"}
+	c.types = []string{"TEXT", "TIMESTAMP"}
+	for _, name := range r.declaredFieldNames() {
+		f := r.Fields[name]
+		c.columns = append(c.columns, name)
+		c.types = append(c.types, f.sqlType())
+	}
+	for i, t := range c.types {
+		if specific, ok := c.dialect.types[t]; ok {
+			c.types[i] = specific
+		}
+	}
+	return err
+}
+
+// sqlType returns the column type storing the field values, the dialect may
+// replace it with its own type
+func (f *ConfigField) sqlType() string {
+	if f.Multiple {
+		return "TEXT"
+	}
+	switch f.typeCode {
+	case TypeCodeInt, TypeCodeUint:
+		return "INTEGER"
+	case TypeCodeFloat:
+		return "REAL"
+	case TypeCodeBool:
+		return "BOOLEAN"
+	default:
+		return "TEXT"
+	}
+}
+
+// sqlValue converts a field value for insertion, lists and records are
+// stored as JSON
+func sqlValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool, int64, uint64, float64:
+		return v, nil
+	default:
+		data, err := json.Marshal(jsonValue(v))
+		return string(data), err
+	}
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (c *ConfigCreateRecord) open() (*sql.DB, error) {
+	key := c.Driver + "\x00" + c.DSN
+	if db, ok := databases.Load(key); ok {
+		return db.(*sql.DB), nil
+	}
+	db, err := sql.Open(c.Driver, c.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if prev, loaded := databases.LoadOrStore(key, db); loaded {
+		db.Close()
+		return prev.(*sql.DB), nil
+	}
+	return db, nil
+}
+
+// table creates the table if it was not seen yet. Existing tables are not
+// altered when fields are added to the configuration.
+func (c *ConfigCreateRecord) table(r *Process, db *sql.DB) error {
+	key := c.Driver + "\x00" + c.DSN + "\x00" + c.Table
+	if _, ok := createdTables.Load(key); ok {
+		return nil
+	}
+	columns := make([]string, len(c.columns))
+	for i, name := range c.columns {
+		columns[i] = c.dialect.quote(name) + " " + c.types[i]
+	}
+	_, err := db.ExecContext(r.ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", c.dialect.quote(c.Table), strings.Join(columns, ", ")))
+	if err != nil {
+		return err
+	}
+	createdTables.Store(key, true)
+	return nil
+}
+
+// Perform inserts the submission in the table
+func (c *ConfigCreateRecord) Perform(w http.ResponseWriter, r *Process) bool {
+	db, err := c.open()
+	if err == nil {
+		err = c.table(r, db)
+	}
+	if err != nil {
+		storageError(w, fmt.Sprintf("open table %s of the %s database", c.Table, c.Driver), err)
+		return false
+	}
+
+	columns := make([]string, len(c.columns))
+	placeholders := make([]string, len(c.columns))
+	values := []interface{}{r.Meta.RequestID, r.Meta.ReceivedAt}
+	for i, name := range c.columns {
+		columns[i] = c.dialect.quote(name)
+		placeholders[i] = c.dialect.placeholder(i)
+		if i < 2 {
+			continue
+		}
+		value, err := sqlValue(r.Fields[name].Value)
+		if err != nil {
+			logError("Failed to encode field.%s for table %s, %v", name, c.Table, err)
+			http.Error(w, "Could not process request because of data error.", http.StatusInternalServerError)
+			return false
+		}
+		values = append(values, value)
+	}
+
+	log.Printf("[DEBUG] Insert record into %s of the %s database", c.Table, c.Driver)
+	_, err = db.ExecContext(r.ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", c.dialect.quote(c.Table), strings.Join(columns, ", "), strings.Join(placeholders, ", ")), values...)
+	if err != nil {
+		storageError(w, fmt.Sprintf("insert into table %s of the %s database", c.Table, c.Driver), err)
+		return false
+	}
+	return true
+}
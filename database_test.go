@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateRecordSQLite(t *testing.T) {
+	database := filepath.Join(t.TempDir(), "records.db")
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /contact/form:
+    fields:
+      name: {}
+      age: {type: int}
+      score: {type: float}
+      subscribed: {type: bool}
+      tags: {multiple: true}
+    create_record: {database: %s}
+`, database))
+	tests := []struct {
+		form     string
+		expected string
+	}{
+		{"field.name=Alice&field.age=30&field.score=1.5&field.subscribed=true&field.tags=a&field.tags=b", `Alice|30|1.5|true|["a","b"]`},
+		{"field.name=Bob", "Bob|<nil>|<nil>|<nil>|"},
+	}
+	for _, tt := range tests {
+		if w := submit(c, http.MethodPost, "/contact/form", tt.form); w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: status %d, %s", tt.form, w.Code, w.Body.String())
+		}
+	}
+
+	db, err := sql.Open("sqlite3", database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The table is named after the endpoint
+	rows, err := db.Query(`SELECT _request_id, _received_at, name, age, score, subscribed, tags FROM contact_form ORDER BY _received_at`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for _, tt := range tests {
+		if !rows.Next() {
+			t.Fatalf("%s: missing row, %v", tt.form, rows.Err())
+		}
+		var id, name string
+		var tags sql.NullString
+		var receivedAt, age, score, subscribed interface{}
+		err := rows.Scan(&id, &receivedAt, &name, &age, &score, &subscribed, &tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join([]string{name, fmt.Sprint(age), fmt.Sprint(score), fmt.Sprint(subscribed), tags.String}, "|")
+		if got != tt.expected || id == "" || receivedAt == nil {
+			t.Errorf("%s: row %s %v %s, expected %s", tt.form, id, receivedAt, got, tt.expected)
+		}
+	}
+	if rows.Next() {
+		t.Error("unexpected extra row")
+	}
+
+	errors := []struct {
+		config  string
+		message string
+	}{
+		{"{}", "receive[/e].create_record.dsn is required"},
+		{"{driver: oracle, dsn: x}", `receive[/e].create_record.driver unexpected driver oracle, expected "sqlite3", "postgres" or "mysql"`},
+		{"{database: x.db, table: 'a b'}", `receive[/e].create_record.table "a b" is not a valid table name`},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    create_record: "+tt.config+"\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.config, msg, tt.message)
+		}
+	}
+}
+
+func TestCreateRecordDialects(t *testing.T) {
+	tests := []struct {
+		driver       string
+		types        string
+		name         string
+		quoted       string
+		placeholders string
+	}{
+		{"sqlite3", "TEXT TIMESTAMP INTEGER REAL BOOLEAN TEXT", `a"b`, `"a""b"`, "? ?"},
+		{"postgres", "TEXT TIMESTAMPTZ BIGINT DOUBLE PRECISION BOOLEAN TEXT", `a"b`, `"a""b"`, "$1 $2"},
+		{"mysql", "TEXT DATETIME(6) BIGINT DOUBLE BOOLEAN TEXT", "a`b", "`a``b`", "? ?"},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {count: {type: int}, score: {type: float}, subscribed: {type: bool}, tags: {type: int, multiple: true}}
+    create_record: {driver: %s, dsn: x, table: records}
+`, tt.driver))
+		create := c.Receive["/e"].CreateRecord
+		if columns := strings.Join(create.columns, " "); columns != "_request_id _received_at count score subscribed tags" {
+			t.Errorf("%s: columns %s", tt.driver, columns)
+		}
+		if types := strings.Join(create.types, " "); types != tt.types {
+			t.Errorf("%s: types %s, expected %s", tt.driver, types, tt.types)
+		}
+		if quoted := create.dialect.quote(tt.name); quoted != tt.quoted {
+			t.Errorf("%s: quoted %s, expected %s", tt.driver, quoted, tt.quoted)
+		}
+		if placeholders := create.dialect.placeholder(0) + " " + create.dialect.placeholder(1); placeholders != tt.placeholders {
+			t.Errorf("%s: placeholders %s, expected %s", tt.driver, placeholders, tt.placeholders)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    create_record: {driver: postgres, database: x.db}\n")
+	if !strings.Contains(msg, "receive[/e].create_record.database is only allowed for sqlite3 without dsn") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// DefaultEmailTimeout bounds the SMTP conversation of send_email
+const DefaultEmailTimeout = 30 * time.Second
+
+// ConfigSendEmail is the send_email action, mailing the submission through
+// an SMTP server with a subject and body rendered from the fields
+type ConfigSendEmail struct {
+	SMTP            string   `yaml:"smtp"`
+	Username        string   `yaml:"username"`
+	PasswordEnv     string   `yaml:"password_env"`
+	From            string   `yaml:"from"`
+	To              []string `yaml:"to"`
+	ReplyTo         string   `yaml:"reply_to"`
+	replyToTemplate *template.Template
+	Subject         string `yaml:"subject"`
+	subjectTemplate *template.Template
+	Body            string `yaml:"body"`
+	bodyTemplate    *template.Template
+	Timeout         time.Duration `yaml:"timeout"`
+}
+
+func (c *ConfigSendEmail) parse(key string) (err error) {
+	if _, _, e := net.SplitHostPort(c.SMTP); e != nil {
+		err = multierror.Append(err, fmt.Errorf("%s.smtp must be a host:port address, %v", key, e)).ErrorOrNil()
+	}
+	if _, e := mail.ParseAddress(c.From); e != nil {
+		err = multierror.Append(err, fmt.Errorf("%s.from %v", key, e)).ErrorOrNil()
+	}
+	if len(c.To) == 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.to is required", key)).ErrorOrNil()
+	}
+	for _, to := range c.To {
+		if _, e := mail.ParseAddress(to); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s.to %v", key, e)).ErrorOrNil()
+		}
+	}
+	if c.PasswordEnv != "" && c.Username == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.password_env requires username", key)).ErrorOrNil()
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultEmailTimeout
+	} else if c.Timeout < 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.timeout must be positive", key)).ErrorOrNil()
+	}
+	if c.Subject == "" {
+		c.Subject = "New submission on {{ .Meta.Endpoint }}"
+	}
+	if c.Body == "" {
+		c.Body = "{{ range .OrderedFields }}{{ .Name }}: {{ .Value }}\n{{ end }}"
+	}
+	for _, t := range []struct {
+		name string
+		text string
+		tmpl **template.Template
+	}{
+		{"reply_to", c.ReplyTo, &c.replyToTemplate},
+		{"subject", c.Subject, &c.subjectTemplate},
+		{"body", c.Body, &c.bodyTemplate},
+	} {
+		if t.text == "" {
+			continue
+		}
+		var e error
+		*t.tmpl, e = parseProcessTemplate("send_email."+t.name, t.text)
+		if e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s.%s template error, %v", key, t.name, e)).ErrorOrNil()
+		}
+	}
+	return err
+}
+
+// headerValue removes the line breaks that would allow to inject headers
+func headerValue(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// message builds the mail with its headers
+func (c *ConfigSendEmail) message(r *Process) ([]byte, error) {
+	subject, err := r.render(c.subjectTemplate)
+	if err != nil {
+		return nil, err
+	}
+	body, err := r.render(c.bodyTemplate)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", c.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(c.To, ", "))
+	if c.replyToTemplate != nil {
+		replyTo, err := r.render(c.replyToTemplate)
+		if err != nil {
+			return nil, err
+		}
+		if addr, err := mail.ParseAddress(headerValue(replyTo)); err == nil {
+			fmt.Fprintf(&b, "Reply-To: %s\r\n", addr)
+		} else {
+			log.Printf("[DEBUG] Ignore invalid Reply-To %q, %v", replyTo, err)
+		}
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
+
+// Perform sends the mail, STARTTLS is used when the server offers it
+func (c *ConfigSendEmail) Perform(w http.ResponseWriter, r *Process) bool {
+	msg, err := c.message(r)
+	if err != nil {
+		logError("Failed to build email from templates, %v", err)
+		http.Error(w, "Could not process request due to misconfiguration.", http.StatusInternalServerError)
+		return false
+	}
+	var auth smtp.Auth
+	if c.Username != "" {
+		host, _, _ := net.SplitHostPort(c.SMTP)
+		auth = smtp.PlainAuth("", c.Username, os.Getenv(c.PasswordEnv), host)
+	}
+	from, _ := mail.ParseAddress(c.From)
+	to := make([]string, 0, len(c.To))
+	for _, addr := range c.To {
+		parsed, _ := mail.ParseAddress(addr)
+		to = append(to, parsed.Address)
+	}
+	log.Printf("[DEBUG] Send email to %s", strings.Join(to, ", "))
+	ctx, cancel := context.WithTimeout(r.ctx, c.Timeout)
+	defer cancel()
+	err = c.send(ctx, auth, from.Address, to, msg)
+	if err != nil {
+		logError("Failed to send email through %s, %v", c.SMTP, err)
+		http.Error(w, "Could not send the notification, please try again later.", http.StatusBadGateway)
+		return false
+	}
+	return true
+}
+
+// send is smtp.SendMail giving up when ctx is done
+func (c *ConfigSendEmail) send(ctx context.Context, auth smtp.Auth, from string, to []string, msg []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.SMTP)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(c.SMTP)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		err = client.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = data.Write(msg)
+	if err == nil {
+		err = data.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
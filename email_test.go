@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an SMTP server recording the commands and messages it
+// receives, rejecting the recipients in reject
+type fakeSMTP struct {
+	listener net.Listener
+	reject   string
+	mu       sync.Mutex
+	commands []string
+	messages []string
+}
+
+func newFakeSMTP(t *testing.T, reject string) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{listener: l, reject: reject}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case verb == "EHLO":
+			c.PrintfLine("250-fake\r\n250 AUTH PLAIN")
+		case verb == "AUTH":
+			c.PrintfLine("235 Authenticated")
+		case verb == "RCPT" && s.reject != "" && strings.Contains(line, s.reject):
+			c.PrintfLine("550 No such user")
+		case verb == "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			c.PrintfLine("250 Queued")
+		case verb == "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestSendEmail(t *testing.T) {
+	t.Setenv("SMTP_PASSWORD", "secret")
+	tests := []struct {
+		name     string
+		options  string
+		form     string
+		reject   string
+		status   int
+		commands []string
+		message  []string
+		// absent are not in the header of the message
+		absent []string
+	}{
+		{
+			name:     "message",
+			options:  "{to: ['Team <team@example.com>', b@example.com], reply_to: '{{ field.email }}', subject: 'From {{ field.name }}'}",
+			form:     "field.name=Zoé&field.email=zoe@example.com",
+			status:   http.StatusSeeOther,
+			commands: []string{"MAIL FROM:<form@example.com>", "RCPT TO:<team@example.com>", "RCPT TO:<b@example.com>"},
+			message:  []string{"From: Forms <form@example.com>\n", "To: Team <team@example.com>, b@example.com\n", "Reply-To: <zoe@example.com>\n", "Subject: =?utf-8?q?From_Zo=C3=A9?=\n", "\nname: Zoé\nemail: zoe@example.com\n"},
+		},
+		{
+			name:     "header injection",
+			options:  "{to: [a@example.com], reply_to: '{{ field.email }}', subject: '{{ field.name }}'}",
+			form:     "field.name=x%0ABcc:+c@example.com&field.email=x%0AFrom:+y",
+			status:   http.StatusSeeOther,
+			commands: []string{"RCPT TO:<a@example.com>"},
+			message:  []string{"Subject: x Bcc: c@example.com\n"},
+			absent:   []string{"\nBcc:", "\nFrom: y", "Reply-To:"},
+		},
+		{
+			name:     "authentication",
+			options:  "{to: [a@example.com], username: user, password_env: SMTP_PASSWORD}",
+			status:   http.StatusSeeOther,
+			commands: []string{"AUTH PLAIN AHVzZXIAc2VjcmV0"},
+		},
+		{
+			name:     "rejected recipient",
+			options:  "{to: [a@example.com, nobody@example.com]}",
+			reject:   "nobody",
+			status:   http.StatusBadGateway,
+			commands: []string{"RCPT TO:<nobody@example.com>"},
+		},
+	}
+	for _, tt := range tests {
+		server := newFakeSMTP(t, tt.reject)
+		options := strings.Replace(tt.options, "{", fmt.Sprintf("{smtp: '%s', from: 'Forms <form@example.com>', ", server.listener.Addr()), 1)
+		c := parseConfig(t, "receive:\n  /e:\n    fields: {name: {}, email: {}}\n    send_email: "+options+"\n")
+		if w := submit(c, http.MethodPost, "/e", tt.form); w.Code != tt.status {
+			t.Fatalf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+		}
+		server.mu.Lock()
+		commands := strings.Join(server.commands, "\n")
+		message := strings.Join(server.messages, "")
+		server.mu.Unlock()
+		for _, expected := range tt.commands {
+			if !strings.Contains(commands, expected) {
+				t.Errorf("%s: commands %q, expected %q", tt.name, commands, expected)
+			}
+		}
+		for _, expected := range tt.message {
+			if !strings.Contains(message, expected) {
+				t.Errorf("%s: message %q, expected %q", tt.name, message, expected)
+			}
+		}
+		header := strings.SplitN(message, "\n\n", 2)[0]
+		for _, absent := range tt.absent {
+			if strings.Contains(header, absent) {
+				t.Errorf("%s: header %q, unexpected %q", tt.name, header, absent)
+			}
+		}
+	}
+
+	// A server that never answers fails once the timeout is exceeded
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+		}
+	}()
+	c := parseConfig(t, fmt.Sprintf("receive:\n  /e:\n    send_email: {smtp: '%s', from: a@example.com, to: [b@example.com], timeout: 50ms}\n", l.Addr()))
+	start := time.Now()
+	if w := submit(c, http.MethodPost, "/e", ""); w.Code != http.StatusBadGateway || time.Since(start) > time.Second {
+		t.Errorf("silent server: status %d after %v", w.Code, time.Since(start))
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    send_email: {smtp: localhost, from: x, password_env: P}\n")
+	for _, expected := range []string{"receive[/e].send_email.smtp must be a host:port address", "receive[/e].send_email.from mail: missing '@'", "receive[/e].send_email.to is required", "receive[/e].send_email.password_env requires username"} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q, expected %q", msg, expected)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// EncryptionKeyEnv is the environment variable holding the encryption key
+// when -encryption-key is not set
+const EncryptionKeyEnv = "DATAMGR_ENCRYPTION_KEY"
+
+// NewEncryption returns the AES-GCM cipher for a base64 encoded key of 16, 24
+// or 32 bytes
+func NewEncryption(key string) (cipher.AEAD, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("decoding key: %v", err)
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptValue encrypts the JSON encoding of value. The result is the base64
+// encoding of the nonce followed by the ciphertext.
+func encryptValue(aead cipher.AEAD, value interface{}) (string, error) {
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// encryptFields replaces the values of the encrypted fields with their
+// ciphertext
+func (c *Process) encryptFields() error {
+	for name, field := range c.Fields {
+		if !field.Encrypt || field.Value == nil {
+			continue
+		}
+		value, err := encryptValue(c.options.Encryption, field.Value)
+		if err != nil {
+			return fmt.Errorf("cannot encrypt field field.%s, %v", name, err)
+		}
+		field.Value = value
+		c.Fields[name] = field
+	}
+	return nil
+}
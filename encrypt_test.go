@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// decryptValue decrypts a value encrypted with encryptValue
+func decryptValue(t *testing.T, options Options, s string) interface{} {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := options.Encryption.NonceSize()
+	plaintext, err := options.Encryption.Open(nil, raw[:size], raw[size:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value interface{}
+	err = json.Unmarshal(plaintext, &value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestNewEncryption(t *testing.T) {
+	tests := []struct {
+		key string
+		err bool
+	}{
+		{base64.StdEncoding.EncodeToString(make([]byte, 16)), false},
+		{base64.StdEncoding.EncodeToString(make([]byte, 24)), false},
+		{base64.StdEncoding.EncodeToString(make([]byte, 32)), false},
+		{base64.StdEncoding.EncodeToString(make([]byte, 10)), true},
+		{"not base64!", true},
+	}
+	for _, tt := range tests {
+		_, err := NewEncryption(tt.key)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v", tt.key, err)
+		}
+	}
+}
+
+func TestEncryptFields(t *testing.T) {
+	aead, err := NewEncryption(base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := Options{Encryption: aead}
+	dir := t.TempDir()
+	c := parseConfigWith(t, options, fmt.Sprintf(`
+receive:
+  /e:
+    fields:
+      name: {}
+      ssn: {encrypt: true}
+      age: {type: int, encrypt: true}
+      note: {encrypt: true}
+    create_file: {name: %s/rec.yaml}
+`, dir))
+	w := submit(c, http.MethodPost, "/e", "field.name=x&field.ssn=123-45&field.age=42")
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("status %d, %s", w.Code, w.Body.String())
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "rec.yaml"))
+	var record map[string]interface{}
+	yaml.Unmarshal(data, &record)
+
+	tests := []struct {
+		field    string
+		expected interface{}
+	}{
+		{"ssn", "123-45"},
+		{"age", 42.0},
+	}
+	for _, tt := range tests {
+		s, ok := record[tt.field].(string)
+		if !ok || strings.Contains(string(data), "123-45") {
+			t.Fatalf("%s: not encrypted in %q", tt.field, data)
+		}
+		if value := decryptValue(t, options, s); value != tt.expected {
+			t.Errorf("%s: decrypted %#v, expected %#v", tt.field, value, tt.expected)
+		}
+	}
+	if record["name"] != "x" || record["note"] != nil {
+		t.Errorf("unexpected record %q", data)
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    action: none\n    fields: {a: {encrypt: true}}\n")
+	if !strings.Contains(msg, "receive[/e].fields.a.encrypt requires an encryption key") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+var frontMatterDelimiter = []byte("---\n")
+
+// encodeRecord writes the record in the create_file format
+func (c *ConfigCreateFile) encodeRecord(out io.Writer, record Record) error {
+	switch c.formatCode {
+	case FormatCodeYAML:
+		return yaml.NewEncoder(out).Encode(record)
+	case FormatCodeJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(record)
+	case FormatCodeTOML:
+		return encodeTOML(out, record)
+	case FormatCodeFrontMatter:
+		header, body := c.splitBody(record)
+		_, err := out.Write(frontMatterDelimiter)
+		if err == nil {
+			err = yaml.NewEncoder(out).Encode(header)
+		}
+		if err == nil {
+			_, err = out.Write(frontMatterDelimiter)
+		}
+		if err == nil && body != "" {
+			_, err = io.WriteString(out, body)
+		}
+		return err
+	default:
+		panic("Unexpected format")
+	}
+}
+
+// encodeCSVRow writes the record as a CSV row with the columns, preceded by
+// the header row if requested. Lists and records are written as JSON.
+func encodeCSVRow(out io.Writer, header bool, columns []string, record Record) error {
+	w := csv.NewWriter(out)
+	if header {
+		err := w.Write(columns)
+		if err != nil {
+			return err
+		}
+	}
+	row := make([]string, len(columns))
+	for i, name := range columns {
+		value, _ := record.Get(name)
+		switch v := value.(type) {
+		case nil:
+		case string:
+			row[i] = v
+		case []interface{}, Record, yaml.MapSlice, map[interface{}]interface{}:
+			data, err := json.Marshal(jsonValue(v))
+			if err != nil {
+				return err
+			}
+			row[i] = string(data)
+		default:
+			row[i] = fmt.Sprintf("%v", v)
+		}
+	}
+	err := w.Write(row)
+	if err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// decodeRecord reads a record written by encodeRecord
+func (c *ConfigCreateFile) decodeRecord(in io.Reader) (Record, error) {
+	var record yaml.MapSlice
+	switch c.formatCode {
+	case FormatCodeYAML, FormatCodeJSON:
+		// JSON is read as YAML to keep the key order
+		err := yaml.NewDecoder(in).Decode(&record)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return Record(record), nil
+	case FormatCodeFrontMatter:
+		data, err := ioutil.ReadAll(in)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return Record{}, nil
+		}
+		if !bytes.HasPrefix(data, frontMatterDelimiter) {
+			return nil, fmt.Errorf("missing front matter")
+		}
+		data = data[len(frontMatterDelimiter):]
+		end := bytes.Index(data, append([]byte("\n"), frontMatterDelimiter...))
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated front matter")
+		}
+		err = yaml.Unmarshal(data[:end+1], &record)
+		if err != nil {
+			return nil, err
+		}
+		return c.joinBody(Record(record), string(data[end+1+len(frontMatterDelimiter):])), nil
+	default:
+		panic("Unexpected format")
+	}
+}
+
+// bodyRecord returns the record holding the fields, nested under data when
+// the metadata is included
+func (c *ConfigCreateFile) bodyRecord(record Record) (Record, bool) {
+	if !c.IncludeMeta {
+		return record, true
+	}
+	data, _ := record.Get("data")
+	return asRecord(data)
+}
+
+// splitBody separates the body field from the front matter fields
+func (c *ConfigCreateFile) splitBody(record Record) (Record, string) {
+	fields, ok := c.bodyRecord(record)
+	if !ok {
+		return record, ""
+	}
+	var body string
+	header := make(Record, 0, len(fields))
+	for _, item := range fields {
+		if item.Key == c.BodyField {
+			if item.Value != nil {
+				body = fmt.Sprintf("%v", item.Value)
+			}
+			continue
+		}
+		header = append(header, item)
+	}
+	if !c.IncludeMeta {
+		return header, body
+	}
+	res := make(Record, len(record))
+	copy(res, record)
+	return res.Set("data", header), body
+}
+
+// joinBody puts back the body into the body field of a front matter record
+func (c *ConfigCreateFile) joinBody(record Record, body string) Record {
+	if !c.IncludeMeta {
+		return record.Set(c.BodyField, body)
+	}
+	fields, _ := c.bodyRecord(record)
+	return record.Set("data", fields.Set(c.BodyField, body))
+}
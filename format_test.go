@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestEncodeRecord(t *testing.T) {
+	record := Record{{Key: "title", Value: "Hello"}, {Key: "tags", Value: []interface{}{"a", "b"}}, {Key: "content", Value: "# Hello\n\nText\n"}}
+	tests := []struct {
+		name     string
+		create   ConfigCreateFile
+		record   Record
+		expected string
+		// decoded is the JSON encoding of the decoded record when it
+		// differs from record
+		decoded string
+	}{
+		{
+			name:     "yaml",
+			create:   ConfigCreateFile{formatCode: FormatCodeYAML},
+			record:   record,
+			expected: "title: Hello\ntags:\n- a\n- b\ncontent: |\n  # Hello\n\n  Text\n",
+		},
+		{
+			name:     "json",
+			create:   ConfigCreateFile{formatCode: FormatCodeJSON},
+			record:   Record{{Key: "title", Value: "Hello"}, {Key: "n", Value: 1}},
+			expected: "{\n  \"title\": \"Hello\",\n  \"n\": 1\n}\n",
+		},
+		{
+			name:     "frontmatter",
+			create:   ConfigCreateFile{formatCode: FormatCodeFrontMatter, BodyField: "content"},
+			record:   record,
+			expected: "---\ntitle: Hello\ntags:\n- a\n- b\n---\n# Hello\n\nText\n",
+		},
+		{
+			name:     "frontmatter without body",
+			create:   ConfigCreateFile{formatCode: FormatCodeFrontMatter, BodyField: "content"},
+			record:   Record{{Key: "title", Value: "Hello"}, {Key: "content", Value: nil}},
+			expected: "---\ntitle: Hello\n---\n",
+			decoded:  `{"title":"Hello","content":""}`,
+		},
+		{
+			name:     "frontmatter with meta",
+			create:   ConfigCreateFile{formatCode: FormatCodeFrontMatter, BodyField: "content", IncludeMeta: true},
+			record:   Record{{Key: "data", Value: Record{{Key: "title", Value: "Hello"}, {Key: "content", Value: "Text\n"}}}, {Key: "meta", Value: Record{{Key: "method", Value: "POST"}}}},
+			expected: "---\ndata:\n  title: Hello\nmeta:\n  method: POST\n---\nText\n",
+		},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		err := tt.create.encodeRecord(&b, tt.record)
+		if err != nil || b.String() != tt.expected {
+			t.Errorf("%s: encoded %q %v, expected %q", tt.name, b.String(), err, tt.expected)
+			continue
+		}
+
+		// Decoding gives back the record with its key order
+		decoded, err := tt.create.decodeRecord(&b)
+		if err != nil {
+			t.Errorf("%s: decoding: %v", tt.name, err)
+			continue
+		}
+		got, _ := json.Marshal(decoded)
+		expected, _ := json.Marshal(tt.record)
+		if tt.decoded != "" {
+			expected = []byte(tt.decoded)
+		}
+		if string(got) != string(expected) {
+			t.Errorf("%s: decoded %s, expected %s", tt.name, got, expected)
+		}
+	}
+}
+
+func TestDecodeFrontMatterErrors(t *testing.T) {
+	c := ConfigCreateFile{formatCode: FormatCodeFrontMatter, BodyField: "content"}
+	tests := []struct {
+		data    string
+		message string
+	}{
+		{"", ""},
+		{"title: Hello\n", "missing front matter"},
+		{"---\ntitle: Hello\n", "unterminated front matter"},
+		{"---\ntitle: [\n---\n", "yaml"},
+	}
+	for _, tt := range tests {
+		_, err := c.decodeRecord(strings.NewReader(tt.data))
+		if tt.message == "" && err != nil {
+			t.Errorf("%q: unexpected error %v", tt.data, err)
+		} else if tt.message != "" && (err == nil || !strings.Contains(err.Error(), tt.message)) {
+			t.Errorf("%q: error %v, expected %q", tt.data, err, tt.message)
+		}
+	}
+}
+
+func TestEncodeCSVRow(t *testing.T) {
+	columns := []string{"name", "age", "tags", "note"}
+	tests := []struct {
+		name     string
+		header   bool
+		record   Record
+		expected string
+	}{
+		{"header", true, Record{{Key: "name", Value: "x"}, {Key: "age", Value: int64(3)}}, "name,age,tags,note\nx,3,,\n"},
+		{"row", false, Record{{Key: "note", Value: "a, \"b\""}, {Key: "name", Value: "x"}}, "x,,,\"a, \"\"b\"\"\"\n"},
+		{"list", false, Record{{Key: "tags", Value: []interface{}{"a", "b"}}}, ",,\"[\"\"a\"\",\"\"b\"\"]\",\n"},
+		{"nested", false, Record{{Key: "note", Value: yaml.MapSlice{{Key: "k", Value: "v"}}}}, ",,,\"{\"\"k\"\":\"\"v\"\"}\"\n"},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		err := encodeCSVRow(&b, tt.header, columns, tt.record)
+		if err != nil || b.String() != tt.expected {
+			t.Errorf("%s: row %q %v, expected %q", tt.name, b.String(), err, tt.expected)
+		}
+	}
+}
+
+func TestCreateFileJSON(t *testing.T) {
+	dir := t.TempDir()
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    methods: [POST, PATCH]
+    fields: {title: {}, count: {type: int}, done: {type: bool}}
+    create_file: {name: %s/rec.json, format: json}
+`, dir))
+	tests := []struct {
+		method   string
+		form     string
+		expected string
+	}{
+		{http.MethodPost, "field.title=Hello&field.count=3&field.done=true", "{\n  \"title\": \"Hello\",\n  \"count\": 3,\n  \"done\": true\n}\n"},
+		// The merge decodes the previous JSON file keeping its key order
+		{http.MethodPatch, "field.count=4", "{\n  \"title\": \"Hello\",\n  \"count\": 4,\n  \"done\": true\n}\n"},
+	}
+	for _, tt := range tests {
+		w := submit(c, tt.method, "/e", tt.form)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%s %s: status %d, %s", tt.method, tt.form, w.Code, w.Body.String())
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "rec.json"))
+		if string(data) != tt.expected {
+			t.Errorf("%s %s: file %q, expected %q", tt.method, tt.form, data, tt.expected)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    create_file: {name: x, format: xml}\n")
+	if !strings.Contains(msg, `expected "yaml", "json"`) {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
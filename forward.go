@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	DefaultForwardTimeout = 10 * time.Second
+	ForwardBackoff        = 500 * time.Millisecond
+)
+
+// ConfigForward is the forward action, posting the parsed fields to
+// downstream URLs
+type ConfigForward struct {
+	URLs     []string          `yaml:"urls"`
+	Encoding string            `yaml:"encoding"`
+	Headers  map[string]string `yaml:"headers"`
+	Timeout  time.Duration     `yaml:"timeout"`
+	Retries  int               `yaml:"retries"`
+}
+
+func (c *ConfigForward) parse(key string) (err error) {
+	if len(c.URLs) == 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.urls is required", key)).ErrorOrNil()
+	}
+	for _, u := range c.URLs {
+		parsed, e := url.Parse(u)
+		if e != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			err = multierror.Append(err, fmt.Errorf("%s.urls %q is not an http(s) URL", key, u)).ErrorOrNil()
+		}
+	}
+	switch c.Encoding {
+	case "", "json", "form":
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.encoding unexpected encoding %v, expected \"json\" or \"form\"", key, c.Encoding)).ErrorOrNil()
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultForwardTimeout
+	}
+	if c.Retries < 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.retries must be positive", key)).ErrorOrNil()
+	}
+	return err
+}
+
+// body encodes the fields for the downstream services
+func (c *ConfigForward) body(r *Process) ([]byte, string, error) {
+	record := r.fieldRecord()
+	if c.Encoding != "form" {
+		data, err := json.Marshal(record)
+		return data, "application/json", err
+	}
+	form := url.Values{}
+	for _, item := range record {
+		name := fmt.Sprintf("%v", item.Key)
+		switch v := item.Value.(type) {
+		case nil:
+		case []interface{}:
+			for _, value := range v {
+				form.Add(name, fmt.Sprintf("%v", value))
+			}
+		case Record:
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil, "", err
+			}
+			form.Add(name, string(data))
+		default:
+			form.Add(name, fmt.Sprintf("%v", v))
+		}
+	}
+	return []byte(form.Encode()), "application/x-www-form-urlencoded", nil
+}
+
+// post sends the body to one URL, retrying on network errors and server
+// errors
+func (c *ConfigForward) post(ctx context.Context, target string, body []byte, contentType string) error {
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if attempt > 0 {
+			log.Printf("[DEBUG] Retry forward to %s, %v", target, err)
+			select {
+			case <-time.After(ForwardBackoff * time.Duration(attempt)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		var retry bool
+		retry, err = c.postOnce(ctx, target, body, contentType)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *ConfigForward) postOnce(ctx context.Context, target string, body []byte, contentType string) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode >= 300 {
+		return res.StatusCode >= 500, fmt.Errorf("status %s", res.Status)
+	}
+	return false, nil
+}
+
+// Perform forwards the submission to every URL not reached yet, failing with
+// 502 Bad Gateway if one of them does not accept it
+func (c *ConfigForward) Perform(w http.ResponseWriter, r *Process) bool {
+	body, contentType, err := c.body(r)
+	if err != nil {
+		logError("Failed to encode forwarded fields, %v", err)
+		http.Error(w, "Could not process request because of data error.", http.StatusInternalServerError)
+		return false
+	}
+	if r.forwarded == nil {
+		r.forwarded = map[string]bool{}
+	}
+	for _, target := range c.URLs {
+		if r.forwarded[target] {
+			continue
+		}
+		log.Printf("[DEBUG] Forward to %s", target)
+		err = c.post(r.ctx, target, body, contentType)
+		if err != nil {
+			logError("Failed to forward to %s, %v", target, err)
+			http.Error(w, "Could not forward the request, please try again later.", http.StatusBadGateway)
+			return false
+		}
+		r.forwarded[target] = true
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// downstream is a service answering the statuses in turn, then 200 OK, and
+// recording the requests it received
+type downstream struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+}
+
+func (d *downstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bodies = append(d.bodies, string(body))
+	d.headers = append(d.headers, r.Header)
+	if len(d.statuses) > 0 {
+		w.WriteHeader(d.statuses[0])
+		d.statuses = d.statuses[1:]
+	}
+}
+
+func TestForward(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  string
+		statuses []int
+		status   int
+		bodies   []string
+	}{
+		{"json", "{}", nil, http.StatusSeeOther, []string{`{"name":"a b","tags":["x","y"]}`}},
+		{"form", "{encoding: form}", nil, http.StatusSeeOther, []string{"name=a+b&tags=x&tags=y"}},
+		{"retried server error", "{retries: 1}", []int{http.StatusServiceUnavailable}, http.StatusSeeOther, []string{`{"name":"a b","tags":["x","y"]}`, `{"name":"a b","tags":["x","y"]}`}},
+		{"retries exhausted", "{}", []int{http.StatusInternalServerError}, http.StatusBadGateway, []string{`{"name":"a b","tags":["x","y"]}`}},
+		{"client error not retried", "{retries: 2}", []int{http.StatusBadRequest}, http.StatusBadGateway, []string{`{"name":"a b","tags":["x","y"]}`}},
+	}
+	for _, tt := range tests {
+		d := &downstream{statuses: tt.statuses}
+		server := httptest.NewServer(d)
+		options := strings.Replace(tt.options, "{", fmt.Sprintf("{urls: ['%s'], headers: {X-Token: secret}, ", server.URL), 1)
+		c := parseConfig(t, "receive:\n  /e:\n    fields: {name: {}, tags: {multiple: true}}\n    forward: "+options+"\n")
+		w := submit(c, http.MethodPost, "/e", "field.name=a+b&field.tags=x&field.tags=y")
+		server.Close()
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+		}
+		if strings.Join(d.bodies, "\n") != strings.Join(tt.bodies, "\n") {
+			t.Errorf("%s: posted %q, expected %q", tt.name, d.bodies, tt.bodies)
+		}
+		if len(d.headers) > 0 && d.headers[0].Get("X-Token") != "secret" {
+			t.Errorf("%s: headers %v", tt.name, d.headers[0])
+		}
+	}
+
+	errors := []struct {
+		options string
+		message string
+	}{
+		{"{}", "receive[/e].forward.urls is required"},
+		{"{urls: ['ftp://x']}", `receive[/e].forward.urls "ftp://x" is not an http(s) URL`},
+		{"{urls: ['http://x'], encoding: xml}", `receive[/e].forward.encoding unexpected encoding xml, expected "json" or "form"`},
+		{"{urls: ['http://x'], retries: -1}", "receive[/e].forward.retries must be positive"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    forward: "+tt.options+"\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.options, msg, tt.message)
+		}
+	}
+}
+
+func TestForwardRetry(t *testing.T) {
+	first, second := &downstream{}, &downstream{statuses: []int{http.StatusBadRequest}}
+	firstServer, secondServer := httptest.NewServer(first), httptest.NewServer(second)
+	defer firstServer.Close()
+	defer secondServer.Close()
+	c := parseConfig(t, fmt.Sprintf("receive:\n  /e:\n    fields: {name: {}}\n    forward: {urls: ['%s', '%s']}\n", firstServer.URL, secondServer.URL))
+	r := c.Receive["/e"]
+	p := &Process{ConfigReceive: r, Fields: map[string]ConfigField{"name": {Value: "a"}}, ctx: context.Background()}
+
+	// A retried process only posts to the URLs that did not accept it yet
+	for i, expected := range []bool{false, true} {
+		if ok := r.Forward.Perform(httptest.NewRecorder(), p); ok != expected {
+			t.Errorf("attempt %d: %v, expected %v", i+1, ok, expected)
+		}
+	}
+	if len(first.bodies) != 1 || len(second.bodies) != 2 {
+		t.Errorf("posted %d times to the first URL and %d times to the second", len(first.bodies), len(second.bodies))
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mildred/datamgr/util"
+)
+
+// generateUUID returns a random version 4 UUID, or with version 7 a UUID
+// starting with the current Unix time in milliseconds so that they sort in
+// creation order
+func generateUUID(version byte) string {
+	var u [16]byte
+	rand.Read(u[:])
+	if version == 7 {
+		var ms [8]byte
+		binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+		copy(u[:6], ms[2:])
+	}
+	u[6] = u[6]&0x0f | version<<4
+	u[8] = u[8]&0x3f | 0x80
+
+	var b [36]byte
+	hex.Encode(b[0:8], u[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], u[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], u[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], u[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], u[10:])
+	return string(b[:])
+}
+
+// crockfordBase32 is the ULID alphabet, it sorts in the same order as the
+// encoded values
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// generateULID returns a ULID, a 48 bit millisecond timestamp followed by 80
+// random bits encoded in 26 characters that sort lexicographically in
+// creation order
+func generateULID() string {
+	var u [16]byte
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(u[:6], ms[2:])
+	rand.Read(u[6:])
+
+	// The 128 bits are encoded 5 bits at a time from the least significant
+	// end, the first character only holds the 3 remaining bits
+	hi, lo := binary.BigEndian.Uint64(u[:8]), binary.BigEndian.Uint64(u[8:])
+	var b [26]byte
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = crockfordBase32[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(b[:])
+}
+
+// generateToken returns length random bytes of alphabet. Random bytes beyond
+// the largest multiple of the alphabet size are discarded so that every
+// character is equally likely.
+func generateToken(length int, alphabet string) string {
+	limit := 256 - 256%len(alphabet)
+	res := make([]byte, 0, length)
+	var buf [64]byte
+	for len(res) < length {
+		rand.Read(buf[:])
+		for _, c := range buf {
+			if int(c) < limit && len(res) < length {
+				res = append(res, alphabet[int(c)%len(alphabet)])
+			}
+		}
+	}
+	return string(res)
+}
+
+// sequenceLocks serializes the increments of the same counter file within the
+// process, the file is also locked against other processes
+var sequenceLocks util.KeyedMutex
+
+// nextSequence increments the counter stored in fileName and returns the new
+// value, starting at 1. The counter only grows so the new value is written
+// over the previous one without truncating the file.
+func nextSequence(fileName string) (int64, error) {
+	unlock := sequenceLocks.Lock(fileName)
+	defer unlock()
+
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	err = util.LockFile(f)
+	if err != nil {
+		return 0, err
+	}
+	var buf [32]byte
+	n, err := f.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	var seq int64
+	if s := strings.TrimSpace(string(buf[:n])); s != "" {
+		seq, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("corrupted sequence file %s: %v", fileName, err)
+		}
+	}
+	seq++
+	_, err = f.WriteAt([]byte(strconv.FormatInt(seq, 10)+"\n"), 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	return seq, err
+}
+
+// allocateSequences increments the counters of the sequence fields. It is
+// only called once the submission is validated and about to be performed, so
+// that dry runs and rejected submissions leave no gap in the sequence. The
+// computed fields and validation rules see the sequence fields empty.
+func (c *Process) allocateSequences() error {
+	for _, name := range c.fieldNames() {
+		field := c.Fields[name]
+		if field.generateCode != GenerateCodeSequence || field.Value != nil {
+			continue
+		}
+		n, err := nextSequence(field.SequenceFile)
+		if err != nil {
+			return fmt.Errorf("field.%s: %v", name, err)
+		}
+		field.Value = n
+		if field.Format != "" {
+			field.Value = fmt.Sprintf(field.Format, n)
+		}
+		if field.Encrypt {
+			field.Value, err = encryptValue(c.options.Encryption, field.Value)
+			if err != nil {
+				return fmt.Errorf("cannot encrypt field field.%s, %v", name, err)
+			}
+		}
+		c.Fields[name] = field
+	}
+	return nil
+}
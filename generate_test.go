@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGenerateUUID(t *testing.T) {
+	tests := []struct {
+		generate string
+		pattern  string
+	}{
+		{"uuid", `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{"uuidv4", `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{"uuidv7", `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, "receive:\n  /e:\n    fields: {id: {generate: "+tt.generate+"}}\n    action: echo\n")
+		seen := map[string]bool{}
+		for i := 0; i < 10; i++ {
+			status, fields, body := echoFields(t, c, "/e", "")
+			id, _ := fields["id"].(string)
+			if status != http.StatusOK || !regexp.MustCompile(tt.pattern).MatchString(id) {
+				t.Fatalf("%s: status %d, id %q (%s)", tt.generate, status, id, body)
+			}
+			if seen[id] {
+				t.Errorf("%s: duplicate id %s", tt.generate, id)
+			}
+			seen[id] = true
+		}
+	}
+
+	// Version 7 starts with the time and sorts in creation order
+	before := time.Now().UnixMilli()
+	first := generateUUID(7)
+	time.Sleep(2 * time.Millisecond)
+	second := generateUUID(7)
+	if first >= second {
+		t.Errorf("%s generated before %s", first, second)
+	}
+	ms, _ := strconv.ParseInt(first[:8]+first[9:13], 16, 64)
+	if ms < before || ms > before+2 {
+		t.Errorf("%s holds the time %d, expected %d", first, ms, before)
+	}
+}
+
+func TestGenerateULID(t *testing.T) {
+	ulid := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	c := parseConfig(t, "receive:\n  /e:\n    fields: {id: {generate: ulid}}\n    action: echo\n")
+	var previous string
+	for i := 0; i < 5; i++ {
+		status, fields, body := echoFields(t, c, "/e", "")
+		id, _ := fields["id"].(string)
+		if status != http.StatusOK || !ulid.MatchString(id) {
+			t.Fatalf("status %d, id %q (%s)", status, id, body)
+		}
+		// The random part only orders the ULIDs of the same millisecond
+		if previous != "" && id <= previous {
+			t.Errorf("%s generated after %s", id, previous)
+		}
+		previous = id
+		time.Sleep(time.Millisecond)
+	}
+
+	// The first 10 characters encode the time in milliseconds
+	before := time.Now().UnixMilli()
+	id := generateULID()
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockfordBase32, c))
+	}
+	if ms < before || ms > before+1 {
+		t.Errorf("%s holds the time %d, expected %d", id, ms, before)
+	}
+}
+
+func TestGenerateSequence(t *testing.T) {
+	dir := t.TempDir()
+	seq := filepath.Join(dir, "seq")
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields:
+      number: {generate: sequence, sequence_file: %s, format: 'INV-%%04d'}
+      name: {required: true}
+      trap: {honeypot: true}
+    action: echo
+`, seq))
+	tests := []struct {
+		name     string
+		form     string
+		status   int
+		expected string
+		counter  string
+	}{
+		{"first", "field.name=a", http.StatusOK, "INV-0001", "1\n"},
+		{"second", "field.name=a", http.StatusOK, "INV-0002", "2\n"},
+		// The counter is only incremented by the performed submissions
+		{"dry run", "field.name=a&dry_run=1", http.StatusOK, "", "2\n"},
+		{"rejected", "", http.StatusBadRequest, "", "2\n"},
+		{"honeypot", "field.name=a&field.trap=x", http.StatusSeeOther, "", "2\n"},
+		{"third", "field.name=a", http.StatusOK, "INV-0003", "3\n"},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", tt.form)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.name, w.Code, tt.status, w.Body.String())
+		}
+		if tt.expected != "" && !strings.Contains(w.Body.String(), `"number":"`+tt.expected+`"`) {
+			t.Errorf("%s: body %q, expected number %s", tt.name, w.Body.String(), tt.expected)
+		}
+		if data, _ := ioutil.ReadFile(seq); string(data) != tt.counter {
+			t.Errorf("%s: counter %q, expected %q", tt.name, data, tt.counter)
+		}
+	}
+
+	// Concurrent increments never hand out the same number
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	numbers := map[int64]bool{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := nextSequence(seq)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || numbers[n] {
+				t.Errorf("sequence %d, %v", n, err)
+			}
+			numbers[n] = true
+		}()
+	}
+	wg.Wait()
+	if data, _ := ioutil.ReadFile(seq); string(data) != "23\n" {
+		t.Errorf("counter %q after the concurrent increments", data)
+	}
+
+	ioutil.WriteFile(seq, []byte("garbage\n"), 0644)
+	if w := submit(c, http.MethodPost, "/e", "field.name=a"); w.Code != http.StatusInternalServerError {
+		t.Errorf("corrupted counter: status %d", w.Code)
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{generate: sequence}", "receive[/e].fields.a.sequence_file is required for sequence fields"},
+		{"{sequence_file: seq}", "receive[/e].fields.a.sequence_file is only allowed with generate sequence"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestGenerateToken(t *testing.T) {
+	tests := []struct {
+		field    string
+		length   int
+		alphabet string
+	}{
+		{"{generate: token}", DefaultTokenLength, DefaultTokenAlphabet},
+		{"{generate: token, length: 6, alphabet: '0123456789'}", 6, "0123456789"},
+		{"{generate: token, length: 200, alphabet: ab}", 200, "ab"},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, "receive:\n  /e:\n    fields: {code: "+tt.field+"}\n    action: echo\n")
+		for i := 0; i < 5; i++ {
+			status, fields, body := echoFields(t, c, "/e", "")
+			code, _ := fields["code"].(string)
+			if status != http.StatusOK || len(code) != tt.length {
+				t.Fatalf("%s: status %d, token %q (%s)", tt.field, status, code, body)
+			}
+			for _, c := range code {
+				if !strings.ContainsRune(tt.alphabet, c) {
+					t.Errorf("%s: token %q has %q outside of the alphabet", tt.field, code, c)
+				}
+			}
+		}
+	}
+
+	// The characters are equally likely even when the alphabet size does not
+	// divide 256, the bound is about 6 standard deviations
+	counts := map[rune]int{}
+	for _, c := range generateToken(30000, "abc") {
+		counts[c]++
+	}
+	for _, c := range "abc" {
+		if counts[c] < 9500 || counts[c] > 10500 {
+			t.Errorf("%q generated %d times out of 30000", c, counts[c])
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{generate: token, length: -1}", "receive[/e].fields.a.length must be positive (got -1)"},
+		{"{generate: token, alphabet: x}", "receive[/e].fields.a.alphabet must have between 2 and 256 characters (got 1)"},
+		{"{length: 8}", "receive[/e].fields.a.length and receive[/e].fields.a.alphabet are only allowed with generate token"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestGenerateHash(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      email: {}
+      count: {type: int}
+      tags: {multiple: true}
+      key: {generate: hash, hash_fields: [email, count, tags], algorithm: sha512}
+    action: echo
+`)
+	tests := []struct {
+		form    string
+		encoded string
+	}{
+		{"field.email=a@example.com&field.count=2&field.tags=x&field.tags=y", `["a@example.com",2,["x","y"]]`},
+		// The values are typed, the integer is not hashed as a string
+		{"field.count=02&field.email=a@example.com&field.tags=x&field.tags=y", `["a@example.com",2,["x","y"]]`},
+		{"field.email=a@example.com", `["a@example.com",null,null]`},
+	}
+	for _, tt := range tests {
+		_, fields, body := echoFields(t, c, "/e", tt.form)
+		sum := sha512.Sum512([]byte(tt.encoded))
+		if fields["key"] != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: key %v, expected the digest of %s (%s)", tt.form, fields["key"], tt.encoded, body)
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{generate: hash, hash_fields: [a]}", "receive[/e].fields.a.hash_fields references undeclared field a"},
+		{"{generate: hash, hash_fields: [b], algorithm: md5}", `receive[/e].fields.a.algorithm unexpected algorithm md5, expected "sha256" or "sha512"`},
+		{"{hash_fields: [b]}", "receive[/e].fields.a.hash_fields and receive[/e].fields.a.algorithm are only allowed with generate hash"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+", b: {}}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestGenerateHeader(t *testing.T) {
+	c := parseConfig(t, "receive:\n  /e:\n    fields: {agent: {generate: header, header: user-agent}, lang: {generate: header, header: Accept-Language}}\n    action: echo\n")
+	tests := []struct {
+		name     string
+		form     string
+		headers  []string
+		expected map[string]interface{}
+	}{
+		{"present", "", []string{"User-Agent", "curl/8.0", "Accept-Language", "fr"}, map[string]interface{}{"agent": "curl/8.0", "lang": "fr"}},
+		{"missing", "", []string{"User-Agent", "curl/8.0"}, map[string]interface{}{"agent": "curl/8.0", "lang": ""}},
+		{"submitted", "field.agent=forged", []string{"User-Agent", "curl/8.0"}, map[string]interface{}{"agent": "curl/8.0"}},
+	}
+	for _, tt := range tests {
+		_, fields, body := echoFields(t, c, "/e", tt.form, tt.headers...)
+		for name, value := range tt.expected {
+			if fields[name] != value {
+				t.Errorf("%s: %s = %#v, expected %#v (%s)", tt.name, name, fields[name], value, body)
+			}
+		}
+	}
+
+	// Repeated headers are joined
+	r := httptest.NewRequest(http.MethodPost, "/e", nil)
+	r.Header.Add("Accept-Language", "fr")
+	r.Header.Add("Accept-Language", "en")
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"lang":"fr, en"`) {
+		t.Errorf("body %q, expected the joined headers", w.Body.String())
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{generate: header}", "receive[/e].fields.a.header is required for header fields"},
+		{"{header: X-Token}", "receive[/e].fields.a.header is only allowed with generate header"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
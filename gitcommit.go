@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// gitLocks serializes the git operations on the same repository
+var gitLocks sync.Map
+
+// ConfigGitCommit is the git_commit action, committing the file written by
+// create_file in the local clone holding it and optionally pushing it
+type ConfigGitCommit struct {
+	Repository      string `yaml:"repository"`
+	Message         string `yaml:"message"`
+	messageTemplate *template.Template
+	Push            bool   `yaml:"push"`
+	Remote          string `yaml:"remote"`
+	Branch          string `yaml:"branch"`
+}
+
+func (c *ConfigGitCommit) parse(key string, r *ConfigReceive) (err error) {
+	if c.Repository == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.repository is required", key)).ErrorOrNil()
+	}
+	if r.CreateFile == nil || r.CreateFile.S3 != nil || r.CreateFile.Async {
+		err = multierror.Append(err, fmt.Errorf("%s requires a synchronous local create_file", key)).ErrorOrNil()
+	}
+	if c.Message == "" {
+		c.Message = "Add {{ .Meta.RequestID }} received on {{ .Meta.Endpoint }}"
+	}
+	var e error
+	c.messageTemplate, e = parseProcessTemplate("git_commit.message", c.Message)
+	if e != nil {
+		err = multierror.Append(err, fmt.Errorf("%s.message template error, %v", key, e)).ErrorOrNil()
+	}
+	if c.Remote == "" {
+		c.Remote = "origin"
+	}
+	return err
+}
+
+// relativePath returns the slash separated path of name relative to dir
+func relativePath(dir, name string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	name, err = filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, name)
+	return filepath.ToSlash(rel), err
+}
+
+// git runs a git command in the repository
+func (c *ConfigGitCommit) git(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", c.Repository}, args...)...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("git %s: %v, %s", args[0], err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// Perform commits the created file. A failed push is logged, the file is
+// still committed and will be pushed with the next one.
+func (c *ConfigGitCommit) Perform(w http.ResponseWriter, r *Process) bool {
+	message, err := r.render(c.messageTemplate)
+	if err != nil {
+		logError("Failed to build commit message from template %+v, %v", c.Message, err)
+		http.Error(w, "Could not process request due to misconfiguration.", http.StatusInternalServerError)
+		return false
+	}
+	rel, err := relativePath(c.Repository, r.createdFile)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		logError("Created file %v is outside of the repository %v", r.createdFile, c.Repository)
+		http.Error(w, "Could not process request due to misconfiguration.", http.StatusInternalServerError)
+		return false
+	}
+
+	mu, _ := gitLocks.LoadOrStore(c.Repository, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	log.Printf("[DEBUG] Commit %v in %v", rel, c.Repository)
+	err = c.git(r.ctx, "add", "--", rel)
+	if err == nil && c.git(r.ctx, "diff", "--cached", "--quiet", "--", rel) == nil {
+		// An identical resubmission leaves nothing to commit
+		log.Printf("[DEBUG] Nothing to commit for %v", rel)
+		return true
+	} else if err == nil {
+		err = c.git(r.ctx, "commit", "-m", message, "--", rel)
+	}
+	if err != nil {
+		storageError(w, fmt.Sprintf("commit file %v", r.createdFile), err)
+		return false
+	}
+	if c.Push {
+		args := []string{"push", c.Remote}
+		if c.Branch != "" {
+			args = append(args, "HEAD:"+c.Branch)
+		}
+		err = c.git(r.ctx, args...)
+		if err != nil {
+			logError("Failed to push %v, %v", c.Repository, err)
+		}
+	}
+	return true
+}
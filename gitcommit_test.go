@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// gitOutput runs git in dir and returns its trimmed output
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v, %s", args[0], err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestGitCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	for _, name := range []string{"AUTHOR", "COMMITTER"} {
+		t.Setenv("GIT_"+name+"_NAME", "datamgr")
+		t.Setenv("GIT_"+name+"_EMAIL", "datamgr@example.com")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	repo, remote := t.TempDir(), t.TempDir()
+	gitOutput(t, remote, "init", "-q", "--bare")
+	gitOutput(t, repo, "init", "-q")
+	gitOutput(t, repo, "remote", "add", "origin", remote)
+
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {name: {}, email: {}}
+    create_file: {name: '%s/forms/{{ field.name }}.yaml'}
+    git_commit: {repository: %s, message: 'Form of {{ field.name }}', push: true, branch: forms}
+  /outside:
+    fields: {name: {}}
+    create_file: {name: '%s/{{ field.name }}.yaml'}
+    git_commit: {repository: %s}
+`, repo, repo, t.TempDir(), repo))
+	tests := []struct {
+		target  string
+		form    string
+		status  int
+		commits string
+	}{
+		{"/e", "field.name=a&field.email=a@example.com", http.StatusSeeOther, "Form of a"},
+		{"/e", "field.name=b", http.StatusSeeOther, "Form of b\nForm of a"},
+		// An identical resubmission commits nothing
+		{"/e", "field.name=b", http.StatusSeeOther, "Form of b\nForm of a"},
+		{"/outside", "field.name=c", http.StatusInternalServerError, "Form of b\nForm of a"},
+	}
+	for _, tt := range tests {
+		if w := submit(c, http.MethodPost, tt.target, tt.form); w.Code != tt.status {
+			t.Fatalf("%s %s: status %d, %s", tt.target, tt.form, w.Code, w.Body.String())
+		}
+		if commits := gitOutput(t, repo, "log", "--format=%s"); commits != tt.commits {
+			t.Errorf("%s %s: commits %q, expected %q", tt.target, tt.form, commits, tt.commits)
+		}
+	}
+	if files := gitOutput(t, repo, "ls-files"); files != "forms/a.yaml\nforms/b.yaml" {
+		t.Errorf("committed files %q", files)
+	}
+	if pushed := gitOutput(t, remote, "log", "--format=%s", "forms"); pushed != "Form of b\nForm of a" {
+		t.Errorf("pushed commits %q", pushed)
+	}
+
+	// A failed push is only logged
+	os.RemoveAll(remote)
+	if w := submit(c, http.MethodPost, "/e", "field.name=d"); w.Code != http.StatusSeeOther {
+		t.Errorf("failed push: status %d, %s", w.Code, w.Body.String())
+	}
+	if commit := gitOutput(t, repo, "log", "-1", "--format=%s"); commit != "Form of d" {
+		t.Errorf("failed push: last commit %q", commit)
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    create_file: {name: x.yaml, async: true}\n    git_commit: {}\n")
+	for _, expected := range []string{"receive[/e].git_commit.repository is required", "receive[/e].git_commit requires a synchronous local create_file"} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q, expected %q", msg, expected)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MaintenanceRetryAfter is the Retry-After value, in seconds, sent during
+// maintenance
+const MaintenanceRetryAfter = "120"
+
+// ConfigHolder holds the live configuration and allows swapping it while
+// requests are being served
+type ConfigHolder struct {
+	mu     sync.RWMutex
+	config *Config
+	load   func() (*Config, error)
+	// maintenance is non zero when receive endpoints are disabled
+	maintenance int32
+}
+
+// NewConfigHolder loads the initial configuration using load, which is kept
+// to reload the configuration later
+func NewConfigHolder(load func() (*Config, error)) (*ConfigHolder, error) {
+	config, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigHolder{config: config, load: load}, nil
+}
+
+// Get returns the live configuration
+func (h *ConfigHolder) Get() *Config {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config
+}
+
+// Reload loads the configuration again and swaps it with the live one on
+// success. On error, the live configuration is kept.
+func (h *ConfigHolder) Reload() error {
+	config, err := h.load()
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	config.carryState(h.config)
+	h.config = config
+	h.mu.Unlock()
+	log.Printf("Configuration reloaded")
+	return nil
+}
+
+// carryState keeps the counters, rate limiters and concurrency slots of the
+// endpoints whose configuration is the same as in old
+func (c *Config) carryState(old *Config) {
+	for endpoint, r := range c.Receive {
+		o, ok := old.Receive[endpoint]
+		if !ok || !r.sameConfig(o) {
+			continue
+		}
+		r.stats = o.stats
+		r.semaphore = o.semaphore
+		if r.RateLimit != nil {
+			r.RateLimit.limiter = o.RateLimit.limiter
+		}
+	}
+}
+
+// sameConfig compares the configuration of the endpoints as given in the
+// file, the state is not serialized
+func (c *ConfigReceive) sameConfig(o *ConfigReceive) bool {
+	a, err := yaml.Marshal(c)
+	if err != nil {
+		return false
+	}
+	b, err := yaml.Marshal(o)
+	return err == nil && bytes.Equal(a, b)
+}
+
+// SetMaintenance enables or disables the maintenance mode
+func (h *ConfigHolder) SetMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&h.maintenance, v)
+	log.Printf("Maintenance mode: %v", on)
+}
+
+// Maintenance tells if the maintenance mode is enabled
+func (h *ConfigHolder) Maintenance() bool {
+	return atomic.LoadInt32(&h.maintenance) != 0
+}
+
+func (h *ConfigHolder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Maintenance() {
+		log.Printf("%s %s: 503 Maintenance", r.Method, r.URL.Path)
+		w.Header().Set("Retry-After", MaintenanceRetryAfter)
+		http.Error(w, "Service under maintenance, please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	h.Get().ServeHTTP(w, r)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadKeepsState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "datamgr.yaml")
+	config := `
+receive:
+  /limited: {action: none, rate_limit: {requests: 1, window: 1h}}
+  /changed: {action: none, rate_limit: {requests: 1, window: 1h}}
+`
+	ioutil.WriteFile(file, []byte(config), 0644)
+	h, err := NewConfigHolder(func() (*Config, error) { return LoadConfig(file, Options{}) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, endpoint := range []string{"/limited", "/changed"} {
+		if w := submit(h, http.MethodPost, endpoint, ""); w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: status %d", endpoint, w.Code)
+		}
+	}
+
+	changed := strings.Replace(config, "/changed: {action: none, rate_limit: {requests: 1, window: 1h}}", "/changed: {action: none, rate_limit: {requests: 1, window: 2h}}", 1)
+	ioutil.WriteFile(file, []byte(changed), 0644)
+	err = h.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		endpoint string
+		status   int
+		requests uint64
+	}{
+		{"/limited", http.StatusTooManyRequests, 1},
+		{"/changed", http.StatusSeeOther, 1},
+	}
+	for _, tt := range tests {
+		if w := submit(h, http.MethodPost, tt.endpoint, ""); w.Code != tt.status {
+			t.Errorf("%s: status %d after reload, expected %d", tt.endpoint, w.Code, tt.status)
+		}
+		if n := h.Get().Receive[tt.endpoint].stats.requests; n != tt.requests {
+			t.Errorf("%s: %d requests counted, expected %d", tt.endpoint, n, tt.requests)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigFetchTimeout bounds the time taken to fetch a configuration URL
+const ConfigFetchTimeout = 30 * time.Second
+
+var stdinConfig struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// readConfig reads the configuration from a file name, from standard input
+// if source is "-", or over HTTP if it is an http(s) URL. Standard input is
+// only read once, reloading parses the same contents again.
+func readConfig(source string) ([]byte, string, error) {
+	switch {
+	case source == "-":
+		stdinConfig.once.Do(func() {
+			stdinConfig.data, stdinConfig.err = ioutil.ReadAll(os.Stdin)
+		})
+		return stdinConfig.data, "standard input", stdinConfig.err
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		client := http.Client{Timeout: ConfigFetchTimeout}
+		res, err := client.Get(source)
+		if err != nil {
+			return nil, source, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, source, fmt.Errorf("unexpected status %s", res.Status)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		return data, source, err
+	default:
+		data, err := ioutil.ReadFile(source)
+		return data, source, err
+	}
+}
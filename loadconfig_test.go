@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	const config = "receive:\n  /e: {action: none}\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(config))
+	}))
+	defer server.Close()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	ioutil.WriteFile(file, []byte(config), 0644)
+
+	tests := []struct {
+		source string
+		name   string
+		err    string
+	}{
+		{file, file, ""},
+		{server.URL + "/config.yaml", server.URL + "/config.yaml", ""},
+		{server.URL + "/missing.yaml", server.URL + "/missing.yaml", "unexpected status 404 Not Found"},
+		{filepath.Join(t.TempDir(), "missing.yaml"), "", "no such file"},
+	}
+	for _, tt := range tests {
+		data, name, err := readConfig(tt.source)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, expected %q", tt.source, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || string(data) != config || name != tt.name {
+			t.Errorf("%s: read %q from %s, %v", tt.source, data, name, err)
+		}
+	}
+}
+
+func TestReadConfigStdin(t *testing.T) {
+	const config = "receive:\n  /e: {action: none}\n"
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(config))
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() {
+		os.Stdin = stdin
+		r.Close()
+	}()
+
+	// Reloading reads the same contents again
+	for i := 0; i < 2; i++ {
+		data, name, err := readConfig("-")
+		if err != nil || string(data) != config || name != "standard input" {
+			t.Errorf("read %d: %q from %s, %v", i, data, name, err)
+		}
+	}
+}
@@ -1,20 +1,42 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"gopkg.in/yaml.v2"
 
@@ -23,178 +45,1662 @@ import (
 )
 
 const (
-	DatamgrFile      = "datamgr.yaml"
-	DefaultMaxMemory = 32 << 20 // 32 MB
+	DatamgrFile           = "datamgr.yaml"
+	DefaultMaxMemory      = 32 << 20 // 32 MB
+	DefaultMaxRaw         = 1 << 20  // 1 MB
+	DefaultMaxFileContent = 64 << 10 // 64 kB
 
-	FormatCodeYAML = 1
+	DefaultCallbackParam = "callback"
+	DefaultFieldPrefix   = "field."
+	DefaultRetryBackoff  = 100 * time.Millisecond
+	DefaultTokenLength   = 32
+	DefaultTokenAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 
-	TypeCodeString = 1
-	TypeCodeBool   = iota
+	FormatCodeYAML        = 1
+	FormatCodeFrontMatter = iota
+	FormatCodeJSON        = iota
+	FormatCodeTOML        = iota
+	FormatCodeCSV         = iota
 
-	GenerateCodeTimestamp = 1
+	TypeCodeString      = 1
+	TypeCodeBool        = iota
+	TypeCodeInt         = iota
+	TypeCodeFloat       = iota
+	TypeCodeFile        = iota
+	TypeCodeTemplate    = iota
+	TypeCodeFileContent = iota
+	TypeCodeUint        = iota
+	TypeCodeDatetime    = iota
+	TypeCodeEnum        = iota
+	TypeCodeEmail       = iota
+	TypeCodeURL         = iota
+
+	GenerateCodeTimestamp  = 1
+	GenerateCodeUUIDv4     = iota
+	GenerateCodeUUIDv7     = iota
+	GenerateCodeULID       = iota
+	GenerateCodeSequence   = iota
+	GenerateCodeToken      = iota
+	GenerateCodeHash       = iota
+	GenerateCodeRemoteAddr = iota
+	GenerateCodeHeader     = iota
+
+	GeneratePolicyAlways        = 1
+	GeneratePolicyIfAbsent      = iota
+	GeneratePolicyNeverOverride = iota
+
+	CreateModeCreate = 1
+	CreateModeMerge  = iota
+
+	OverflowCodeQueue  = 1
+	OverflowCodeReject = iota
+
+	MatchCodeExact  = 1
+	MatchCodePrefix = iota
+
+	ActionCodeNone = 1
+	ActionCodeEcho = iota
+
+	PriorityCodeForm  = 1
+	PriorityCodeQuery = iota
+
+	BoolStyleStrict = 1
+	BoolStyleHTML   = iota
+
+	// SubPathField is the field receiving the path below a prefix matched
+	// endpoint
+	SubPathField = "_path"
+
+	SourceCodeForm       = 1
+	SourceCodeHeader     = iota
+	SourceCodeCookie     = iota
+	SourceCodeRemoteAddr = iota
+	SourceCodeClaim      = iota
+
+	RedirectCodeReferer = 1
+	RedirectCodeNone    = iota
+	RedirectCodeError   = iota
+
+	HoneypotCodeAccept = 1
+	HoneypotCodeReject = iota
 )
 
-type Config struct {
-	Receive map[string]*ConfigReceive `yaml:"receive"`
+// DefaultInputLayouts are the layouts accepted by datetime fields without
+// input_layout, they cover the values sent by HTML date and time inputs
+var DefaultInputLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+type Config struct {
+	Receive map[string]*ConfigReceive `yaml:"receive"`
+	TLS     *ConfigTLS                `yaml:"tls"`
+	options Options
+	// prefixes are the prefix matched endpoints, longest first
+	prefixes []string
+}
+
+// Options are the server wide settings given on the command line
+type Options struct {
+	DefaultTimeout time.Duration
+	TrustedProxies []*net.IPNet
+	ClientIPHeader string
+	Encryption     cipher.AEAD
+	Queue          *WriteQueue
+	Audit          *AuditLog
+	RateLimit      *RateLimiter
+}
+
+type ConfigReceive struct {
+	Fields       map[string]ConfigField `yaml:"fields"`
+	CreateFile   *ConfigCreateFile      `yaml:"create_file"`
+	AppendFile   *ConfigAppendFile      `yaml:"append_file"`
+	CreateRecord *ConfigCreateRecord    `yaml:"create_record"`
+	GitCommit    *ConfigGitCommit       `yaml:"git_commit"`
+	Forward      *ConfigForward         `yaml:"forward"`
+	SendEmail    *ConfigSendEmail       `yaml:"send_email"`
+	Notify       *ConfigNotify          `yaml:"notify"`
+	MQTT         *ConfigMQTT            `yaml:"mqtt"`
+	NATS         *ConfigNATS            `yaml:"nats"`
+	Timeout      time.Duration          `yaml:"timeout"`
+	Methods      []string               `yaml:"methods"`
+	StrictFields bool                   `yaml:"strict_fields"`
+	NestedFields bool                   `yaml:"nested_fields"`
+	fieldOrder   []string
+	stats        *endpointStats
+	options      *Options
+	storage      Storage
+
+	Match     string `yaml:"match"`
+	matchCode int
+
+	AllowCIDRs []string `yaml:"allow_cidrs"`
+	allowNets  []*net.IPNet
+
+	AcceptContentTypes  []string `yaml:"accept_content_types"`
+	CallbackParam       *string  `yaml:"callback_param"`
+	RedirectFallback    string   `yaml:"redirect_fallback"`
+	redirectCode        int
+	FieldPrefix         *string `yaml:"field_prefix"`
+	FieldSourcePriority string  `yaml:"field_source_priority"`
+	priorityCode        int
+
+	Action        string `yaml:"action"`
+	actionCode    int
+	RequireAction bool `yaml:"require_action"`
+
+	Validate []*ConfigValidate `yaml:"validate"`
+	Captcha  *ConfigCaptcha    `yaml:"captcha"`
+
+	RateLimit *ConfigRateLimit `yaml:"rate_limit"`
+	Auth      *ConfigAuth      `yaml:"auth"`
+	CSRF      *ConfigCSRF      `yaml:"csrf"`
+	CORS      *ConfigCORS      `yaml:"cors"`
+
+	MaxConcurrent      int    `yaml:"max_concurrent"`
+	ConcurrentOverflow string `yaml:"concurrent_overflow"`
+	overflowCode       int
+	semaphore          chan struct{}
+}
+
+type Process struct {
+	*ConfigReceive
+	Fields map[string]ConfigField
+	Meta   ProcessMeta
+	ctx    context.Context
+	// createdFile is the name of the file written by the create_file action
+	createdFile string
+	// mode is the CreateMode* used by the create_file action
+	mode int
+	// raw is the request body kept for create_file.store_raw
+	raw []byte
+	// claims are the claims of the bearer token, for the claim sources
+	claims  map[string]interface{}
+	request *http.Request
+	// performed is the number of actions that succeeded
+	performed int
+	// forwarded are the forward URLs that accepted the submission, they are
+	// skipped when a queued process is retried
+	forwarded map[string]bool
+}
+
+// mapValues translates the submitted values through value_map, unmapped
+// values are kept unless value_map_strict is set
+func (f *ConfigField) mapValues(name string, v []string) ([]string, error) {
+	res := make([]string, 0, len(v))
+	for _, s := range v {
+		mapped, ok := f.ValueMap[s]
+		if !ok && f.ValueMapStrict {
+			return nil, fmt.Errorf("field.%s unexpected value %q", name, s)
+		} else if !ok {
+			mapped = s
+		}
+		res = append(res, mapped)
+	}
+	return res, nil
+}
+
+type ProcessMeta struct {
+	ReceivedAt time.Time `yaml:"received_at" json:"received_at"`
+	Method     string    `yaml:"method" json:"method"`
+	Path       string    `yaml:"path" json:"path"`
+	RemoteAddr string    `yaml:"remote_addr" json:"remote_addr"`
+	Endpoint   string    `yaml:"endpoint" json:"endpoint"`
+	RequestID  string    `yaml:"request_id" json:"request_id"`
+}
+
+type ConfigField struct {
+	Internal        bool        `yaml:"internal"`
+	Value           interface{} `yaml:"value"`
+	valueTemplate   *template.Template
+	Default         interface{} `yaml:"default"`
+	Pattern         string      `yaml:"pattern"`
+	PatternMessage  string      `yaml:"pattern_message"`
+	pattern         *regexp.Regexp
+	MinLength       int    `yaml:"min_length"`
+	MaxLength       int    `yaml:"max_length"`
+	Honeypot        bool   `yaml:"honeypot"`
+	HoneypotPolicy  string `yaml:"honeypot_policy"`
+	honeypotCode    int
+	Type            string `yaml:"type"`
+	typeCode        int
+	Generate        string   `yaml:"generate"`
+	SequenceFile    string   `yaml:"sequence_file"`
+	Header          string   `yaml:"header"`
+	Length          int      `yaml:"length"`
+	Alphabet        string   `yaml:"alphabet"`
+	HashFields      []string `yaml:"hash_fields"`
+	Algorithm       string   `yaml:"algorithm"`
+	generateCode    int
+	GeneratePolicy  string `yaml:"generate_policy"`
+	generatePolicy  int
+	Required        bool              `yaml:"required"`
+	Multi           bool              `yaml:"multi"`
+	Multiple        bool              `yaml:"multiple"`
+	MinItems        int               `yaml:"min_items"`
+	MaxItems        int               `yaml:"max_items"`
+	Format          string            `yaml:"format"`
+	InputLayout     string            `yaml:"input_layout"`
+	InputLayouts    []string          `yaml:"input_layouts"`
+	ValueMap        map[string]string `yaml:"value_map"`
+	ValueMapStrict  bool              `yaml:"value_map_strict"`
+	Allowed         []string          `yaml:"allowed"`
+	CheckMX         bool              `yaml:"check_mx"`
+	Schemes         []string          `yaml:"schemes"`
+	Source          string            `yaml:"source"`
+	sourceCode      int
+	sourceName      string
+	Encrypt         bool   `yaml:"encrypt"`
+	UploadDir       string `yaml:"upload_dir"`
+	UploadName      string `yaml:"upload_name"`
+	uploadName      *template.Template
+	MimeTypes       []string `yaml:"mime_types"`
+	MaxSize         int64    `yaml:"max_size"`
+	ContentEncoding string   `yaml:"content_encoding"`
+	upload          *multipart.FileHeader
+	Template        string `yaml:"template"`
+	template        *template.Template
+	BoolStyle       string `yaml:"bool_style"`
+	boolStyle       int
+	Min             *float64 `yaml:"min"`
+	Max             *float64 `yaml:"max"`
+	Precision       *int     `yaml:"precision"`
+}
+
+type ConfigCreateFile struct {
+	Name             string `yaml:"name"`
+	nameTemplate     *template.Template
+	BaseDir          string `yaml:"base_dir"`
+	Format           string `yaml:"format"`
+	formatCode       int
+	BodyField        string `yaml:"body_field"`
+	IncludeMeta      bool   `yaml:"include_meta"`
+	ReportPath       bool   `yaml:"report_path"`
+	Rest             bool   `yaml:"rest"`
+	Location         string `yaml:"location"`
+	locationTemplate *template.Template
+	Mode             string `yaml:"mode"`
+	modeCode         int
+	WriteChecksum    string        `yaml:"write_checksum"`
+	Async            bool          `yaml:"async"`
+	S3               *ConfigS3     `yaml:"s3"`
+	StoreRaw         bool          `yaml:"store_raw"`
+	Retries          int           `yaml:"retries"`
+	RetryBackoff     time.Duration `yaml:"retry_backoff"`
+	MaxRawSize       int64         `yaml:"max_raw_size"`
+	storage          Storage
+}
+
+func main() {
+	var listen, trustedProxies util.StringList
+	var options Options
+	var tmpCleanupAge, httpDrainTimeout, queueDrainTimeout, rateLimitWindow time.Duration
+	var configSource, openapiPath, adminToken, accessLog, encryptionKey, pprofAddr, auditLogDir, umask string
+	var tlsCert, tlsKey, tlsRedirect string
+	var accessLogMaxSize int64
+	var queueSize, queueWorkers, rateLimit, rateLimitBurst int
+	flag.StringVar(&configSource, "config", DatamgrFile, "Configuration file, \"-\" for standard input or an http(s) URL")
+	flag.Var(&listen, "listen", "Listen address, can be repeated or comma separated (default \":8080\")")
+	flag.DurationVar(&options.DefaultTimeout, "timeout", 0, "Default request processing timeout for endpoints without one (disabled if zero)")
+	flag.StringVar(&openapiPath, "openapi", "", "Path serving the OpenAPI description of the endpoints (disabled if empty)")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token enabling the /admin/ routes (disabled if empty)")
+	flag.StringVar(&accessLog, "access-log", "", "Access log file (disabled if empty)")
+	flag.Var(&trustedProxies, "trusted-proxies", "CIDR ranges of proxies trusted for the client address headers, can be repeated or comma separated")
+	flag.StringVar(&options.ClientIPHeader, "client-ip-header", "", "Header set by the trusted proxies with the client address, such as CF-Connecting-IP (X-Forwarded-For and X-Real-IP if empty)")
+	flag.StringVar(&encryptionKey, "encryption-key", "", "Base64 encoded AES key for encrypted fields (default from $"+EncryptionKeyEnv+")")
+	flag.StringVar(&pprofAddr, "pprof-addr", "", "Listen address of the /debug/pprof/ profiling handlers (disabled if empty)")
+	flag.DurationVar(&tmpCleanupAge, "tmp-cleanup-age", time.Hour, "Remove temporary files older than this at startup")
+	flag.Int64Var(&accessLogMaxSize, "access-log-max-size", 0, "Rotate the access log past this size in bytes (disabled if zero)")
+	flag.StringVar(&auditLogDir, "audit-log-dir", "", "Directory of the daily JSON lines audit log of all submissions (disabled if empty)")
+	flag.StringVar(&umask, "umask", "", "Octal umask applied to the created files and directories (process default if empty)")
+	flag.DurationVar(&httpDrainTimeout, "http-drain-timeout", 30*time.Second, "Deadline for in-flight requests to complete on shutdown (none if zero)")
+	flag.DurationVar(&queueDrainTimeout, "queue-drain-timeout", 30*time.Second, "Deadline for pending async writes to complete on shutdown, after the HTTP drain (none if zero)")
+	flag.IntVar(&queueSize, "queue-size", DefaultQueueSize, "Maximum number of pending writes of async endpoints")
+	flag.IntVar(&queueWorkers, "queue-workers", DefaultQueueWorkers, "Number of workers performing the writes of async endpoints")
+	flag.IntVar(&rateLimit, "rate-limit", 0, "Maximum number of requests per client address and -rate-limit-window on all endpoints (disabled if zero)")
+	flag.DurationVar(&rateLimitWindow, "rate-limit-window", time.Minute, "Window of the -rate-limit")
+	flag.IntVar(&rateLimitBurst, "rate-limit-burst", 0, "Requests a client may send at once under -rate-limit (default to -rate-limit)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "PEM certificate chain file, serves HTTPS on the listen addresses with -tls-key (default from the tls configuration)")
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM private key file of -tls-cert")
+	flag.StringVar(&tlsRedirect, "tls-redirect", "", "Listen address redirecting plain HTTP to HTTPS, such as \":80\" (disabled if empty)")
+	flag.Parse()
+	if len(listen) == 0 {
+		listen = util.StringList{":8080"}
+	}
+	var err error
+	if umask != "" {
+		mask, err := strconv.ParseUint(umask, 8, 32)
+		if err != nil {
+			log.Fatalf("Error parsing -umask: %v", err)
+		}
+		if util.UmaskSupported {
+			util.SetUmask(int(mask))
+			log.Printf("Using umask %04o", mask)
+		} else {
+			log.Printf("[WARN] -umask is not supported on this platform")
+		}
+	}
+	options.TrustedProxies, err = util.ParseCIDRs(trustedProxies)
+	if err != nil {
+		log.Fatalf("Error parsing -trusted-proxies: %v", err)
+	}
+	if encryptionKey == "" {
+		encryptionKey = os.Getenv(EncryptionKeyEnv)
+	}
+	if encryptionKey != "" {
+		options.Encryption, err = NewEncryption(encryptionKey)
+		if err != nil {
+			log.Fatalf("Error with the encryption key: %v", err)
+		}
+	}
+
+	if auditLogDir != "" {
+		options.Audit, err = OpenAuditLog(auditLogDir)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		defer options.Audit.Close()
+	}
+
+	options.Queue = NewWriteQueue(queueSize, queueWorkers)
+
+	if rateLimit > 0 && rateLimitWindow <= 0 {
+		log.Fatalf("-rate-limit-window must be positive")
+	} else if rateLimit > 0 {
+		options.RateLimit = NewRateLimiter(rateLimit, rateLimitWindow, rateLimitBurst)
+	}
+
+	ctx, stopContext := context.WithCancel(context.Background())
+	util.CancelSignals(ctx, stopContext, util.StopSignals...)
+
+	config, err := NewConfigHolder(func() (*Config, error) {
+		return LoadConfig(configSource, options)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config.Get().CleanupTempFiles(tmpCleanupAge)
+
+	util.HandleSignals(ctx, func(os.Signal) { config.Get().LogStats() }, util.StatsSignals...)
+	util.HandleSignals(ctx, func(os.Signal) {
+		err := config.Reload()
+		if err != nil {
+			logError("Failed to reload configuration, %v", err)
+		}
+	}, util.ReloadSignals...)
+	util.HandleSignals(ctx, func(os.Signal) {
+		config.SetMaintenance(!config.Maintenance())
+	}, util.MaintenanceSignals...)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", HealthHandler)
+	if openapiPath != "" {
+		mux.Handle(openapiPath, config.OpenAPIHandler())
+	}
+	if adminToken != "" {
+		mux.Handle("/admin/reload", adminHandler(adminToken, config.ReloadHandler))
+		mux.Handle("/admin/maintenance", adminHandler(adminToken, config.MaintenanceHandler))
+	}
+	mux.Handle("/", config)
+	var handler http.Handler = mux
+
+	if accessLog != "" {
+		out, err := util.OpenRotatingFile(accessLog, accessLogMaxSize)
+		if err != nil {
+			log.Fatalf("Error opening access log: %v", err)
+		}
+		defer out.Close()
+		handler = AccessLog(out, handler)
+	}
+
+	if tlsCert == "" && tlsKey == "" && config.Get().TLS != nil {
+		tlsCert, tlsKey = config.Get().TLS.Cert, config.Get().TLS.Key
+		if tlsRedirect == "" {
+			tlsRedirect = config.Get().TLS.Redirect
+		}
+	}
+	var tlsConfig *tls.Config
+	if tlsCert != "" || tlsKey != "" {
+		if tlsCert == "" || tlsKey == "" {
+			log.Fatalf("-tls-cert and -tls-key must be given together")
+		}
+		tlsConfig, err = NewTLSConfig(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+	} else if tlsRedirect != "" {
+		log.Fatalf("-tls-redirect requires -tls-cert and -tls-key")
+	}
+
+	servers, err := Serve(listen, handler, tlsConfig)
+	if err != nil {
+		log.Fatalf("Error starting server: %v", err)
+	}
+
+	if tlsRedirect != "" {
+		redirectServers, err := Serve([]string{tlsRedirect}, RedirectHandler(listen[0]), nil)
+		if err != nil {
+			log.Fatalf("Error starting redirect server: %v", err)
+		}
+		servers = append(servers, redirectServers...)
+	}
+
+	if pprofAddr != "" {
+		debugServers, err := Serve([]string{pprofAddr}, PprofHandler(), nil)
+		if err != nil {
+			log.Fatalf("Error starting profiling server: %v", err)
+		}
+		servers = append(servers, debugServers...)
+	}
+
+	<-ctx.Done()
+
+	if !Drain(servers, options.Queue, httpDrainTimeout, queueDrainTimeout) {
+		os.Exit(1)
+	}
+}
+
+// LoadConfig reads and parses the configuration from source, see readConfig
+func LoadConfig(source string, options Options) (*Config, error) {
+	data, name, err := readConfig(source)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %v", name, err)
+	}
+	config := &Config{options: options}
+	err = config.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", name, err)
+	}
+	return config, nil
+}
+
+func (c *Config) Parse(data []byte) error {
+	err := yaml.UnmarshalStrict(data, c)
+	if err != nil {
+		return yamlError(err)
+	}
+
+	if c.TLS != nil {
+		err = multierror.Append(err, c.TLS.parse("tls")).ErrorOrNil()
+	}
+	for endpoint, r := range c.Receive {
+		r.options = &c.options
+		r.stats = &endpointStats{}
+		r.storage = osStorage{}
+		if r.CreateFile != nil && r.CreateFile.S3 != nil {
+			var e error
+			r.storage, e = r.CreateFile.S3.storage(fmt.Sprintf("receive[%+s].create_file.s3", endpoint))
+			if e != nil {
+				err = multierror.Append(err, e).ErrorOrNil()
+			}
+		}
+		if r.Timeout == 0 {
+			r.Timeout = c.options.DefaultTimeout
+		} else if r.Timeout < 0 {
+			err = multierror.Append(err, fmt.Errorf("receive[%+s].timeout must be positive, got %v", endpoint, r.Timeout)).ErrorOrNil()
+		}
+		switch r.Match {
+		case "":
+			r.matchCode = MatchCodeExact
+			if strings.HasSuffix(endpoint, "/") {
+				r.matchCode = MatchCodePrefix
+			}
+		case "exact":
+			r.matchCode = MatchCodeExact
+		case "prefix":
+			r.matchCode = MatchCodePrefix
+		default:
+			err = multierror.Append(err, fmt.Errorf("receive[%+s].match unexpected %v, expected \"exact\" or \"prefix\"", endpoint, r.Match)).ErrorOrNil()
+		}
+		if r.matchCode == MatchCodePrefix {
+			c.prefixes = append(c.prefixes, endpoint)
+		}
+		if r.CallbackParam == nil {
+			callback := DefaultCallbackParam
+			r.CallbackParam = &callback
+		}
+		if len(r.AllowCIDRs) > 0 {
+			var e error
+			r.allowNets, e = util.ParseCIDRs(r.AllowCIDRs)
+			if e != nil {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].allow_cidrs %v", endpoint, e)).ErrorOrNil()
+			}
+		}
+		switch r.RedirectFallback {
+		case "", "referer":
+			r.redirectCode = RedirectCodeReferer
+		case "none":
+			r.redirectCode = RedirectCodeNone
+		case "error":
+			r.redirectCode = RedirectCodeError
+			if *r.CallbackParam == "" {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].redirect_fallback error requires callback_param", endpoint)).ErrorOrNil()
+			}
+		default:
+			err = multierror.Append(err, fmt.Errorf("receive[%+s].redirect_fallback unexpected %v, expected \"referer\", \"none\" or \"error\"", endpoint, r.RedirectFallback)).ErrorOrNil()
+		}
+		if r.FieldPrefix == nil {
+			prefix := DefaultFieldPrefix
+			r.FieldPrefix = &prefix
+		}
+		switch r.FieldSourcePriority {
+		case "":
+		case "form":
+			r.priorityCode = PriorityCodeForm
+		case "query":
+			r.priorityCode = PriorityCodeQuery
+		default:
+			err = multierror.Append(err, fmt.Errorf("receive[%+s].field_source_priority unexpected %v, expected \"form\" or \"query\"", endpoint, r.FieldSourcePriority)).ErrorOrNil()
+		}
+		for i, contentType := range r.AcceptContentTypes {
+			mediaType, _, e := mime.ParseMediaType(contentType)
+			if e != nil {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].accept_content_types invalid type %v, %v", endpoint, contentType, e)).ErrorOrNil()
+			}
+			r.AcceptContentTypes[i] = mediaType
+		}
+		switch r.Action {
+		case "":
+		case "none":
+			r.actionCode = ActionCodeNone
+			if r.storesData() {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].action none conflicts with the other actions", endpoint)).ErrorOrNil()
+			}
+		case "echo":
+			r.actionCode = ActionCodeEcho
+			if r.storesData() {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].action echo conflicts with the other actions", endpoint)).ErrorOrNil()
+			}
+		default:
+			err = multierror.Append(err, fmt.Errorf("receive[%+s].action unexpected %v, expected \"none\" or \"echo\"", endpoint, r.Action)).ErrorOrNil()
+		}
+		if !r.storesData() && r.actionCode == 0 {
+			if r.RequireAction {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s] has no action, set one such as create_file or action: none", endpoint)).ErrorOrNil()
+			} else {
+				log.Printf("[WARN] receive[%+s] has no action, submissions are validated but not stored (set action: none to acknowledge)", endpoint)
+			}
+		}
+		if r.MaxConcurrent < 0 {
+			err = multierror.Append(err, fmt.Errorf("receive[%+s].max_concurrent must be positive, got %d", endpoint, r.MaxConcurrent)).ErrorOrNil()
+		} else if r.MaxConcurrent > 0 {
+			r.semaphore = make(chan struct{}, r.MaxConcurrent)
+		}
+		switch r.ConcurrentOverflow {
+		case "queue", "":
+			r.overflowCode = OverflowCodeQueue
+		case "reject":
+			r.overflowCode = OverflowCodeReject
+		default:
+			err = multierror.Append(err, fmt.Errorf("receive[%+s].concurrent_overflow unexpected policy %v, expected \"queue\" or \"reject\"", endpoint, r.ConcurrentOverflow)).ErrorOrNil()
+		}
+		for i, method := range r.Methods {
+			r.Methods[i] = strings.ToUpper(method)
+			switch r.Methods[i] {
+			case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			default:
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].methods unexpected method %v, expected GET, POST, PUT, PATCH or DELETE", endpoint, method)).ErrorOrNil()
+			}
+		}
+		for fName, f := range r.Fields {
+			e := f.parse(fmt.Sprintf("receive[%+s].fields.%s", endpoint, fName))
+			if e != nil {
+				err = multierror.Append(err, e).ErrorOrNil()
+			}
+			if f.sourceCode == SourceCodeClaim && (r.Auth == nil || r.Auth.OIDC == nil) {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].fields.%s.source %s requires auth.oidc", endpoint, fName, f.Source)).ErrorOrNil()
+			}
+			if f.generateCode == GenerateCodeHash {
+				err = multierror.Append(err, f.checkHashFields(fmt.Sprintf("receive[%+s].fields.%s", endpoint, fName), fName, r.Fields)).ErrorOrNil()
+			}
+			if text, ok := f.Value.(string); ok && strings.Contains(text, "{{") && f.typeCode != TypeCodeTemplate {
+				key := fmt.Sprintf("receive[%+s].fields.%s.value", endpoint, fName)
+				f.valueTemplate, e = parseFieldTemplate(key, text, fName, r.Fields)
+				if e != nil {
+					err = multierror.Append(err, e).ErrorOrNil()
+				}
+			}
+			if f.typeCode == TypeCodeTemplate {
+				e := f.parseComputed(fmt.Sprintf("receive[%+s].fields.%s", endpoint, fName), fName, r.Fields)
+				if e != nil {
+					err = multierror.Append(err, e).ErrorOrNil()
+				}
+			}
+			if f.Encrypt && c.options.Encryption == nil {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].fields.%s.encrypt requires an encryption key", endpoint, fName)).ErrorOrNil()
+			}
+			r.Fields[fName] = f
+			if r.NestedFields {
+				err = multierror.Append(err, r.checkNestedField(fmt.Sprintf("receive[%+s].fields.%s", endpoint, fName), fName)).ErrorOrNil()
+			}
+		}
+		if r.CSRF != nil {
+			err = multierror.Append(err, r.CSRF.parse(fmt.Sprintf("receive[%+s].csrf", endpoint))).ErrorOrNil()
+		}
+		if r.Auth != nil {
+			err = multierror.Append(err, r.Auth.parse(fmt.Sprintf("receive[%+s].auth", endpoint))).ErrorOrNil()
+		}
+		if r.CORS != nil {
+			err = multierror.Append(err, r.CORS.parse(fmt.Sprintf("receive[%+s].cors", endpoint), r)).ErrorOrNil()
+		}
+		if r.RateLimit != nil {
+			err = multierror.Append(err, r.RateLimit.parse(fmt.Sprintf("receive[%+s].rate_limit", endpoint))).ErrorOrNil()
+		}
+		if r.Captcha != nil {
+			err = multierror.Append(err, r.Captcha.parse(fmt.Sprintf("receive[%+s].captcha", endpoint))).ErrorOrNil()
+		}
+		for i, v := range r.Validate {
+			err = multierror.Append(err, v.parse(fmt.Sprintf("receive[%+s].validate[%d]", endpoint, i), r.Fields)).ErrorOrNil()
+		}
+		if r.AppendFile != nil {
+			// S3 objects cannot be appended to, append_file always
+			// writes to the local filesystem
+			r.AppendFile.storage = osStorage{}
+			err = multierror.Append(err, r.AppendFile.parse(fmt.Sprintf("receive[%+s].append_file", endpoint))).ErrorOrNil()
+		}
+		if r.NATS != nil {
+			err = multierror.Append(err, r.NATS.parse(fmt.Sprintf("receive[%+s].nats", endpoint))).ErrorOrNil()
+		}
+		if r.MQTT != nil {
+			err = multierror.Append(err, r.MQTT.parse(fmt.Sprintf("receive[%+s].mqtt", endpoint))).ErrorOrNil()
+		}
+		if r.Notify != nil {
+			err = multierror.Append(err, r.Notify.parse(fmt.Sprintf("receive[%+s].notify", endpoint))).ErrorOrNil()
+		}
+		if r.SendEmail != nil {
+			err = multierror.Append(err, r.SendEmail.parse(fmt.Sprintf("receive[%+s].send_email", endpoint))).ErrorOrNil()
+		}
+		if r.Forward != nil {
+			err = multierror.Append(err, r.Forward.parse(fmt.Sprintf("receive[%+s].forward", endpoint))).ErrorOrNil()
+		}
+		if r.GitCommit != nil {
+			err = multierror.Append(err, r.GitCommit.parse(fmt.Sprintf("receive[%+s].git_commit", endpoint), r)).ErrorOrNil()
+		}
+		if r.CreateRecord != nil {
+			err = multierror.Append(err, r.CreateRecord.parse(fmt.Sprintf("receive[%+s].create_record", endpoint), endpoint, r)).ErrorOrNil()
+		}
+		if r.CreateFile != nil {
+			r.CreateFile.storage = r.storage
+			var e error
+			r.CreateFile.nameTemplate, e = parseProcessTemplate("create_file.name", r.CreateFile.Name)
+			if e != nil {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.name template error, %v", endpoint, e)).ErrorOrNil()
+			}
+			if r.CreateFile.Location != "" {
+				r.CreateFile.locationTemplate, e = parseProcessTemplate("create_file.location", r.CreateFile.Location)
+				if e != nil {
+					err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.location template error, %v", endpoint, e)).ErrorOrNil()
+				}
+			}
+			switch r.CreateFile.Format {
+			case "yaml", "":
+				r.CreateFile.formatCode = FormatCodeYAML
+			case "json":
+				r.CreateFile.formatCode = FormatCodeJSON
+			case "toml":
+				r.CreateFile.formatCode = FormatCodeTOML
+			case "csv":
+				r.CreateFile.formatCode = FormatCodeCSV
+				if r.CreateFile.IncludeMeta || r.CreateFile.WriteChecksum != "" || r.CreateFile.StoreRaw || r.CreateFile.S3 != nil {
+					err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.format csv appends rows and cannot be used with include_meta, write_checksum, store_raw or s3", endpoint)).ErrorOrNil()
+				}
+			case "frontmatter":
+				r.CreateFile.formatCode = FormatCodeFrontMatter
+				if _, ok := r.Fields[r.CreateFile.BodyField]; !ok {
+					err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.body_field must name a declared field, got %q", endpoint, r.CreateFile.BodyField)).ErrorOrNil()
+				}
+			default:
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.format unexpected format %v, expected \"yaml\", \"json\", \"toml\", \"csv\" or \"frontmatter\"", endpoint, r.CreateFile.Format)).ErrorOrNil()
+			}
+			switch r.CreateFile.Mode {
+			case "create", "":
+				r.CreateFile.modeCode = CreateModeCreate
+			case "merge":
+				r.CreateFile.modeCode = CreateModeMerge
+			default:
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.mode unexpected mode %v, expected \"create\" or \"merge\"", endpoint, r.CreateFile.Mode)).ErrorOrNil()
+			}
+			if (r.CreateFile.formatCode == FormatCodeTOML || r.CreateFile.formatCode == FormatCodeCSV) && (r.CreateFile.modeCode == CreateModeMerge || r.allowsMethod(http.MethodPut) || r.allowsMethod(http.MethodPatch)) {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.format %s cannot be merged into", endpoint, r.CreateFile.Format)).ErrorOrNil()
+			}
+			if _, ok := checksumAlgorithms[r.CreateFile.WriteChecksum]; r.CreateFile.WriteChecksum != "" && !ok {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.write_checksum unexpected algorithm %v, expected \"sha256\" or \"sha512\"", endpoint, r.CreateFile.WriteChecksum)).ErrorOrNil()
+			}
+			if r.CreateFile.Retries < 0 {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.retries must be positive", endpoint)).ErrorOrNil()
+			}
+			if r.CreateFile.RetryBackoff == 0 {
+				r.CreateFile.RetryBackoff = DefaultRetryBackoff
+			}
+			if r.CreateFile.MaxRawSize == 0 {
+				r.CreateFile.MaxRawSize = DefaultMaxRaw
+			}
+			if r.CreateFile.Async && c.options.Queue == nil {
+				err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.async requires the write queue", endpoint)).ErrorOrNil()
+			}
+		}
+	}
+	sort.Slice(c.prefixes, func(i, j int) bool {
+		return len(c.prefixes[i]) > len(c.prefixes[j])
+	})
+	return err
+}
+
+func (f *ConfigField) parse(key string) (err error) {
+	switch f.Generate {
+	case "":
+	case "timestamp":
+		f.generateCode = GenerateCodeTimestamp
+		if f.Format == "" {
+			f.Format = "20060102.150405.999999999"
+		}
+	case "uuid", "uuidv4":
+		f.generateCode = GenerateCodeUUIDv4
+	case "uuidv7":
+		f.generateCode = GenerateCodeUUIDv7
+	case "ulid":
+		f.generateCode = GenerateCodeULID
+	case "token":
+		f.generateCode = GenerateCodeToken
+		if f.Length == 0 {
+			f.Length = DefaultTokenLength
+		}
+		if f.Alphabet == "" {
+			f.Alphabet = DefaultTokenAlphabet
+		}
+		if f.Length < 0 {
+			err = multierror.Append(err, fmt.Errorf("%s.length must be positive (got %d)", key, f.Length)).ErrorOrNil()
+		}
+		if n := len(f.Alphabet); n < 2 || n > 256 {
+			err = multierror.Append(err, fmt.Errorf("%s.alphabet must have between 2 and 256 characters (got %d)", key, n)).ErrorOrNil()
+		}
+	case "hash":
+		f.generateCode = GenerateCodeHash
+		if f.Algorithm == "" {
+			f.Algorithm = "sha256"
+		}
+		if _, ok := checksumAlgorithms[f.Algorithm]; !ok {
+			err = multierror.Append(err, fmt.Errorf("%s.algorithm unexpected algorithm %v, expected \"sha256\" or \"sha512\"", key, f.Algorithm)).ErrorOrNil()
+		}
+		if len(f.HashFields) == 0 {
+			err = multierror.Append(err, fmt.Errorf("%s.hash_fields is required for hash fields", key)).ErrorOrNil()
+		}
+	case "remote_addr":
+		f.generateCode = GenerateCodeRemoteAddr
+	case "header":
+		f.generateCode = GenerateCodeHeader
+		if f.Header == "" {
+			err = multierror.Append(err, fmt.Errorf("%s.header is required for header fields", key)).ErrorOrNil()
+		}
+	case "sequence":
+		f.generateCode = GenerateCodeSequence
+		if f.SequenceFile == "" {
+			err = multierror.Append(err, fmt.Errorf("%s.sequence_file is required for sequence fields", key)).ErrorOrNil()
+		}
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.generate unexpected %v, expected \"timestamp\", \"uuid\", \"uuidv4\", \"uuidv7\", \"ulid\", \"sequence\", \"token\", \"hash\", \"remote_addr\" or \"header\"", key, f.Generate)).ErrorOrNil()
+	}
+	if f.Header != "" && f.generateCode != GenerateCodeHeader {
+		err = multierror.Append(err, fmt.Errorf("%s.header is only allowed with generate header", key)).ErrorOrNil()
+	}
+	if f.SequenceFile != "" && f.generateCode != GenerateCodeSequence {
+		err = multierror.Append(err, fmt.Errorf("%s.sequence_file is only allowed with generate sequence", key)).ErrorOrNil()
+	}
+	if (f.Length != 0 || f.Alphabet != "") && f.generateCode != GenerateCodeToken {
+		err = multierror.Append(err, fmt.Errorf("%s.length and %s.alphabet are only allowed with generate token", key, key)).ErrorOrNil()
+	}
+	if (len(f.HashFields) > 0 || f.Algorithm != "") && f.generateCode != GenerateCodeHash {
+		err = multierror.Append(err, fmt.Errorf("%s.hash_fields and %s.algorithm are only allowed with generate hash", key, key)).ErrorOrNil()
+	}
+	switch f.GeneratePolicy {
+	case "", "always":
+		f.generatePolicy = GeneratePolicyAlways
+	case "if_absent":
+		f.generatePolicy = GeneratePolicyIfAbsent
+	case "never_override":
+		f.generatePolicy = GeneratePolicyNeverOverride
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.generate_policy unexpected %v, expected \"always\", \"if_absent\" or \"never_override\"", key, f.GeneratePolicy)).ErrorOrNil()
+	}
+	switch f.Type {
+	case "", "string":
+		f.typeCode = TypeCodeString
+	case "bool":
+		f.typeCode = TypeCodeBool
+	case "int":
+		f.typeCode = TypeCodeInt
+	case "uint":
+		f.typeCode = TypeCodeUint
+	case "float":
+		f.typeCode = TypeCodeFloat
+	case "datetime":
+		f.typeCode = TypeCodeDatetime
+		if f.InputLayout != "" {
+			f.InputLayouts = append([]string{f.InputLayout}, f.InputLayouts...)
+		}
+		if len(f.InputLayouts) == 0 {
+			f.InputLayouts = DefaultInputLayouts
+		}
+		if f.Format == "" {
+			f.Format = time.RFC3339
+		}
+	case "enum":
+		f.typeCode = TypeCodeEnum
+		if len(f.Allowed) == 0 {
+			err = multierror.Append(err, fmt.Errorf("%s.allowed is required for enum fields", key)).ErrorOrNil()
+		}
+	case "email":
+		f.typeCode = TypeCodeEmail
+	case "url":
+		f.typeCode = TypeCodeURL
+		if len(f.Schemes) == 0 {
+			f.Schemes = []string{"http", "https"}
+		}
+		for i, scheme := range f.Schemes {
+			f.Schemes[i] = strings.ToLower(scheme)
+		}
+	case "template":
+		f.typeCode = TypeCodeTemplate
+	case "file":
+		f.typeCode = TypeCodeFile
+		if f.UploadDir == "" {
+			err = multierror.Append(err, fmt.Errorf("%s.upload_dir is required for file fields", key)).ErrorOrNil()
+		}
+		if f.UploadName != "" {
+			var e error
+			f.uploadName, e = parseProcessTemplate(key+".upload_name", f.UploadName)
+			if e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s.upload_name: %v", key, e)).ErrorOrNil()
+			}
+		}
+	case "file_content":
+		f.typeCode = TypeCodeFileContent
+		if f.MaxSize == 0 {
+			f.MaxSize = DefaultMaxFileContent
+		}
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.type unexpected type %v, expected \"string\", \"bool\", \"int\", \"uint\", \"float\", \"datetime\", \"enum\", \"email\", \"url\", \"file\", \"file_content\" or \"template\"", key, f.Type)).ErrorOrNil()
+	}
+	switch f.ContentEncoding {
+	case "", "text", "base64":
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.content_encoding unexpected encoding %v, expected \"text\" or \"base64\"", key, f.ContentEncoding)).ErrorOrNil()
+	}
+	if f.ContentEncoding != "" && f.typeCode != TypeCodeFileContent {
+		err = multierror.Append(err, fmt.Errorf("%s.content_encoding is only allowed on file_content fields", key)).ErrorOrNil()
+	}
+	if f.MaxSize != 0 && f.typeCode != TypeCodeFile && f.typeCode != TypeCodeFileContent {
+		err = multierror.Append(err, fmt.Errorf("%s.max_size is only allowed on file and file_content fields", key)).ErrorOrNil()
+	}
+	if (f.UploadDir != "" || f.UploadName != "" || len(f.MimeTypes) > 0) && f.typeCode != TypeCodeFile {
+		err = multierror.Append(err, fmt.Errorf("%s.upload_dir, %s.upload_name and %s.mime_types are only allowed on file fields", key, key, key)).ErrorOrNil()
+	}
+	switch f.BoolStyle {
+	case "", "strict":
+		f.boolStyle = BoolStyleStrict
+	case "html":
+		f.boolStyle = BoolStyleHTML
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.bool_style unexpected style %v, expected \"strict\" or \"html\"", key, f.BoolStyle)).ErrorOrNil()
+	}
+	if f.BoolStyle != "" && f.typeCode != TypeCodeBool {
+		err = multierror.Append(err, fmt.Errorf("%s.bool_style is only allowed on bool fields", key)).ErrorOrNil()
+	}
+	if (f.Min != nil || f.Max != nil) && !f.numeric() {
+		err = multierror.Append(err, fmt.Errorf("%s.min and %s.max are only allowed on numeric types", key, key)).ErrorOrNil()
+	}
+	if (f.InputLayout != "" || len(f.InputLayouts) > 0) && f.typeCode != TypeCodeDatetime {
+		err = multierror.Append(err, fmt.Errorf("%s.input_layout and %s.input_layouts are only allowed on datetime fields", key, key)).ErrorOrNil()
+	}
+	if len(f.Allowed) > 0 && f.typeCode != TypeCodeEnum {
+		err = multierror.Append(err, fmt.Errorf("%s.allowed is only allowed on enum fields", key)).ErrorOrNil()
+	}
+	if f.CheckMX && f.typeCode != TypeCodeEmail {
+		err = multierror.Append(err, fmt.Errorf("%s.check_mx is only allowed on email fields", key)).ErrorOrNil()
+	}
+	if len(f.Schemes) > 0 && f.typeCode != TypeCodeURL {
+		err = multierror.Append(err, fmt.Errorf("%s.schemes is only allowed on url fields", key)).ErrorOrNil()
+	}
+	if f.Pattern != "" && f.typeCode != TypeCodeString {
+		err = multierror.Append(err, fmt.Errorf("%s.pattern is only allowed on string fields", key)).ErrorOrNil()
+	} else if f.Pattern != "" {
+		// Like the HTML pattern attribute, the whole value must match
+		if _, e := regexp.Compile(f.Pattern); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s.pattern error, %v", key, e)).ErrorOrNil()
+		} else {
+			f.pattern = regexp.MustCompile("^(?:" + f.Pattern + ")$")
+		}
+	}
+	if (f.MinLength != 0 || f.MaxLength != 0) && f.typeCode != TypeCodeString {
+		err = multierror.Append(err, fmt.Errorf("%s.min_length and %s.max_length are only allowed on string fields", key, key)).ErrorOrNil()
+	}
+	if f.MinLength < 0 || f.MaxLength < 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.min_length and %s.max_length must be positive", key, key)).ErrorOrNil()
+	}
+	if f.MaxLength > 0 && f.MinLength > f.MaxLength {
+		err = multierror.Append(err, fmt.Errorf("%s.min_length %d must be lower than max_length %d", key, f.MinLength, f.MaxLength)).ErrorOrNil()
+	}
+	if f.PatternMessage != "" && f.Pattern == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.pattern_message requires pattern", key)).ErrorOrNil()
+	}
+	if f.Precision != nil && f.typeCode != TypeCodeFloat {
+		err = multierror.Append(err, fmt.Errorf("%s.precision is only allowed on float fields", key)).ErrorOrNil()
+	} else if f.Precision != nil && *f.Precision < 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.precision must be positive (got %d)", key, *f.Precision)).ErrorOrNil()
+	}
+	if f.ValueMapStrict && f.ValueMap == nil {
+		err = multierror.Append(err, fmt.Errorf("%s.value_map_strict requires value_map", key)).ErrorOrNil()
+	}
+	if f.Multi && f.Multiple {
+		err = multierror.Append(err, fmt.Errorf("%s.multi and %s.multiple are mutually exclusive", key, key)).ErrorOrNil()
+	}
+	if (f.MinItems != 0 || f.MaxItems != 0) && !f.Multiple {
+		err = multierror.Append(err, fmt.Errorf("%s.min_items and %s.max_items are only allowed on multiple fields", key, key)).ErrorOrNil()
+	}
+	if f.MinItems < 0 || f.MaxItems < 0 {
+		err = multierror.Append(err, fmt.Errorf("%s.min_items and %s.max_items must be positive", key, key)).ErrorOrNil()
+	}
+	if f.MaxItems > 0 && f.MinItems > f.MaxItems {
+		err = multierror.Append(err, fmt.Errorf("%s.min_items %d must be lower than max_items %d", key, f.MinItems, f.MaxItems)).ErrorOrNil()
+	}
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		err = multierror.Append(err, fmt.Errorf("%s.min %v must be lower than max %v", key, *f.Min, *f.Max)).ErrorOrNil()
+	}
+	switch {
+	case f.Source == "" || f.Source == "form":
+		f.sourceCode = SourceCodeForm
+	case strings.HasPrefix(f.Source, "header:"):
+		f.sourceCode = SourceCodeHeader
+		f.sourceName = strings.TrimPrefix(f.Source, "header:")
+	case strings.HasPrefix(f.Source, "cookie:"):
+		f.sourceCode = SourceCodeCookie
+		f.sourceName = strings.TrimPrefix(f.Source, "cookie:")
+	case strings.HasPrefix(f.Source, "claim:"):
+		f.sourceCode = SourceCodeClaim
+		f.sourceName = strings.TrimPrefix(f.Source, "claim:")
+	case f.Source == "remote_addr":
+		f.sourceCode = SourceCodeRemoteAddr
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.source unexpected source %v, expected \"form\", \"header:<Name>\", \"cookie:<Name>\", \"claim:<name>\" or \"remote_addr\"", key, f.Source)).ErrorOrNil()
+	}
+	if (f.sourceCode == SourceCodeHeader || f.sourceCode == SourceCodeCookie || f.sourceCode == SourceCodeClaim) && f.sourceName == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.source %v is missing a name", key, f.Source)).ErrorOrNil()
+	}
+	if f.Default != nil {
+		if f.Required {
+			err = multierror.Append(err, fmt.Errorf("%s.default is contradictory with required", key)).ErrorOrNil()
+		}
+		if f.Value != nil || f.Internal || f.generateCode != 0 {
+			err = multierror.Append(err, fmt.Errorf("%s.default is only allowed on submitted fields without value or generate", key)).ErrorOrNil()
+		}
+	}
+	switch f.HoneypotPolicy {
+	case "", "accept":
+		f.honeypotCode = HoneypotCodeAccept
+	case "reject":
+		f.honeypotCode = HoneypotCodeReject
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.honeypot_policy unexpected policy %v, expected \"accept\" or \"reject\"", key, f.HoneypotPolicy)).ErrorOrNil()
+	}
+	if f.HoneypotPolicy != "" && !f.Honeypot {
+		err = multierror.Append(err, fmt.Errorf("%s.honeypot_policy requires honeypot", key)).ErrorOrNil()
+	}
+	if f.Honeypot && (f.Required || f.Internal || f.sourceCode != SourceCodeForm) {
+		err = multierror.Append(err, fmt.Errorf("%s.honeypot is only allowed on optional form fields", key)).ErrorOrNil()
+	}
+	// Internal form fields are never read from the submission
+	if f.Internal && f.sourceCode == SourceCodeForm {
+		if f.Value == nil && f.generateCode == 0 && f.typeCode != TypeCodeTemplate {
+			err = multierror.Append(err, fmt.Errorf("%s is internal and needs a value or generate", key)).ErrorOrNil()
+		}
+		if f.Required {
+			err = multierror.Append(err, fmt.Errorf("%s.required is contradictory with internal, internal fields are not submitted", key)).ErrorOrNil()
+		}
+	}
+	return err
+}
+
+// route returns the endpoint handling path and the sub path below it for
+// prefix matched endpoints. Exact matches take precedence over prefixes.
+func (c *Config) route(path string) (endpoint string, subPath string) {
+	if handler := c.Receive[path]; handler != nil && handler.matchCode == MatchCodeExact {
+		return path, ""
+	}
+	for _, prefix := range c.prefixes {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		rest := path[len(prefix):]
+		if rest == "" || strings.HasSuffix(prefix, "/") || strings.HasPrefix(rest, "/") {
+			return prefix, strings.TrimPrefix(rest, "/")
+		}
+	}
+	return "", ""
+}
+
+func (c *Config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	endpoint, subPath := c.route(r.URL.Path)
+	if endpoint == "" {
+		log.Printf("%s %s: 404 Not Found", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("%s %s", r.Method, r.URL.Path)
+	c.Receive[endpoint].serve(w, r, endpoint, subPath)
+}
+
+func (c *ConfigReceive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.serve(w, r, r.URL.Path, "")
+}
+
+func (c *ConfigReceive) serve(w http.ResponseWriter, r *http.Request, endpoint, subPath string) {
+	if c.CORS != nil && c.CORS.Handle(w, r) {
+		return
+	}
+
+	if !c.allowsClient(r) {
+		log.Printf("%s %s: 403 Client %s not allowed", r.Method, r.URL.Path, clientIP(r, c.options))
+		http.Error(w, "Forbidden.", http.StatusForbidden)
+		return
+	}
+
+	if c.rateLimited(w, r) {
+		log.Printf("%s %s: 429 Client %s rate limited", r.Method, r.URL.Path, clientIP(r, c.options))
+		return
+	}
+
+	var claims map[string]interface{}
+	if c.Auth != nil {
+		var ok bool
+		claims, ok = c.Auth.Authorize(w, r)
+		if !ok {
+			return
+		}
+	}
+
+	if r.Method == http.MethodGet && r.URL.Query().Get("schema") == "1" {
+		c.serveSchema(w, endpoint)
+		return
+	}
+
+	if c.CSRF != nil && r.Method == http.MethodGet && r.URL.Query().Get("csrf") == "1" {
+		c.CSRF.Issue(w, r, endpoint)
+		return
+	}
+
+	atomic.AddUint64(&c.stats.requests, 1)
+
+	if len(c.Methods) > 0 && !c.allowsMethod(r.Method) {
+		w.Header().Set("Allow", strings.Join(c.Methods, ", "))
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if c.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), c.Timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	if !c.acceptsContentType(r) {
+		log.Printf("%s %s: 415 Unsupported Media Type %q", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		http.Error(w, fmt.Sprintf("Unsupported content type, expected %s.", strings.Join(c.AcceptContentTypes, " or ")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if !c.acquire(w, r) {
+		return
+	}
+	defer c.release()
+
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error decompressing body: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer body.Close()
+		r.Body = body
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+	}
+
+	var raw []byte
+	if c.CreateFile != nil && c.CreateFile.StoreRaw {
+		var err error
+		raw, err = ioutil.ReadAll(io.LimitReader(r.Body, c.CreateFile.MaxRawSize+1))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if int64(len(raw)) > c.CreateFile.MaxRawSize {
+			http.Error(w, "Request body too large to be stored.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	}
+
+	err := r.ParseMultipartForm(DefaultMaxMemory)
+	if err == http.ErrNotMultipart {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if c.CSRF != nil && !c.CSRF.Check(w, r) {
+		return
+	}
+
+	process := &Process{
+		ConfigReceive: c,
+		Fields:        map[string]ConfigField{},
+		Meta:          newProcessMeta(r, endpoint, c.options),
+		ctx:           r.Context(),
+		request:       r,
+		raw:           raw,
+		claims:        claims,
+	}
+
+	var honeypot *ConfigField
+	for fieldName, field := range c.Fields {
+		if field.sourceCode == SourceCodeForm && c.formKey(fieldName) == *c.CallbackParam {
+			continue
+		}
+		if field.Honeypot {
+			// Honeypot fields are hidden from humans and never stored
+			for _, v := range field.sourceValues(fieldName, process) {
+				if strings.TrimSpace(v) != "" {
+					log.Printf("[WARN] %s %s: honeypot field.%s filled by %s", r.Method, r.URL.Path, fieldName, process.Meta.RemoteAddr)
+					honeypot = &field
+				}
+			}
+			continue
+		}
+		e := field.fetchValue(fieldName, process)
+		if e != nil {
+			err = multierror.Append(err, e).ErrorOrNil()
+		}
+		process.Fields[fieldName] = field
+	}
+	if honeypot != nil && honeypot.honeypotCode == HoneypotCodeReject {
+		http.Error(w, "Submission rejected.", http.StatusBadRequest)
+		return
+	} else if honeypot != nil {
+		// Pretend to accept the submission without performing the actions
+		c.redirect(w, r)
+		return
+	}
+	if c.matchCode == MatchCodePrefix {
+		process.Fields[SubPathField] = ConfigField{Internal: true, Value: subPath}
+	}
+	if err == nil {
+		err = process.computeFields()
+	}
+	if err == nil {
+		err = process.validate()
+	}
+	if err == nil {
+		err = process.encryptFields()
+	}
+
+	if c.StrictFields {
+		if unexpected := c.unexpectedFields(r.Form); len(unexpected) > 0 {
+			err = multierror.Append(err, fmt.Errorf("unexpected fields %s", strings.Join(unexpected, ", "))).ErrorOrNil()
+		}
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Context().Err() != nil {
+		timeoutError(w, "process fields")
+		return
+	}
+
+	if dryRun(r) {
+		log.Printf("[DEBUG] Dry run, skipping actions")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Captcha tokens are single use, they are left for the real submission
+	// after a dry run
+	if c.Captcha != nil && !c.Captcha.Verify(w, process) {
+		return
+	}
+
+	err = process.allocateSequences()
+	if err != nil {
+		storageError(w, "allocate sequence", err)
+		return
+	}
+
+	if c.actionCode == ActionCodeEcho {
+		process.echo(w, r)
+		return
+	}
+
+	err = process.saveUploads()
+	if err != nil {
+		storageError(w, "save uploaded file", err)
+		return
+	}
+
+	if c.CreateFile != nil {
+		process.mode = c.createMode(r.Method)
+	}
+
+	if c.CreateFile != nil && c.CreateFile.Async {
+		c.enqueue(w, process)
+		return
+	}
+
+	if !process.performActions(w) {
+		return
+	}
+
+	if c.CreateFile != nil && c.CreateFile.Rest {
+		c.CreateFile.respondCreated(w, process)
+		return
+	}
+	if c.CreateFile != nil && c.CreateFile.ReportPath && acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]string{"file": process.createdFile})
+		if err != nil {
+			logError("Failed to encode response, %v", err)
+		}
+		return
+	}
+
+	c.redirect(w, r)
+}
+
+// actions lists the actions of the endpoint in the order they are performed
+func (c *ConfigReceive) actions() []func(http.ResponseWriter, *Process) bool {
+	var actions []func(http.ResponseWriter, *Process) bool
+	if c.CreateFile != nil {
+		actions = append(actions, func(w http.ResponseWriter, p *Process) bool {
+			if !c.CreateFile.Perform(w, p) {
+				return false
+			}
+			atomic.AddUint64(&c.stats.filesCreated, 1)
+			return true
+		})
+	}
+	if c.GitCommit != nil {
+		actions = append(actions, c.GitCommit.Perform)
+	}
+	if c.AppendFile != nil {
+		actions = append(actions, c.AppendFile.Perform)
+	}
+	if c.CreateRecord != nil {
+		actions = append(actions, c.CreateRecord.Perform)
+	}
+	if c.Forward != nil {
+		actions = append(actions, c.Forward.Perform)
+	}
+	if c.SendEmail != nil {
+		actions = append(actions, c.SendEmail.Perform)
+	}
+	if c.MQTT != nil {
+		actions = append(actions, c.MQTT.Perform)
+	}
+	if c.NATS != nil {
+		actions = append(actions, c.NATS.Perform)
+	}
+	if c.Notify != nil {
+		actions = append(actions, func(w http.ResponseWriter, p *Process) bool {
+			c.Notify.Perform(p)
+			return true
+		})
+	}
+	return actions
+}
+
+// performActions runs the actions not performed yet and logs the submission
+// to the audit log. The actions that succeeded are counted so that a retry
+// of a queued process resumes at the one that failed.
+func (p *Process) performActions(w http.ResponseWriter) bool {
+	actions := p.actions()
+	for ; p.performed < len(actions); p.performed++ {
+		if !actions[p.performed](w, p) {
+			return false
+		}
+	}
+	p.options.Audit.Log(p)
+	return true
 }
 
-type ConfigReceive struct {
-	Fields     map[string]ConfigField `yaml:"fields"`
-	CreateFile *ConfigCreateFile      `yaml:"create_file"`
+// redirect responds to a successful submission, redirecting to the callback
+// or according to redirect_fallback
+func (c *ConfigReceive) redirect(w http.ResponseWriter, r *http.Request) {
+	if cb := c.callback(r); cb != "" {
+		http.Redirect(w, r, cb, http.StatusSeeOther)
+		return
+	}
+
+	switch c.redirectCode {
+	case RedirectCodeNone:
+		w.WriteHeader(http.StatusNoContent)
+	case RedirectCodeError:
+		http.Error(w, fmt.Sprintf("Missing %s parameter.", *c.CallbackParam), http.StatusBadRequest)
+	default:
+		http.Redirect(w, r, r.Referer(), http.StatusSeeOther)
+	}
 }
 
-type Process struct {
-	*ConfigReceive
-	Fields map[string]ConfigField
+// allowsClient checks the client IP against allow_cidrs
+func (c *ConfigReceive) allowsClient(r *http.Request) bool {
+	if len(c.AllowCIDRs) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP(r, c.options))
+	return ip != nil && util.ContainsIP(c.allowNets, ip)
 }
 
-type ConfigField struct {
-	Internal     bool        `yaml:"internal"`
-	Value        interface{} `yaml:"value"`
-	Type         string      `yaml:"type"`
-	typeCode     int
-	Generate     string `yaml:"generate"`
-	generateCode int
-	Required     bool   `yaml:"required"`
-	Format       string `yaml:"format"`
+// storesData tells if the endpoint has an action storing or sending the
+// submissions
+func (c *ConfigReceive) storesData() bool {
+	return c.CreateFile != nil || c.AppendFile != nil || c.CreateRecord != nil || c.Forward != nil || c.SendEmail != nil || c.MQTT != nil || c.NATS != nil
 }
 
-type ConfigCreateFile struct {
-	Name         string `yaml:"name"`
-	nameTemplate *template.Template
-	Format       string `yaml:"format"`
-	formatCode   int
+func (c *ConfigReceive) allowsMethod(method string) bool {
+	for _, m := range c.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
 }
 
-func main() {
-	var server http.Server
-	var config Config
-	flag.StringVar(&server.Addr, "listen", ":8080", "Listen address")
-	flag.Parse()
+// plainConfigReceive is ConfigReceive without its UnmarshalYAML method
+type plainConfigReceive ConfigReceive
 
-	ctx, stopContext := context.WithCancel(context.Background())
-	util.CancelSignals(ctx, stopContext, util.StopSignals...)
+func (c *ConfigReceive) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	err := unmarshal((*plainConfigReceive)(c))
+	if err != nil {
+		return err
+	}
 
-	data, err := ioutil.ReadFile(DatamgrFile)
+	// Decode again to find out the declaration order of the fields
+	var raw yaml.MapSlice
+	err = unmarshal(&raw)
 	if err != nil {
-		log.Fatalf("Error reading %s: %v", DatamgrFile, err)
+		return err
 	}
-	err = config.Parse(data)
+	for _, item := range raw {
+		if item.Key != "fields" {
+			continue
+		}
+		fields, _ := item.Value.(yaml.MapSlice)
+		for _, field := range fields {
+			c.fieldOrder = append(c.fieldOrder, fmt.Sprintf("%v", field.Key))
+		}
+	}
+	return nil
+}
+
+// acceptsContentType checks the request Content-Type, ignoring its
+// parameters, against accept_content_types
+func (c *ConfigReceive) acceptsContentType(r *http.Request) bool {
+	if len(c.AcceptContentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
-		log.Fatalf("Error parsing %s: %v", DatamgrFile, err)
+		return false
+	}
+	for _, accepted := range c.AcceptContentTypes {
+		if mediaType == accepted {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire takes a processing slot when max_concurrent is set, either waiting
+// for one or rejecting the request depending on concurrent_overflow
+func (c *ConfigReceive) acquire(w http.ResponseWriter, r *http.Request) bool {
+	if c.semaphore == nil {
+		return true
 	}
+	select {
+	case c.semaphore <- struct{}{}:
+		return true
+	default:
+	}
+	if c.overflowCode == OverflowCodeReject {
+		log.Printf("%s %s: 503 Too many concurrent requests", r.Method, r.URL.Path)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many concurrent requests, please try again later.", http.StatusServiceUnavailable)
+		return false
+	}
+	select {
+	case c.semaphore <- struct{}{}:
+		return true
+	case <-r.Context().Done():
+		timeoutError(w, "wait for a processing slot")
+		return false
+	}
+}
 
-	server.Handler = &config
+func (c *ConfigReceive) release() {
+	if c.semaphore != nil {
+		<-c.semaphore
+	}
+}
 
-	go func() {
-		err := server.ListenAndServe()
-		if err != nil {
-			log.Fatalf("Error starting server: %v", err)
+// formKey returns the form key under which the field is submitted
+func (c *ConfigReceive) formKey(name string) string {
+	return *c.FieldPrefix + name
+}
+
+// reservedParam tells if the form key is a parameter of datamgr rather than
+// a field: the callback, dry_run, the captcha or CSRF token or the API key
+func (c *ConfigReceive) reservedParam(key string) bool {
+	switch {
+	case key == *c.CallbackParam || key == "dry_run":
+		return true
+	case c.Captcha != nil && key == c.Captcha.TokenField:
+		return true
+	case c.Auth != nil && c.Auth.QueryParam != "" && key == c.Auth.QueryParam:
+		return true
+	case c.CSRF != nil && key == c.CSRF.Field:
+		return true
+	}
+	return false
+}
+
+// unexpectedFields returns the sorted list of submitted field keys that are
+// not declared in the endpoint. Without field prefix, the reserved
+// parameters are not considered fields.
+func (c *ConfigReceive) unexpectedFields(form url.Values) []string {
+	var unexpected []string
+	for key := range form {
+		if !strings.HasPrefix(key, *c.FieldPrefix) {
+			continue
+		}
+		if *c.FieldPrefix == "" && c.reservedParam(key) {
+			continue
+		}
+		name := strings.TrimPrefix(key, *c.FieldPrefix)
+		if f, ok := c.Fields[strings.TrimSuffix(name, "[]")]; ok && f.Multiple {
+			continue
+		}
+		if _, ok := c.Fields[name]; !ok {
+			unexpected = append(unexpected, key)
 		}
-	}()
+	}
+	sort.Strings(unexpected)
+	return unexpected
+}
 
-	defer server.Shutdown(context.Background())
+// callback returns the redirect URL given with the callback parameter, if
+// enabled
+func (c *ConfigReceive) callback(r *http.Request) string {
+	if *c.CallbackParam == "" {
+		return ""
+	}
+	return r.Form.Get(*c.CallbackParam)
+}
 
-	<-ctx.Done()
+// createMode returns the create_file mode for the request method: PUT and
+// PATCH merge into the existing file when they are explicitly allowed.
+func (c *ConfigReceive) createMode(method string) int {
+	if (method == http.MethodPut || method == http.MethodPatch) && c.allowsMethod(method) {
+		return CreateModeMerge
+	}
+	return c.CreateFile.modeCode
 }
 
-func (c *Config) Parse(data []byte) error {
-	err := yaml.Unmarshal(data, c)
-	if err != nil {
-		return err
+// dryRun tells if the request only asks for validation, using either the
+// dry_run form parameter or the X-Dry-Run header
+func dryRun(r *http.Request) bool {
+	v := r.Form.Get("dry_run")
+	if v == "" {
+		v = r.Header.Get("X-Dry-Run")
 	}
+	dry, _ := strconv.ParseBool(v)
+	return dry
+}
 
-	for endpoint, r := range c.Receive {
-		for fName, f := range r.Fields {
-			switch f.Generate {
-			case "":
-			case "timestamp":
-				f.generateCode = GenerateCodeTimestamp
-				if f.Format == "" {
-					f.Format = "20060102.150405.999999999"
-				}
-			default:
-				err = multierror.Append(err, fmt.Errorf("receive[%+s].fields.%s.generate unexpected %v, expected \"timestamp\"", endpoint, fName, f.Generate)).ErrorOrNil()
-			}
-			switch f.Type {
-			case "", "string":
-				f.typeCode = TypeCodeString
-			case "bool":
-				f.typeCode = TypeCodeBool
-			default:
-				err = multierror.Append(err, fmt.Errorf("receive[%+s].fields.%s.type unexpected type %v, expected \"string\" or \"bool\"", endpoint, fName, f.Type)).ErrorOrNil()
-			}
-			r.Fields[fName] = f
+// acceptsJSON tells if the client asked for a JSON response
+func acceptsJSON(r *http.Request) bool {
+	return acceptsMediaType(r, "application/json")
+}
+
+// acceptsMediaType tells if the Accept header lists one of the media types
+func acceptsMediaType(r *http.Request, mediaTypes ...string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
 		}
-		if r.CreateFile != nil {
-			r.CreateFile.nameTemplate = template.New("create_file.name")
-			r.CreateFile.nameTemplate.Funcs(template.FuncMap{
-				"field": func() string { return "" },
-			})
-			_, e := r.CreateFile.nameTemplate.Parse(r.CreateFile.Name)
-			if e != nil {
-				err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.name template error, %v", endpoint, e)).ErrorOrNil()
-			}
-			switch r.CreateFile.Format {
-			case "yaml", "":
-				r.CreateFile.formatCode = FormatCodeYAML
-			default:
-				err = multierror.Append(err, fmt.Errorf("receive[%+s].create_file.format unexpected format %v, expected \"yaml\"", endpoint, r.CreateFile.Format)).ErrorOrNil()
+		for _, t := range mediaTypes {
+			if mediaType == t {
+				return true
 			}
 		}
 	}
-	return err
+	return false
 }
 
-func (c *Config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	handler := c.Receive[r.URL.Path]
-	if handler == nil {
-		log.Printf("%s %s: 404 Not Found", r.Method, r.URL.Path)
-		http.NotFound(w, r)
-		return
+// echo answers the parsed fields for action echo, as YAML when accepted and
+// JSON otherwise
+func (c *Process) echo(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if acceptsMediaType(r, "application/yaml", "application/x-yaml", "text/yaml") {
+		w.Header().Set("Content-Type", "application/yaml")
+		err = yaml.NewEncoder(w).Encode(c.fieldRecord())
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(c.fieldRecord())
+	}
+	if err != nil {
+		logError("Failed to encode response, %v", err)
 	}
-	log.Printf("%s %s", r.Method, r.URL.Path)
-	handler.ServeHTTP(w, r)
 }
 
-func (c *ConfigReceive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(DefaultMaxMemory)
-	if err == http.ErrNotMultipart {
-		err = r.ParseForm()
+func newProcessMeta(r *http.Request, endpoint string, options *Options) ProcessMeta {
+	requestID := r.Header.Get("X-Request-Id")
+	if requestID == "" {
+		var b [16]byte
+		rand.Read(b[:])
+		requestID = hex.EncodeToString(b[:])
 	}
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error parsing form: %v", err), http.StatusBadRequest)
-		return
+	return ProcessMeta{
+		ReceivedAt: time.Now().UTC(),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: clientIP(r, options),
+		Endpoint:   endpoint,
+		RequestID:  requestID,
 	}
+}
 
-	process := &Process{
-		ConfigReceive: c,
-		Fields:        map[string]ConfigField{},
+// formValues returns the submitted values for key. When the key is both in
+// the body and the query string, field_source_priority decides which wins,
+// otherwise both are merged.
+func (c *Process) formValues(key string) []string {
+	r := c.request
+	var first, second url.Values
+	switch c.priorityCode {
+	case PriorityCodeForm:
+		first, second = r.PostForm, r.URL.Query()
+	case PriorityCodeQuery:
+		first, second = r.URL.Query(), r.PostForm
+	default:
+		return r.Form[key]
 	}
-
-	for fieldName, field := range c.Fields {
-		e := field.fetchValue(fieldName, r.Form)
-		if e != nil {
-			err = multierror.Append(err, e).ErrorOrNil()
-		}
-		process.Fields[fieldName] = field
+	if v := first[key]; len(v) > 0 {
+		return v
 	}
+	return second[key]
+}
 
+// parseProcessTemplate parses a template rendered against a Process
+func parseProcessTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs((*Process)(nil).templateFuncs()).Parse(text)
+}
+
+// render executes a template parsed with parseProcessTemplate
+func (c *Process) render(tmpl *template.Template) (string, error) {
+	t, err := tmpl.Clone()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return "", err
 	}
+	t.Funcs(c.templateFuncs())
+	var b bytes.Buffer
+	err = t.Execute(&b, c)
+	return b.String(), err
+}
 
-	if c.CreateFile != nil {
-		c.CreateFile.Perform(w, process)
+// templateFuncs returns the functions available to the create_file.name
+// template. It is also used on a nil Process to parse the template.
+func (c *Process) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"field":       c.fieldMapSafe,
+		"unsafeField": c.fieldMap,
+		"formatTime":  formatTime,
 	}
+}
 
-	if cb := r.Form.Get("callback"); cb != "" {
-		http.Redirect(w, r, cb, http.StatusSeeOther)
-		return
-	}
+// ReceivedAt is the time the request was received, available to templates
+// without declaring a timestamp field
+func (c *Process) ReceivedAt() time.Time {
+	return c.Meta.ReceivedAt
+}
+
+// formatTime formats t with the Go layout, it is meant to be used in a
+// template pipeline such as {{ .ReceivedAt | formatTime "2006/01" }}
+func formatTime(layout string, t time.Time) string {
+	return t.Format(layout)
+}
+
+// FieldValue is a field name and value pair of Process.OrderedFields
+type FieldValue struct {
+	Name  string
+	Value interface{}
+}
 
-	http.Redirect(w, r, r.Referer(), http.StatusSeeOther)
+// OrderedFields lists the fields in declaration order for templates ranging
+// over them. Like the field function, values containing a slash are left out.
+func (c *Process) OrderedFields() []FieldValue {
+	var res []FieldValue
+	for _, name := range c.fieldNames() {
+		value := c.Fields[name].Value
+		if !strings.Contains(fmt.Sprintf("%v", value), "/") {
+			res = append(res, FieldValue{Name: name, Value: value})
+		}
+	}
+	return res
 }
 
 func (c *Process) fieldMapSafe() map[string]interface{} {
@@ -223,83 +1729,449 @@ func generateTimestamp(format string) string {
 	return time.Now().UTC().Format(format)
 }
 
-func (f *ConfigField) fetchValue(name string, values url.Values) (err error) {
-	v := values["field."+name]
-	switch f.generateCode {
-	case GenerateCodeTimestamp:
-		f.Value = generateTimestamp(f.Format)
+// sourceValues returns the values submitted for the field from its
+// configured source
+func (f *ConfigField) sourceValues(name string, p *Process) []string {
+	r := p.request
+	switch f.sourceCode {
+	case SourceCodeHeader:
+		return r.Header.Values(f.sourceName)
+	case SourceCodeCookie:
+		var v []string
+		for _, cookie := range r.Cookies() {
+			if cookie.Name == f.sourceName {
+				v = append(v, cookie.Value)
+			}
+		}
+		return v
+	case SourceCodeRemoteAddr:
+		return []string{p.Meta.RemoteAddr}
+	case SourceCodeClaim:
+		switch v := p.claims[f.sourceName].(type) {
+		case nil:
+			return nil
+		case []interface{}:
+			res := make([]string, 0, len(v))
+			for _, item := range v {
+				res = append(res, fmt.Sprintf("%v", item))
+			}
+			return res
+		default:
+			return []string{fmt.Sprintf("%v", v)}
+		}
+	default:
+		key := p.formKey(name)
+		if f.Multiple {
+			// Checkbox groups and multi-selects are often named with a
+			// trailing [] as expected by PHP and Rails
+			v := p.formValues(key)
+			return append(v[:len(v):len(v)], p.formValues(key+"[]")...)
+		}
+		return p.formValues(key)
+	}
+}
+
+func (f *ConfigField) fetchValue(name string, p *Process) (err error) {
+	if f.valueTemplate != nil {
+		// Rendered by computeFields unless submitted
+		f.Value = nil
+	}
+	v := f.sourceValues(name, p)
+	submitted := len(v) > 0 && !(f.Internal && f.sourceCode == SourceCodeForm)
+	if f.generateCode != 0 && !(submitted && f.generatePolicy == GeneratePolicyIfAbsent) {
+		if submitted && f.generatePolicy == GeneratePolicyNeverOverride {
+			return fmt.Errorf("field.%s is generated and cannot be submitted", name)
+		}
+		switch f.generateCode {
+		case GenerateCodeTimestamp:
+			f.Value = generateTimestamp(f.Format)
+		case GenerateCodeUUIDv4:
+			f.Value = generateUUID(4)
+		case GenerateCodeUUIDv7:
+			f.Value = generateUUID(7)
+		case GenerateCodeULID:
+			f.Value = generateULID()
+		case GenerateCodeRemoteAddr:
+			f.Value = p.Meta.RemoteAddr
+		case GenerateCodeHeader:
+			f.Value = strings.Join(p.request.Header.Values(f.Header), ", ")
+		case GenerateCodeToken:
+			f.Value = generateToken(f.Length, f.Alphabet)
+		case GenerateCodeSequence:
+			// Allocated by allocateSequences once the submission is accepted
+			f.Value = nil
+		}
+		return
 	}
-	if f.Internal {
+	if f.Internal && f.sourceCode == SourceCodeForm {
+		return
+	}
+	if f.typeCode == TypeCodeFile {
+		return f.fetchFile(name, p)
+	}
+	if f.typeCode == TypeCodeFileContent {
+		return f.fetchFileContent(name, p)
+	}
+	if f.typeCode == TypeCodeTemplate {
+		return
+	}
+	if len(v) == 0 && f.typeCode == TypeCodeBool && f.boolStyle == BoolStyleHTML {
+		// An unchecked checkbox is not submitted at all
+		f.Value = false
+		log.Printf("[DEBUG] Empty field.%s, unchecked", name)
+		return
+	}
+	if len(v) == 0 && f.Default != nil {
+		f.Value = f.Default
+		log.Printf("[DEBUG] Empty field.%s, using default %#v", name, f.Value)
 		return
 	}
 	if len(v) == 0 {
 		if f.Required {
 			err = fmt.Errorf("required field field.%s not set", name)
+		} else if f.Multiple && f.MinItems > 0 {
+			err = fmt.Errorf("field.%s requires at least %d values (got 0)", name, f.MinItems)
 		}
 		log.Printf("[DEBUG] Empty field.%s", name)
 		return
 	}
-	switch f.typeCode {
-	case TypeCodeString:
-		f.Value = v[len(v)-1]
-		break
-	case TypeCodeBool:
-		f.Value, err = strconv.ParseBool(v[len(v)-1])
+	if f.ValueMap != nil {
+		v, err = f.mapValues(name, v)
 		if err != nil {
-			err = fmt.Errorf("cannot parse field field.%s to boolean (value is %+v)", name, v)
+			return
+		}
+	}
+	if f.Multiple {
+		if f.MaxItems > 0 && len(v) > f.MaxItems {
+			return fmt.Errorf("field.%s accepts at most %d values (got %d)", name, f.MaxItems, len(v))
+		}
+		if len(v) < f.MinItems {
+			return fmt.Errorf("field.%s requires at least %d values (got %d)", name, f.MinItems, len(v))
+		}
+		values := make([]interface{}, 0, len(v))
+		for _, s := range v {
+			value, e := f.parseValue(p.request.Context(), name, s)
+			if e != nil {
+				err = multierror.Append(err, e).ErrorOrNil()
+				continue
+			}
+			values = append(values, value)
 		}
-		break
+		f.Value = values
+		log.Printf("[DEBUG] Parse field.%s=%#v", name, f.Value)
+		return
+	}
+	if len(v) > 1 {
+		if f.Multi {
+			err = fmt.Errorf("field.%s received multiple values", name)
+			return
+		}
+		log.Printf("[DEBUG] Multiple values for field.%s, keeping the last one", name)
+	}
+	value, err := f.parseValue(p.request.Context(), name, v[len(v)-1])
+	if err != nil {
+		return
 	}
+	f.Value = value
 	log.Printf("[DEBUG] Parse field.%s=%#v", name, f.Value)
 	return
 }
 
-func (c *ConfigCreateFile) Perform(w http.ResponseWriter, r *Process) {
-	var b bytes.Buffer
-	t, err := r.CreateFile.nameTemplate.Clone()
-	if err != nil {
-		log.Printf("[ERROR] Failed to initialize file name template, %v", c.Name, err)
-		http.Error(w, "Internal server error.", http.StatusInternalServerError)
-		return
+// parseValue converts a submitted value to the field type
+func (f *ConfigField) parseValue(ctx context.Context, name, s string) (interface{}, error) {
+	switch f.typeCode {
+	case TypeCodeBool:
+		parse := strconv.ParseBool
+		if f.boolStyle == BoolStyleHTML {
+			parse = parseHTMLBool
+		}
+		b, err := parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse field field.%s to boolean (value is %+v)", name, s)
+		}
+		return b, nil
+	case TypeCodeInt:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse field field.%s to integer (value is %+v)", name, s)
+		}
+		return i, f.checkRange(name, float64(i), i)
+	case TypeCodeUint:
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse field field.%s to unsigned integer (value is %+v)", name, s)
+		}
+		return u, f.checkRange(name, float64(u), u)
+	case TypeCodeFloat:
+		n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("cannot parse field field.%s to float (value is %+v)", name, s)
+		}
+		if f.Precision != nil {
+			scale := math.Pow10(*f.Precision)
+			n = math.Round(n*scale) / scale
+		}
+		return n, f.checkRange(name, n, n)
+	case TypeCodeDatetime:
+		s = strings.TrimSpace(s)
+		for _, layout := range f.InputLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.Format(f.Format), nil
+			}
+		}
+		return nil, fmt.Errorf("cannot parse field field.%s to date/time (value is %+v, expected layouts %s)", name, s, strings.Join(f.InputLayouts, ", "))
+	case TypeCodeEnum:
+		for _, allowed := range f.Allowed {
+			if s == allowed {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("field.%s unexpected value %q, expected one of %s", name, s, strings.Join(f.Allowed, ", "))
+	case TypeCodeEmail:
+		return f.parseEmail(ctx, name, s)
+	case TypeCodeURL:
+		return f.parseURL(name, s)
+	default:
+		if n := utf8.RuneCountInString(s); n < f.MinLength {
+			return nil, fmt.Errorf("field.%s must have at least %d characters (got %d)", name, f.MinLength, n)
+		} else if f.MaxLength > 0 && n > f.MaxLength {
+			return nil, fmt.Errorf("field.%s must have at most %d characters (got %d)", name, f.MaxLength, n)
+		}
+		if f.pattern != nil && !f.pattern.MatchString(s) {
+			if f.PatternMessage != "" {
+				return nil, fmt.Errorf("field.%s: %s", name, f.PatternMessage)
+			}
+			return nil, fmt.Errorf("field.%s does not match pattern %s (value is %+v)", name, f.Pattern, s)
+		}
+		return s, nil
 	}
-	t.Funcs(template.FuncMap{
-		"field":       r.fieldMapSafe,
-		"unsafeField": r.fieldMap,
-	})
-	err = t.Execute(&b, r)
+}
+
+// parseURL validates an absolute URL with one of the allowed schemes, the
+// scheme and host are lowercased
+func (f *ConfigField) parseURL(name, s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() {
+		return nil, fmt.Errorf("cannot parse field field.%s to URL (value is %+v)", name, s)
+	}
+	u.Host = strings.ToLower(u.Host)
+	allowed := false
+	for _, scheme := range f.Schemes {
+		allowed = allowed || u.Scheme == scheme
+	}
+	if !allowed {
+		return nil, fmt.Errorf("field.%s unexpected URL scheme %q, expected one of %s", name, u.Scheme, strings.Join(f.Schemes, ", "))
+	}
+	if (u.Scheme == "http" || u.Scheme == "https") && u.Host == "" {
+		return nil, fmt.Errorf("field.%s URL is missing a host (value is %+v)", name, s)
+	}
+	return u.String(), nil
+}
+
+// parseEmail validates a bare email address and lowercases its domain, the
+// local part is case sensitive and kept as is. With check_mx the domain must
+// accept mail, either with MX records or an address record as implicit MX.
+func (f *ConfigField) parseEmail(ctx context.Context, name, s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || strings.ContainsAny(s, "<>") {
+		return nil, fmt.Errorf("cannot parse field field.%s to email address (value is %+v)", name, s)
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	domain := strings.ToLower(addr.Address[at+1:])
+	if f.CheckMX {
+		mxs, err := net.DefaultResolver.LookupMX(ctx, domain)
+		if len(mxs) == 1 && mxs[0].Host == "." {
+			return nil, fmt.Errorf("field.%s domain %s does not accept email", name, domain)
+		} else if err != nil || len(mxs) == 0 {
+			if _, err := net.DefaultResolver.LookupHost(ctx, domain); err != nil {
+				return nil, fmt.Errorf("field.%s domain %s does not accept email", name, domain)
+			}
+		}
+	}
+	return addr.Address[:at+1] + domain, nil
+}
+
+// parseHTMLBool parses the values sent by HTML checkboxes
+func parseHTMLBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "on", "yes", "true", "1", "checked":
+		return true, nil
+	case "off", "no", "false", "0", "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid checkbox value %q", s)
+	}
+}
+
+func (f *ConfigField) numeric() bool {
+	return f.typeCode == TypeCodeInt || f.typeCode == TypeCodeUint || f.typeCode == TypeCodeFloat
+}
+
+// checkRange checks a numeric value against the min and max options, value is
+// used for error messages
+func (f *ConfigField) checkRange(name string, n float64, value interface{}) error {
+	if f.Min != nil && n < *f.Min {
+		return fmt.Errorf("field.%s must be >= %v (got %v)", name, *f.Min, value)
+	}
+	if f.Max != nil && n > *f.Max {
+		return fmt.Errorf("field.%s must be <= %v (got %v)", name, *f.Max, value)
+	}
+	return nil
+}
+
+// Perform writes the file for the processed request. It returns false if the
+// request failed, in which case the error has already been sent to the client.
+func (c *ConfigCreateFile) Perform(w http.ResponseWriter, r *Process) bool {
+	fileName, err := r.render(c.nameTemplate)
 	if err != nil {
-		log.Printf("[ERROR] Failed to build file name from template %+v, %v", c.Name, err)
+		logError("Failed to build file name from template %+v, %v", c.Name, err)
 		http.Error(w, "Could not process request due to misconfiguration.", http.StatusInternalServerError)
-		return
+		return false
 	}
-	fileName := b.String()
 	log.Printf("[DEBUG] Create file %v", fileName)
 
-	dir := path.Base(fileName)
-	err = os.MkdirAll(dir, 0755)
+	dir := path.Dir(fileName)
+	err = c.storage.MkdirAll(r.ctx, dir, 0755)
 	if err != nil {
-		log.Printf("[ERROR] Failed to create directory %v, %v", dir, err)
-		http.Error(w, "Could not process request due to a system error, please try again later.", http.StatusInternalServerError)
-		return
+		storageError(w, fmt.Sprintf("create directory %v", dir), err)
+		return false
+	}
+
+	record := r.record(c.IncludeMeta)
+	if c.formatCode == FormatCodeCSV {
+		err = appendFile(r.ctx, c.storage, fileName, func(out io.Writer, empty bool) error {
+			return encodeCSVRow(out, empty, r.declaredFieldNames(), record)
+		})
+		if err != nil {
+			storageError(w, fmt.Sprintf("append to file %v", fileName), err)
+			return false
+		}
+		r.createdFile = fileName
+		if c.ReportPath {
+			w.Header().Set("X-Created-File", fileName)
+		}
+		return true
+	}
+	if r.mode == CreateModeMerge {
+		existing, err := c.readRecord(r.ctx, fileName)
+		if err != nil {
+			storageError(w, fmt.Sprintf("read file %v", fileName), err)
+			return false
+		}
+		record = mergeRecords(existing, record)
+		log.Printf("[DEBUG] Merge into file %v", fileName)
+	}
+
+	var step string
+	var digest hash.Hash
+	for attempt := 1; ; attempt++ {
+		step, digest, err = c.writeRecord(r.ctx, fileName, record)
+		if err == nil || attempt > c.Retries || !transientError(err) {
+			break
+		}
+		log.Printf("[DEBUG] Retry %s file %v after transient error, %v", step, fileName, err)
+		select {
+		case <-time.After(c.RetryBackoff * time.Duration(attempt)):
+		case <-r.ctx.Done():
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		timeoutError(w, fmt.Sprintf("write file %v", fileName))
+		return false
+	} else if err != nil && step == "encode" && !errors.Is(err, syscall.ENOSPC) {
+		logError("Failed to encode file %v, %v", fileName, err)
+		http.Error(w, "Could not process request because of data error.", http.StatusInternalServerError)
+		return false
+	} else if err != nil {
+		storageError(w, fmt.Sprintf("%s file %v", step, fileName), err)
+		return false
+	}
+
+	if digest != nil {
+		sidecar := fileName + "." + c.WriteChecksum
+		sum := fmt.Sprintf("%x  %s\n", digest.Sum(nil), path.Base(fileName))
+		err = writeAtomic(r.ctx, c.storage, sidecar, []byte(sum))
+		if err != nil {
+			storageError(w, fmt.Sprintf("write checksum file %v", sidecar), err)
+			return false
+		}
+	}
+
+	if c.StoreRaw {
+		rawName := fileName + ".raw"
+		err = writeAtomic(r.ctx, c.storage, rawName, r.raw)
+		if err != nil {
+			storageError(w, fmt.Sprintf("write raw body file %v", rawName), err)
+			return false
+		}
+	}
+
+	r.createdFile = fileName
+	if c.ReportPath {
+		w.Header().Set("X-Created-File", fileName)
 	}
+	return true
+}
 
-	f, err := os.Create(fileName)
+// writeRecord writes the record to a temporary file renamed once complete,
+// or directly on atomic storages, so readers never see a partial record. It
+// returns the failed step on error.
+func (c *ConfigCreateFile) writeRecord(ctx context.Context, fileName string, record Record) (step string, digest hash.Hash, err error) {
+	tmpName := writeName(c.storage, fileName)
+	f, err := c.storage.Create(ctx, tmpName)
 	if err != nil {
-		log.Printf("[ERROR] Failed to create file %v, %v", fileName, err)
-		http.Error(w, "Could not process request due to a system error, please try again later.", http.StatusInternalServerError)
-		return
+		return "create", nil, err
 	}
-	defer f.Close()
 
-	switch c.formatCode {
-	case FormatCodeYAML:
-		err = yaml.NewEncoder(f).Encode(r.fieldMap())
-	default:
-		panic("Unexpected format")
+	buf := bufio.NewWriter(f)
+	var out io.Writer = buf
+	if c.WriteChecksum != "" {
+		digest = checksumAlgorithms[c.WriteChecksum]()
+		out = io.MultiWriter(buf, digest)
+	}
+
+	step = "encode"
+	err = c.encodeRecord(out, record)
+	if err == nil {
+		step = "flush"
+		err = buf.Flush()
+	}
+	if syncer, ok := f.(interface{ Sync() error }); ok && err == nil {
+		step = "sync"
+		err = syncer.Sync()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if s, e := finishWrite(ctx, c.storage, f, tmpName, fileName, err); err == nil && e != nil {
+		step, err = s, e
+	}
+	return step, digest, err
+}
+
+// respondCreated answers REST clients with 201 Created, the stored fields
+// and the location of the record
+func (c *ConfigCreateFile) respondCreated(w http.ResponseWriter, r *Process) {
+	if c.locationTemplate != nil {
+		location, err := r.render(c.locationTemplate)
+		if err != nil {
+			logError("Failed to build location from template %+v, %v", c.Location, err)
+		} else {
+			w.Header().Set("Location", location)
+		}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err := json.NewEncoder(w).Encode(r.fieldRecord())
 	if err != nil {
-		log.Printf("[ERROR] Failed to encode file %v, %v", fileName, err)
-		http.Error(w, "Could not process request because of data error.", http.StatusInternalServerError)
-		return
+		logError("Failed to encode response, %v", err)
 	}
 }
+
+// checksumAlgorithms are the hashes available for create_file.write_checksum
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
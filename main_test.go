@@ -0,0 +1,1913 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mildred/datamgr/util"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// parseConfig parses the configuration text, failing the test on error
+func parseConfig(t testing.TB, text string) *Config {
+	t.Helper()
+	return parseConfigWith(t, Options{}, text)
+}
+
+func parseConfigWith(t testing.TB, options Options, text string) *Config {
+	t.Helper()
+	c := &Config{options: options}
+	err := c.Parse([]byte(text))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return c
+}
+
+// parseError parses the configuration text and returns the error message,
+// failing the test if it parses
+func parseError(t testing.TB, text string) string {
+	t.Helper()
+	c := &Config{}
+	err := c.Parse([]byte(text))
+	if err == nil {
+		t.Fatalf("Parse succeeded, expected an error")
+	}
+	return err.Error()
+}
+
+// submit sends an urlencoded form to the handler, headers are given as name
+// and value pairs
+func submit(h http.Handler, method, target, form string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(form))
+	if form != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// errStorage is the local filesystem failing to create files with err
+type errStorage struct {
+	osStorage
+	err error
+}
+
+func (s errStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	return nil, s.err
+}
+
+// echoFields submits the form to the echo endpoint and decodes the parsed
+// fields, the body is returned instead when the submission fails
+func echoFields(t *testing.T, h http.Handler, target, form string, headers ...string) (int, map[string]interface{}, string) {
+	t.Helper()
+	w := submit(h, http.MethodPost, target, form, append([]string{"Accept", "application/json"}, headers...)...)
+	if w.Code != http.StatusOK {
+		return w.Code, nil, strings.TrimSpace(w.Body.String())
+	}
+	var fields map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &fields)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	return w.Code, fields, ""
+}
+
+func TestFieldMulti(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      last: {}
+      single: {multi: true}
+    action: echo
+`)
+	tests := []struct {
+		form     string
+		status   int
+		expected map[string]interface{}
+		message  string
+	}{
+		{"field.last=a&field.last=b", http.StatusOK, map[string]interface{}{"last": "b"}, ""},
+		{"field.single=a", http.StatusOK, map[string]interface{}{"single": "a"}, ""},
+		{"field.single=a&field.single=b", http.StatusBadRequest, nil, "field.single received multiple values"},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.form, status, tt.status, body)
+		}
+		for name, value := range tt.expected {
+			if fields[name] != value {
+				t.Errorf("%s: field %s = %#v, expected %#v", tt.form, name, fields[name], value)
+			}
+		}
+		if !strings.Contains(body, tt.message) {
+			t.Errorf("%s: body %q, expected %q", tt.form, body, tt.message)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    fields: {a: {multi: true, multiple: true}}\n")
+	if !strings.Contains(msg, "multi and receive[/e].fields.a.multiple are mutually exclusive") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestCreateFileIncludeMeta(t *testing.T) {
+	tests := []struct {
+		includeMeta bool
+		expected    string
+	}{
+		{false, "name: x\n"},
+		{true, "data:\n  name: x\nmeta:\n"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {name: {}}
+    create_file: {name: %s/rec.yaml, include_meta: %v}
+`, dir, tt.includeMeta))
+		w := submit(c, http.MethodPost, "/e", "field.name=x", "X-Request-Id", "req-1")
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("include_meta %v: status %d, %s", tt.includeMeta, w.Code, w.Body.String())
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "rec.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), tt.expected) {
+			t.Errorf("include_meta %v: file %q, expected to start with %q", tt.includeMeta, data, tt.expected)
+		}
+		var record struct {
+			Meta *ProcessMeta `yaml:"meta"`
+		}
+		err = yaml.Unmarshal(data, &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.includeMeta && (record.Meta == nil || record.Meta.RequestID != "req-1" || record.Meta.Method != "POST" || record.Meta.Endpoint != "/e" || record.Meta.RemoteAddr != "192.0.2.1" || record.Meta.ReceivedAt.IsZero()) {
+			t.Errorf("include_meta %v: unexpected meta %+v", tt.includeMeta, record.Meta)
+		} else if !tt.includeMeta && record.Meta != nil {
+			t.Errorf("include_meta %v: unexpected meta %+v", tt.includeMeta, record.Meta)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {age: {type: int, required: true}}
+    create_file: {name: %s/rec.yaml}
+`, dir))
+	tests := []struct {
+		form    string
+		headers []string
+		status  int
+	}{
+		{"field.age=3&dry_run=1", nil, http.StatusOK},
+		{"field.age=3", []string{"X-Dry-Run", "true"}, http.StatusOK},
+		{"field.age=x&dry_run=1", nil, http.StatusBadRequest},
+		{"dry_run=1", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", tt.form, tt.headers...)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.form, w.Code, tt.status)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("dry runs wrote %d files", len(entries))
+	}
+	if w := submit(c, http.MethodPost, "/e", "field.age=3"); w.Code != http.StatusSeeOther {
+		t.Errorf("status %d after the dry runs", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rec.yaml")); err != nil {
+		t.Error(err)
+	}
+}
+
+// slowStorage is the local filesystem taking delay to create a file, or
+// giving up when the context is done
+type slowStorage struct {
+	osStorage
+	delay time.Duration
+}
+
+func (s slowStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	select {
+	case <-time.After(s.delay):
+		return s.osStorage.Create(ctx, name)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		timeout        string
+		defaultTimeout time.Duration
+		status         int
+	}{
+		{"no timeout", "", 0, http.StatusSeeOther},
+		{"endpoint timeout", "timeout: 20ms", 0, http.StatusGatewayTimeout},
+		{"default timeout", "", 20 * time.Millisecond, http.StatusGatewayTimeout},
+		{"endpoint overrides default", "timeout: 1s", 20 * time.Millisecond, http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfigWith(t, Options{DefaultTimeout: tt.defaultTimeout}, fmt.Sprintf(`
+receive:
+  /e:
+    %s
+    create_file: {name: %s/rec.yaml}
+`, tt.timeout, dir))
+		c.Receive["/e"].CreateFile.storage = slowStorage{delay: 100 * time.Millisecond}
+		w := submit(c, http.MethodPost, "/e", "")
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+		}
+		_, err := os.Stat(filepath.Join(dir, "rec.yaml"))
+		if written := err == nil; written != (tt.status == http.StatusSeeOther) {
+			t.Errorf("%s: file written %v", tt.name, written)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e: {timeout: -1s}\n")
+	if !strings.Contains(msg, "receive[/e].timeout must be positive") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestCreateFileReportPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		accept string
+		status int
+	}{
+		{"create", "create", "", http.StatusSeeOther},
+		{"create json", "create", "application/json", http.StatusOK},
+		{"merge json", "merge", "application/json", http.StatusOK},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {id: {}}
+    create_file: {name: '%s/{{ field.id }}.yaml', report_path: true, mode: %s}
+`, dir, tt.mode))
+		expected := filepath.Join(dir, "42.yaml")
+		w := submit(c, http.MethodPost, "/e", "field.id=42", "Accept", tt.accept)
+		if w.Code != tt.status {
+			t.Fatalf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+		}
+		if got := w.Header().Get("X-Created-File"); got != expected {
+			t.Errorf("%s: X-Created-File %q, expected %q", tt.name, got, expected)
+		}
+		if _, err := os.Stat(expected); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.accept != "" {
+			var res map[string]string
+			json.Unmarshal(w.Body.Bytes(), &res)
+			if res["file"] != expected {
+				t.Errorf("%s: response %q, expected file %q", tt.name, w.Body.String(), expected)
+			}
+		}
+	}
+}
+
+func TestFieldSource(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      agent: {source: "header:User-Agent", required: true}
+      session: {source: "cookie:session"}
+      count: {source: "header:X-Count", type: int}
+      client: {source: remote_addr}
+      name: {source: form}
+    action: echo
+`)
+	tests := []struct {
+		name     string
+		form     string
+		headers  []string
+		status   int
+		expected map[string]interface{}
+	}{
+		{
+			name:     "all sources",
+			form:     "field.name=n&field.agent=ignored",
+			headers:  []string{"User-Agent", "test/1.0", "Cookie", "session=abc; other=x", "X-Count", "3"},
+			status:   http.StatusOK,
+			expected: map[string]interface{}{"agent": "test/1.0", "session": "abc", "count": 3.0, "client": "192.0.2.1", "name": "n"},
+		},
+		{name: "required header", form: "field.name=n", status: http.StatusBadRequest},
+		{name: "typed header", headers: []string{"User-Agent", "a", "X-Count", "x"}, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form, tt.headers...)
+		if status != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.name, status, tt.status, body)
+		}
+		for name, value := range tt.expected {
+			if fields[name] != value {
+				t.Errorf("%s: field %s = %#v, expected %#v", tt.name, name, fields[name], value)
+			}
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    fields: {a: {source: \"body:x\"}}\n")
+	if !strings.Contains(msg, "receive[/e].fields.a.source") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestFieldRange(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      age: {type: int, min: 0, max: 150}
+      ratio: {type: float, min: 0.5}
+    action: echo
+`)
+	tests := []struct {
+		form    string
+		status  int
+		message string
+	}{
+		{"field.age=0", http.StatusOK, ""},
+		{"field.age=150", http.StatusOK, ""},
+		{"field.age=-1", http.StatusBadRequest, "field.age must be >= 0 (got -1)"},
+		{"field.age=999", http.StatusBadRequest, "field.age must be <= 150 (got 999)"},
+		{"field.ratio=0.5", http.StatusOK, ""},
+		{"field.ratio=0.25", http.StatusBadRequest, "field.ratio must be >= 0.5 (got 0.25)"},
+	}
+	for _, tt := range tests {
+		status, _, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status || !strings.Contains(body, tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, status, body, tt.status, tt.message)
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{type: int, min: 5, max: 1}", "receive[/e].fields.a.min 5 must be lower than max 1"},
+		{"{min: 1}", "receive[/e].fields.a.min and receive[/e].fields.a.max are only allowed on numeric types"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestFieldItems(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      tags: {multiple: true, min_items: 1, max_items: 2}
+    action: echo
+`)
+	tests := []struct {
+		form    string
+		status  int
+		count   int
+		message string
+	}{
+		{"field.tags=a", http.StatusOK, 1, ""},
+		{"field.tags=a&field.tags=b", http.StatusOK, 2, ""},
+		{"field.tags=a&field.tags=b&field.tags=c", http.StatusBadRequest, 0, "field.tags accepts at most 2 values (got 3)"},
+		{"", http.StatusBadRequest, 0, "field.tags requires at least 1 values (got 0)"},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status || !strings.Contains(body, tt.message) {
+			t.Errorf("%q: status %d %q, expected %d %q", tt.form, status, body, tt.status, tt.message)
+		}
+		if tags, _ := fields["tags"].([]interface{}); len(tags) != tt.count {
+			t.Errorf("%q: tags %#v, expected %d values", tt.form, fields["tags"], tt.count)
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{max_items: 2}", "receive[/e].fields.a.min_items and receive[/e].fields.a.max_items are only allowed on multiple fields"},
+		{"{multiple: true, min_items: -1}", "must be positive"},
+		{"{multiple: true, min_items: 3, max_items: 2}", "receive[/e].fields.a.min_items 3 must be lower than max_items 2"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestCreateFileMethodMode(t *testing.T) {
+	tests := []struct {
+		methods  string
+		method   string
+		expected map[string]string
+	}{
+		{"[POST, PUT, PATCH]", http.MethodPost, map[string]string{"name": "new", "email": ""}},
+		{"[POST, PUT, PATCH]", http.MethodPut, map[string]string{"name": "new", "email": "old@example.com"}},
+		{"[POST, PUT, PATCH]", http.MethodPatch, map[string]string{"name": "new", "email": "old@example.com"}},
+		{"[]", http.MethodPut, map[string]string{"name": "new", "email": ""}},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    methods: %s
+    fields: {name: {}, email: {}}
+    create_file: {name: %s/rec.yaml}
+`, tt.methods, dir))
+		name := filepath.Join(dir, "rec.yaml")
+		ioutil.WriteFile(name, []byte("name: old\nemail: old@example.com\n"), 0644)
+		w := submit(c, tt.method, "/e", "field.name=new")
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%s %s: status %d, %s", tt.methods, tt.method, w.Code, w.Body.String())
+		}
+		data, _ := ioutil.ReadFile(name)
+		var record map[string]string
+		yaml.Unmarshal(data, &record)
+		for k, v := range tt.expected {
+			if record[k] != v {
+				t.Errorf("%s %s: %s = %q, expected %q", tt.methods, tt.method, k, record[k], v)
+			}
+		}
+	}
+
+	c := parseConfig(t, "receive:\n  /e:\n    methods: [POST]\n    create_file: {name: x.yaml}\n")
+	if w := submit(c, http.MethodPut, "/e", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT status %d when only POST is allowed", w.Code)
+	}
+	msg := parseError(t, "receive:\n  /e:\n    methods: [POST, PUT]\n    create_file: {name: x.toml, format: toml}\n")
+	if !strings.Contains(msg, "receive[/e].create_file.format toml cannot be merged into") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestStrictFields(t *testing.T) {
+	tests := []struct {
+		strict  bool
+		form    string
+		status  int
+		message string
+	}{
+		{false, "field.name=a&field.other=b", http.StatusOK, ""},
+		{true, "field.name=a", http.StatusOK, ""},
+		{true, "field.name=a&redirect=/x&dry_run=0", http.StatusOK, ""},
+		{true, "field.tags[]=a&field.tags[]=b", http.StatusOK, ""},
+		{true, "field.name=a&field.other=b", http.StatusBadRequest, "unexpected fields field.other"},
+		{true, "field.z=a&field.b=b", http.StatusBadRequest, "unexpected fields field.b, field.z"},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    strict_fields: %v
+    fields: {name: {}, tags: {multiple: true}}
+    action: echo
+`, tt.strict))
+		status, _, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status || !strings.Contains(body, tt.message) {
+			t.Errorf("strict %v %s: status %d %q, expected %d %q", tt.strict, tt.form, status, body, tt.status, tt.message)
+		}
+	}
+}
+
+func TestWriteChecksum(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		sum       func([]byte) string
+	}{
+		{"sha256", func(b []byte) string { return fmt.Sprintf("%x", sha256.Sum256(b)) }},
+		{"sha512", func(b []byte) string { return fmt.Sprintf("%x", sha512.Sum512(b)) }},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {name: {}}
+    create_file: {name: %s/rec.yaml, write_checksum: %s}
+`, dir, tt.algorithm))
+		if w := submit(c, http.MethodPost, "/e", "field.name=x"); w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: status %d, %s", tt.algorithm, w.Code, w.Body.String())
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "rec.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sidecar, err := ioutil.ReadFile(filepath.Join(dir, "rec.yaml."+tt.algorithm))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := tt.sum(data) + "  rec.yaml\n"; string(sidecar) != expected {
+			t.Errorf("%s: sidecar %q, expected %q", tt.algorithm, sidecar, expected)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    create_file: {name: x.yaml, write_checksum: md5}\n")
+	if !strings.Contains(msg, "receive[/e].create_file.write_checksum unexpected algorithm md5") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestCreateFileNameMeta(t *testing.T) {
+	tests := []struct {
+		template string
+		method   string
+		headers  []string
+		expected string
+	}{
+		{"{{ .Meta.Method }}/{{ field.id }}.yaml", http.MethodPost, nil, "POST/42.yaml"},
+		{"{{ .Meta.Method }}/{{ field.id }}.yaml", http.MethodPut, nil, "PUT/42.yaml"},
+		{"{{ .Meta.RemoteAddr }}-{{ field.id }}.yaml", http.MethodPost, nil, "192.0.2.1-42.yaml"},
+		{"{{ .Meta.RequestID }}.yaml", http.MethodPost, []string{"X-Request-Id", "req-1"}, "req-1.yaml"},
+		{"{{ .Meta.ReceivedAt.Year }}/{{ field.id }}.yaml", http.MethodPost, nil, fmt.Sprintf("%d/42.yaml", time.Now().Year())},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    methods: [POST, PUT]
+    fields: {id: {}}
+    create_file: {name: '%s/%s'}
+`, dir, tt.template))
+		w := submit(c, tt.method, "/e", "field.id=42", tt.headers...)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: status %d, %s", tt.template, w.Code, w.Body.String())
+		}
+		if _, err := os.Stat(filepath.Join(dir, tt.expected)); err != nil {
+			t.Errorf("%s: %v", tt.template, err)
+		}
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	tests := []struct {
+		overflow string
+		timeout  string
+		status   int
+	}{
+		{"reject", "", http.StatusServiceUnavailable},
+		{"queue", "timeout: 150ms", http.StatusGatewayTimeout},
+		{"queue", "", http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    max_concurrent: 1
+    concurrent_overflow: %s
+    %s
+    create_file: {name: '%s/{{ .Meta.RequestID }}.yaml'}
+`, tt.overflow, tt.timeout, dir))
+		endpoint := c.Receive["/e"]
+		endpoint.CreateFile.storage = slowStorage{delay: 100 * time.Millisecond}
+		first := make(chan int)
+		go func() {
+			first <- submit(c, http.MethodPost, "/e", "", "X-Request-Id", "first").Code
+		}()
+		for len(endpoint.semaphore) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		w := submit(c, http.MethodPost, "/e", "", "X-Request-Id", "second")
+		if w.Code != tt.status {
+			t.Errorf("%s %s: second request status %d, expected %d", tt.overflow, tt.timeout, w.Code, tt.status)
+		}
+		if tt.status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After header", tt.overflow)
+		}
+		if code := <-first; code != http.StatusSeeOther {
+			t.Errorf("%s %s: first request status %d", tt.overflow, tt.timeout, code)
+		}
+		if len(endpoint.semaphore) != 0 {
+			t.Errorf("%s %s: slot not released", tt.overflow, tt.timeout)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e: {max_concurrent: -1}\n")
+	if !strings.Contains(msg, "receive[/e].max_concurrent must be positive, got -1") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /forms/: {action: echo}
+  /forms/special: {action: echo}
+  /forms/deep/: {action: echo}
+  /api: {action: echo, match: prefix}
+  /exact: {action: echo}
+`)
+	tests := []struct {
+		path     string
+		endpoint string
+		subPath  string
+	}{
+		{"/forms/contact", "/forms/", "contact"},
+		{"/forms/", "/forms/", ""},
+		{"/forms/special", "/forms/special", ""},
+		{"/forms/special/x", "/forms/", "special/x"},
+		{"/forms/deep/x/y", "/forms/deep/", "x/y"},
+		{"/api", "/api", ""},
+		{"/api/users/1", "/api", "users/1"},
+		{"/apiary", "", ""},
+		{"/exact", "/exact", ""},
+		{"/exact/x", "", ""},
+		{"/other", "", ""},
+	}
+	for _, tt := range tests {
+		endpoint, subPath := c.route(tt.path)
+		if endpoint != tt.endpoint || subPath != tt.subPath {
+			t.Errorf("%s: routed to %q %q, expected %q %q", tt.path, endpoint, subPath, tt.endpoint, tt.subPath)
+		}
+	}
+
+	_, fields, body := echoFields(t, c, "/forms/deep/x/y", "")
+	if fields["_path"] != "x/y" {
+		t.Errorf("_path %#v (%s), expected the sub path", fields["_path"], body)
+	}
+	if w := submit(c, http.MethodPost, "/other", ""); w.Code != http.StatusNotFound {
+		t.Errorf("status %d for an unknown path", w.Code)
+	}
+	msg := parseError(t, "receive:\n  /e: {match: glob}\n")
+	if !strings.Contains(msg, "receive[/e].match unexpected glob") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestRequireAction(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		message  string
+	}{
+		{"{}", ""},
+		{"{require_action: true}", "receive[/e] has no action, set one such as create_file or action: none"},
+		{"{require_action: true, action: none}", ""},
+		{"{require_action: true, action: echo}", ""},
+		{"{require_action: true, create_file: {name: x.yaml}}", ""},
+		{"{action: none, create_file: {name: x.yaml}}", "receive[/e].action none conflicts with the other actions"},
+		{"{action: echo, create_file: {name: x.yaml}}", "receive[/e].action echo conflicts with the other actions"},
+		{"{action: store}", "receive[/e].action unexpected store"},
+	}
+	for _, tt := range tests {
+		c := &Config{}
+		err := c.Parse([]byte("receive:\n  /e: " + tt.endpoint + "\n"))
+		if tt.message == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.endpoint, err)
+		} else if tt.message != "" && (err == nil || !strings.Contains(err.Error(), tt.message)) {
+			t.Errorf("%s: error %v, expected %q", tt.endpoint, err, tt.message)
+		}
+	}
+
+	c := parseConfig(t, "receive:\n  /e: {action: none}\n")
+	if w := submit(c, http.MethodPost, "/e", "", "Referer", "/thanks"); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/thanks" {
+		t.Errorf("action none: status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// countingWriter counts the writes reaching the storage, failing them with
+// writeErr and the close with closeErr
+type countingWriter struct {
+	writes   int
+	writeErr error
+	closeErr error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.writeErr != nil {
+		return 0, w.writeErr
+	}
+	return len(p), nil
+}
+
+func (w *countingWriter) Close() error {
+	return w.closeErr
+}
+
+// countingStorage is a storage handing out the same countingWriter for every
+// file, renames and removals are ignored
+type countingStorage struct {
+	osStorage
+	w *countingWriter
+}
+
+func (s countingStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	return s.w, nil
+}
+
+func (s countingStorage) Rename(ctx context.Context, oldName, newName string) error {
+	return nil
+}
+
+func (s countingStorage) Remove(ctx context.Context, name string) error {
+	return nil
+}
+
+// largeRecord returns a record of n fields including array fields
+func largeRecord(n int) Record {
+	var record Record
+	for i := 0; i < n; i++ {
+		record = append(record, yaml.MapItem{Key: fmt.Sprintf("field%d", i), Value: strings.Repeat("x", 20)})
+		record = append(record, yaml.MapItem{Key: fmt.Sprintf("tags%d", i), Value: []interface{}{"a", "b", "c"}})
+	}
+	return record
+}
+
+func TestWriteRecordSteps(t *testing.T) {
+	failure := fmt.Errorf("failure")
+	tests := []struct {
+		name   string
+		record Record
+		writer countingWriter
+		step   string
+	}{
+		{"small record write", largeRecord(1), countingWriter{writeErr: failure}, "flush"},
+		{"large record write", largeRecord(1000), countingWriter{writeErr: failure}, "encode"},
+		{"close", largeRecord(1), countingWriter{closeErr: failure}, "close"},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, "receive:\n  /e:\n    create_file: {name: x.yaml}\n")
+		create := c.Receive["/e"].CreateFile
+		create.storage = countingStorage{w: &tt.writer}
+		step, _, err := create.writeRecord(context.Background(), "x.yaml", tt.record)
+		if err == nil || step != tt.step {
+			t.Errorf("%s: step %q error %v, expected %q", tt.name, step, err, tt.step)
+		}
+	}
+}
+
+func BenchmarkWriteRecord(b *testing.B) {
+	record := largeRecord(1000)
+	c := parseConfig(b, "receive:\n  /e:\n    create_file: {name: x.yaml}\n")
+	create := c.Receive["/e"].CreateFile
+	b.Run("unbuffered", func(b *testing.B) {
+		w := &countingWriter{}
+		for i := 0; i < b.N; i++ {
+			err := create.encodeRecord(w, record)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+	})
+	b.Run("buffered", func(b *testing.B) {
+		w := &countingWriter{}
+		create.storage = countingStorage{w: w}
+		for i := 0; i < b.N; i++ {
+			_, _, err := create.writeRecord(context.Background(), "x.yaml", record)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+	})
+}
+
+func TestAcceptContentTypes(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    accept_content_types: [application/x-www-form-urlencoded, "Multipart/Form-Data"]
+    action: echo
+`)
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		{"application/x-www-form-urlencoded", http.StatusOK},
+		{"application/x-www-form-urlencoded; charset=utf-8", http.StatusOK},
+		{"multipart/form-data; boundary=x", http.StatusOK},
+		{"application/json", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+		{"invalid;;", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/e", strings.NewReader("--x--\r\n"))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%q: status %d, expected %d (%s)", tt.contentType, w.Code, tt.status, w.Body.String())
+		}
+		if w.Code == http.StatusUnsupportedMediaType && !strings.Contains(w.Body.String(), "expected application/x-www-form-urlencoded or multipart/form-data") {
+			t.Errorf("%q: body %q", tt.contentType, w.Body.String())
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e: {action: none, accept_content_types: [\"text/\"]}\n")
+	if !strings.Contains(msg, "receive[/e].accept_content_types invalid type text/") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestBoolStyle(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      strict: {type: bool}
+      html: {type: bool, bool_style: html}
+    action: echo
+`)
+	tests := []struct {
+		form     string
+		status   int
+		expected map[string]interface{}
+	}{
+		{"field.strict=true&field.html=on", http.StatusOK, map[string]interface{}{"strict": true, "html": true}},
+		{"field.html=Checked", http.StatusOK, map[string]interface{}{"html": true}},
+		{"field.html=off", http.StatusOK, map[string]interface{}{"html": false}},
+		{"", http.StatusOK, map[string]interface{}{"html": false, "strict": nil}},
+		{"field.strict=on", http.StatusBadRequest, nil},
+		{"field.html=maybe", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status {
+			t.Errorf("%q: status %d, expected %d (%s)", tt.form, status, tt.status, body)
+		}
+		for name, value := range tt.expected {
+			if fields[name] != value {
+				t.Errorf("%q: field %s = %#v, expected %#v", tt.form, name, fields[name], value)
+			}
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{type: bool, bool_style: loose}", "receive[/e].fields.a.bool_style unexpected style loose"},
+		{"{bool_style: html}", "receive[/e].fields.a.bool_style is only allowed on bool fields"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestGeneratePolicy(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	tests := []struct {
+		policy    string
+		form      string
+		status    int
+		submitted bool
+	}{
+		{"always", "field.id=mine", http.StatusOK, false},
+		{"", "field.id=mine", http.StatusOK, false},
+		{"if_absent", "field.id=mine", http.StatusOK, true},
+		{"if_absent", "", http.StatusOK, false},
+		{"never_override", "", http.StatusOK, false},
+		{"never_override", "field.id=mine", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {id: {generate: uuid, generate_policy: "%s"}}
+    action: echo
+`, tt.policy))
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status {
+			t.Errorf("%s %q: status %d, expected %d (%s)", tt.policy, tt.form, status, tt.status, body)
+			continue
+		}
+		if status != http.StatusOK {
+			if !strings.Contains(body, "field.id is generated and cannot be submitted") {
+				t.Errorf("%s %q: body %q", tt.policy, tt.form, body)
+			}
+			continue
+		}
+		id, _ := fields["id"].(string)
+		if tt.submitted && id != "mine" {
+			t.Errorf("%s %q: id %q, expected the submitted value", tt.policy, tt.form, id)
+		} else if !tt.submitted && !uuid.MatchString(id) {
+			t.Errorf("%s %q: id %q, expected a generated UUID", tt.policy, tt.form, id)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    fields: {a: {generate: uuid, generate_policy: sometimes}}\n")
+	if !strings.Contains(msg, "receive[/e].fields.a.generate_policy unexpected sometimes") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestCallbackParam(t *testing.T) {
+	tests := []struct {
+		param    string
+		form     string
+		location string
+	}{
+		{"", "callback=/default", "/default"},
+		{"callback_param: next", "next=/next&callback=/ignored", "/next"},
+		{"callback_param: next", "callback=/ignored", "/referer"},
+		{"callback_param: ''", "callback=/ignored", "/referer"},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    %s
+    action: none
+`, tt.param))
+		w := submit(c, http.MethodPost, "/e", tt.form, "Referer", "/referer")
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != tt.location {
+			t.Errorf("%q %s: status %d location %q, expected %q", tt.param, tt.form, w.Code, w.Header().Get("Location"), tt.location)
+		}
+	}
+
+	// The callback parameter is not taken as a field when unprefixed
+	c := parseConfig(t, `
+receive:
+  /e:
+    field_prefix: ''
+    callback_param: next
+    fields: {next: {}, name: {}}
+    action: echo
+`)
+	_, fields, body := echoFields(t, c, "/e", "next=/next&name=x")
+	if fields["name"] != "x" || fields["next"] != nil {
+		t.Errorf("fields %v (%s), expected next to be left out", fields, body)
+	}
+}
+
+func TestGzipBody(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields: {name: {}}
+    action: echo
+`)
+	compress := func(s string) string {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write([]byte(s))
+		zw.Close()
+		return b.String()
+	}
+	tests := []struct {
+		name     string
+		body     string
+		encoding string
+		status   int
+	}{
+		{"plain", "field.name=x", "", http.StatusOK},
+		{"gzip", compress("field.name=x"), "gzip", http.StatusOK},
+		{"uppercase", compress("field.name=x"), "GZIP", http.StatusOK},
+		{"corrupt", "field.name=x", "gzip", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		var headers []string
+		if tt.encoding != "" {
+			headers = []string{"Content-Encoding", tt.encoding}
+		}
+		status, fields, body := echoFields(t, c, "/e", tt.body, headers...)
+		if status != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.name, status, tt.status, body)
+		} else if status == http.StatusOK && fields["name"] != "x" {
+			t.Errorf("%s: fields %v", tt.name, fields)
+		} else if status == http.StatusBadRequest && !strings.Contains(body, "Error decompressing body") {
+			t.Errorf("%s: body %q", tt.name, body)
+		}
+	}
+}
+
+func TestFieldSourcePriority(t *testing.T) {
+	tests := []struct {
+		priority string
+		target   string
+		form     string
+		expected []interface{}
+	}{
+		{"", "/e?field.tags=query", "field.tags=form", []interface{}{"form", "query"}},
+		{"form", "/e?field.tags=query", "field.tags=form", []interface{}{"form"}},
+		{"form", "/e?field.tags=query", "", []interface{}{"query"}},
+		{"query", "/e?field.tags=query", "field.tags=form", []interface{}{"query"}},
+		{"query", "/e", "field.tags=form", []interface{}{"form"}},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    field_source_priority: "%s"
+    fields: {tags: {multiple: true}}
+    action: echo
+`, tt.priority))
+		_, fields, body := echoFields(t, c, tt.target, tt.form)
+		got, _ := json.Marshal(fields["tags"])
+		expected, _ := json.Marshal(tt.expected)
+		if string(got) != string(expected) {
+			t.Errorf("%q %s %s: tags %s, expected %s (%s)", tt.priority, tt.target, tt.form, got, expected, body)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e: {action: none, field_source_priority: header}\n")
+	if !strings.Contains(msg, "receive[/e].field_source_priority unexpected header") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestCreateFileRest(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		expected string
+	}{
+		{"location", "/contacts/{{ field.id }}", "/contacts/42"},
+		{"meta location", "/{{ .Meta.Method }}/{{ field.id }}", "/POST/42"},
+		{"no location", "", ""},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {id: {type: int}, name: {}}
+    create_file: {name: '%s/{{ field.id }}.yaml', rest: true, location: '%s'}
+`, dir, tt.location))
+		w := submit(c, http.MethodPost, "/e", "field.id=42&field.name=x")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: status %d, %s", tt.name, w.Code, w.Body.String())
+		}
+		if location := w.Header().Get("Location"); location != tt.expected {
+			t.Errorf("%s: location %q, expected %q", tt.name, location, tt.expected)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: content type %q", tt.name, ct)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != `{"id":42,"name":"x"}` {
+			t.Errorf("%s: body %s", tt.name, body)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "42.yaml")); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    create_file: {name: x.yaml, rest: true, location: '{{ .Meta'}\n")
+	if !strings.Contains(msg, "receive[/e].create_file.location template error") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestFieldPrefix(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		form     string
+		expected map[string]interface{}
+	}{
+		{"", "field.name=x&name=y", map[string]interface{}{"name": "x"}},
+		{"field_prefix: ''", "name=y&field.name=x", map[string]interface{}{"name": "y"}},
+		{"field_prefix: 'data-'", "data-name=z&name=y", map[string]interface{}{"name": "z"}},
+		{"field_prefix: 'data-'", "field.name=x", map[string]interface{}{"name": nil}},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    %s
+    fields: {name: {}}
+    action: echo
+`, tt.prefix))
+		_, fields, body := echoFields(t, c, "/e", tt.form)
+		for name, value := range tt.expected {
+			if fields[name] != value {
+				t.Errorf("%q %s: field %s = %#v, expected %#v (%s)", tt.prefix, tt.form, name, fields[name], value, body)
+			}
+		}
+	}
+
+	// Without prefix, the reserved parameters are not unexpected fields
+	c := parseConfig(t, `
+receive:
+  /e:
+    field_prefix: ''
+    strict_fields: true
+    fields: {name: {}}
+    action: echo
+`)
+	reserved := []struct {
+		form   string
+		status int
+	}{
+		{"name=x&callback=/x&dry_run=0", http.StatusOK},
+		{"name=x&other=y", http.StatusBadRequest},
+	}
+	for _, tt := range reserved {
+		if status, _, body := echoFields(t, c, "/e", tt.form); status != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.form, status, tt.status, body)
+		}
+	}
+	properties := c.Receive["/e"].formSchema()["properties"].(map[string]interface{})
+	if _, ok := properties["name"]; !ok {
+		t.Errorf("form schema properties %v, expected the unprefixed key", properties)
+	}
+}
+
+func TestInternalFieldCombinations(t *testing.T) {
+	tests := []struct {
+		field   string
+		message string
+	}{
+		{"{internal: true}", "receive[/e].fields.a is internal and needs a value or generate"},
+		{"{internal: true, value: x, required: true}", "receive[/e].fields.a.required is contradictory with internal"},
+		{"{internal: true, generate: uuid, required: true}", "receive[/e].fields.a.required is contradictory with internal"},
+		{"{internal: true, value: x}", ""},
+		{"{internal: true, generate: timestamp}", ""},
+		{"{internal: true, type: template, template: x}", ""},
+		{"{internal: true, source: \"header:X-A\"}", ""},
+		{"{internal: true, source: \"header:X-A\", required: true}", ""},
+	}
+	for _, tt := range tests {
+		c := &Config{}
+		err := c.Parse([]byte("receive:\n  /e:\n    action: none\n    fields: {a: " + tt.field + "}\n"))
+		if tt.message == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.field, err)
+		} else if tt.message != "" && (err == nil || !strings.Contains(err.Error(), tt.message)) {
+			t.Errorf("%s: error %v, expected %q", tt.field, err, tt.message)
+		}
+	}
+
+	// Internal fields are not read from the submission
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields: {a: {internal: true, value: fixed}}
+    action: echo
+`)
+	if _, fields, body := echoFields(t, c, "/e", "field.a=forged"); fields["a"] != "fixed" {
+		t.Errorf("field a = %#v (%s), expected the internal value", fields["a"], body)
+	}
+}
+
+func TestStoreRaw(t *testing.T) {
+	tests := []struct {
+		name   string
+		gzip   bool
+		body   string
+		status int
+	}{
+		{"raw", false, "field.name=x&field.other=y", http.StatusSeeOther},
+		{"decompressed", true, "field.name=x", http.StatusSeeOther},
+		{"too large", false, "field.name=" + strings.Repeat("x", 64), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {name: {}}
+    create_file: {name: %s/rec.yaml, store_raw: true, max_raw_size: 32}
+`, dir))
+		body := tt.body
+		var headers []string
+		if tt.gzip {
+			var b bytes.Buffer
+			zw := gzip.NewWriter(&b)
+			zw.Write([]byte(tt.body))
+			zw.Close()
+			body = b.String()
+			headers = []string{"Content-Encoding", "gzip"}
+		}
+		w := submit(c, http.MethodPost, "/e", body, headers...)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		raw, err := ioutil.ReadFile(filepath.Join(dir, "rec.yaml.raw"))
+		if tt.status != http.StatusSeeOther {
+			if err == nil {
+				t.Errorf("%s: raw body stored", tt.name)
+			}
+			continue
+		}
+		if string(raw) != tt.body {
+			t.Errorf("%s: raw body %q %v, expected %q", tt.name, raw, err, tt.body)
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "rec.yaml"))
+		if string(data) != "name: x\n" {
+			t.Errorf("%s: record %q", tt.name, data)
+		}
+	}
+}
+
+func TestAllowCIDRs(t *testing.T) {
+	proxies, _ := util.ParseCIDRs([]string{"10.0.0.1"})
+	c := parseConfigWith(t, Options{TrustedProxies: proxies}, `
+receive:
+  /e:
+    allow_cidrs: [192.0.2.0/24, "2001:db8::/32", 198.51.100.7]
+    action: none
+`)
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		status     int
+	}{
+		{"192.0.2.1:1234", "", http.StatusSeeOther},
+		{"[2001:db8::1]:1234", "", http.StatusSeeOther},
+		{"198.51.100.7:1234", "", http.StatusSeeOther},
+		{"198.51.100.8:1234", "", http.StatusForbidden},
+		{"10.0.0.1:1234", "192.0.2.9", http.StatusSeeOther},
+		{"10.0.0.1:1234", "203.0.113.1", http.StatusForbidden},
+		{"192.0.2.1:1234", "203.0.113.1", http.StatusSeeOther},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/e", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, expected %d", tt.remoteAddr, tt.forwarded, w.Code, tt.status)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e: {action: none, allow_cidrs: [10.0.0.0/40]}\n")
+	if !strings.Contains(msg, "receive[/e].allow_cidrs") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestTemplateTimes(t *testing.T) {
+	layouts := []struct {
+		layout   string
+		expected string
+	}{
+		{"2006/01", "2024/03"},
+		{"2006-01-02T15:04", "2024-03-09T08:07"},
+		{"", ""},
+	}
+	at := time.Date(2024, 3, 9, 8, 7, 6, 0, time.UTC)
+	for _, tt := range layouts {
+		if s := formatTime(tt.layout, at); s != tt.expected {
+			t.Errorf("%q: formatted %q, expected %q", tt.layout, s, tt.expected)
+		}
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{`{{ .ReceivedAt | formatTime "2006/01" }}/{{ field.id }}.yaml`, now.Format("2006/01") + "/42.yaml"},
+		{`{{ field.day }}-{{ field.id }}.yaml`, now.Format("20060102") + "-42.yaml"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields:
+      id: {}
+      day: {internal: true, generate: timestamp, format: "20060102"}
+    create_file: {name: '%s/%s'}
+`, dir, tt.name))
+		if w := submit(c, http.MethodPost, "/e", "field.id=42"); w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: status %d, %s", tt.name, w.Code, w.Body.String())
+		}
+		if _, err := os.Stat(filepath.Join(dir, tt.expected)); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestRedirectFallback(t *testing.T) {
+	tests := []struct {
+		fallback string
+		form     string
+		status   int
+		location string
+	}{
+		{"", "", http.StatusSeeOther, "/referer"},
+		{"referer", "", http.StatusSeeOther, "/referer"},
+		{"none", "", http.StatusNoContent, ""},
+		{"none", "callback=/cb", http.StatusSeeOther, "/cb"},
+		{"error", "", http.StatusBadRequest, ""},
+		{"error", "callback=/cb", http.StatusSeeOther, "/cb"},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    redirect_fallback: "%s"
+    action: none
+`, tt.fallback))
+		w := submit(c, http.MethodPost, "/e", tt.form, "Referer", "/referer")
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%q %s: status %d location %q, expected %d %q", tt.fallback, tt.form, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+		if tt.status == http.StatusBadRequest && !strings.Contains(w.Body.String(), "Missing callback parameter") {
+			t.Errorf("%q: body %q", tt.fallback, w.Body.String())
+		}
+	}
+
+	errors := []struct {
+		endpoint string
+		message  string
+	}{
+		{"{action: none, redirect_fallback: home}", "receive[/e].redirect_fallback unexpected home"},
+		{"{action: none, redirect_fallback: error, callback_param: ''}", "receive[/e].redirect_fallback error requires callback_param"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e: "+tt.endpoint+"\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.endpoint, msg, tt.message)
+		}
+	}
+}
+
+func TestValueMap(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      country: {value_map: {fr: France, de: Germany}}
+      level: {type: int, value_map: {low: "1", high: "3"}, value_map_strict: true}
+      langs: {multiple: true, value_map: {fr: French}}
+    action: echo
+`)
+	tests := []struct {
+		form     string
+		status   int
+		expected map[string]interface{}
+		message  string
+	}{
+		{"field.country=fr&field.level=high", http.StatusOK, map[string]interface{}{"country": "France", "level": 3.0}, ""},
+		{"field.country=it", http.StatusOK, map[string]interface{}{"country": "it"}, ""},
+		{"field.level=3", http.StatusBadRequest, nil, `field.level unexpected value "3"`},
+		{"field.langs=fr&field.langs=en", http.StatusOK, map[string]interface{}{"langs": []interface{}{"French", "en"}}, ""},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status || !strings.Contains(body, tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, status, body, tt.status, tt.message)
+		}
+		for name, value := range tt.expected {
+			got, _ := json.Marshal(fields[name])
+			expected, _ := json.Marshal(value)
+			if string(got) != string(expected) {
+				t.Errorf("%s: field %s = %s, expected %s", tt.form, name, got, expected)
+			}
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    action: none\n    fields: {a: {value_map_strict: true}}\n")
+	if !strings.Contains(msg, "receive[/e].fields.a.value_map_strict requires value_map") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      name: {}
+      age: {type: int}
+      tags: {multiple: true}
+    action: echo
+`)
+	tests := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"", "application/json", `{"name":"x","age":3,"tags":["a","b"]}` + "\n"},
+		{"application/json", "application/json", `{"name":"x","age":3,"tags":["a","b"]}` + "\n"},
+		{"application/yaml", "application/yaml", "name: x\nage: 3\ntags:\n- a\n- b\n"},
+		{"text/yaml;q=0.9, */*;q=0.1", "application/yaml", "name: x\nage: 3\ntags:\n- a\n- b\n"},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", "field.name=x&field.age=3&field.tags=a&field.tags=b", "Accept", tt.accept)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != tt.contentType || w.Body.String() != tt.body {
+			t.Errorf("%q: status %d %s %q, expected %s %q", tt.accept, w.Code, w.Header().Get("Content-Type"), w.Body.String(), tt.contentType, tt.body)
+		}
+	}
+	if status, _, body := echoFields(t, c, "/e", "field.age=x"); status != http.StatusBadRequest {
+		t.Errorf("invalid submission echoed, status %d %s", status, body)
+	}
+}
+
+func TestOrderedFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		form     string
+		expected string
+	}{
+		{"{{ range .OrderedFields }}{{ .Value }}-{{ end }}x.yaml", "field.b=2&field.a=1&field.c=3", "2-1-3-x.yaml"},
+		{"{{ range $i, $f := .OrderedFields }}{{ if $i }}_{{ end }}{{ $f.Name }}{{ end }}.yaml", "field.b=2", "b_a_c.yaml"},
+		{"{{ range .OrderedFields }}{{ .Value }}{{ end }}.yaml", "field.b=../x&field.a=1&field.c=3", "13.yaml"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {b: {}, a: {}, c: {}}
+    create_file: {name: '%s/%s'}
+`, dir, tt.name))
+		if w := submit(c, http.MethodPost, "/e", tt.form); w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: status %d, %s", tt.name, w.Code, w.Body.String())
+		}
+		if _, err := os.Stat(filepath.Join(dir, tt.expected)); err != nil {
+			entries, _ := ioutil.ReadDir(dir)
+			t.Errorf("%s: %v, directory has %d entries", tt.name, err, len(entries))
+		}
+	}
+}
+
+func TestFieldUint(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      count: {type: uint}
+      size: {type: uint, max: 10}
+    action: echo
+`)
+	tests := []struct {
+		form     string
+		status   int
+		expected interface{}
+		message  string
+	}{
+		{"field.count=0", http.StatusOK, 0.0, ""},
+		{"field.count=18446744073709551615", http.StatusOK, 18446744073709551615.0, ""},
+		{"field.count=-1", http.StatusBadRequest, nil, "cannot parse field field.count to unsigned integer (value is -1)"},
+		{"field.count=1.5", http.StatusBadRequest, nil, "cannot parse field field.count to unsigned integer"},
+		{"field.size=10", http.StatusOK, nil, ""},
+		{"field.size=11", http.StatusBadRequest, nil, "field.size must be <= 10 (got 11)"},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status || !strings.Contains(body, tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, status, body, tt.status, tt.message)
+		}
+		if tt.expected != nil && fields["count"] != tt.expected {
+			t.Errorf("%s: count %#v, expected %#v", tt.form, fields["count"], tt.expected)
+		}
+	}
+}
+
+func TestFieldPrecision(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      price: {type: float, precision: 2}
+      ratio: {type: float, precision: 0}
+      raw: {type: float}
+    action: echo
+`)
+	tests := []struct {
+		form     string
+		status   int
+		expected map[string]interface{}
+		message  string
+	}{
+		{"field.price=1.005&field.ratio=2.5&field.raw=0.125", http.StatusOK, map[string]interface{}{"price": 1.0, "ratio": 3.0, "raw": 0.125}, ""},
+		{"field.price=+19.999+", http.StatusOK, map[string]interface{}{"price": 20.0}, ""},
+		{"field.price=-0.014", http.StatusOK, map[string]interface{}{"price": -0.01}, ""},
+		{"field.raw=NaN", http.StatusBadRequest, nil, "cannot parse field field.raw"},
+		{"field.raw=Inf", http.StatusBadRequest, nil, "cannot parse field field.raw"},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status || !strings.Contains(body, tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, status, body, tt.status, tt.message)
+		}
+		for name, value := range tt.expected {
+			if fields[name] != value {
+				t.Errorf("%s: %s = %#v, expected %#v", tt.form, name, fields[name], value)
+			}
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{type: int, precision: 2}", "receive[/e].fields.a.precision is only allowed on float fields"},
+		{"{type: float, precision: -1}", "receive[/e].fields.a.precision must be positive (got -1)"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestFieldDatetime(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      at: {type: datetime}
+      day: {type: datetime, input_layout: 02/01/2006, input_layouts: [Jan 2 2006], format: '2006-01-02'}
+    action: echo
+`)
+	tests := []struct {
+		form     string
+		status   int
+		expected map[string]interface{}
+		message  string
+	}{
+		{"field.at=2024-03-01T10:20:30.5%2B02:00", http.StatusOK, map[string]interface{}{"at": "2024-03-01T10:20:30+02:00"}, ""},
+		{"field.at=2024-03-01T10:20:30", http.StatusOK, map[string]interface{}{"at": "2024-03-01T10:20:30Z"}, ""},
+		{"field.at=2024-03-01T10:20", http.StatusOK, map[string]interface{}{"at": "2024-03-01T10:20:00Z"}, ""},
+		{"field.at=+2024-03-01+", http.StatusOK, map[string]interface{}{"at": "2024-03-01T00:00:00Z"}, ""},
+		{"field.day=25/12/2024", http.StatusOK, map[string]interface{}{"day": "2024-12-25"}, ""},
+		{"field.day=Dec+25+2024", http.StatusOK, map[string]interface{}{"day": "2024-12-25"}, ""},
+		{"field.at=yesterday", http.StatusBadRequest, nil, "cannot parse field field.at to date/time"},
+		// The explicit layouts replace the default ones
+		{"field.day=2024-12-25", http.StatusBadRequest, nil, "expected layouts 02/01/2006, Jan 2 2006"},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != tt.status || !strings.Contains(body, tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, status, body, tt.status, tt.message)
+		}
+		for name, value := range tt.expected {
+			if fields[name] != value {
+				t.Errorf("%s: %s = %#v, expected %#v", tt.form, name, fields[name], value)
+			}
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    fields: {a: {input_layout: '2006'}}\n")
+	if expected := "receive[/e].fields.a.input_layout and receive[/e].fields.a.input_layouts are only allowed on datetime fields"; !strings.Contains(msg, expected) {
+		t.Errorf("error %q, expected %q", msg, expected)
+	}
+}
+
+func TestFieldEnum(t *testing.T) {
+	c := parseConfig(t, "receive:\n  /e:\n    fields: {color: {type: enum, allowed: [red, green]}}\n    action: echo\n")
+	tests := []struct {
+		form    string
+		status  int
+		message string
+	}{
+		{"field.color=red", http.StatusOK, `"color":"red"`},
+		{"field.color=green", http.StatusOK, `"color":"green"`},
+		{"field.color=Red", http.StatusBadRequest, `field.color unexpected value "Red", expected one of red, green`},
+		{"field.color=blue", http.StatusBadRequest, `field.color unexpected value "blue", expected one of red, green`},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", tt.form)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, w.Code, w.Body.String(), tt.status, tt.message)
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{type: enum}", "receive[/e].fields.a.allowed is required for enum fields"},
+		{"{allowed: [x]}", "receive[/e].fields.a.allowed is only allowed on enum fields"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestFieldEmail(t *testing.T) {
+	c := parseConfig(t, "receive:\n  /e:\n    fields: {email: {type: email}, checked: {type: email, check_mx: true}}\n    action: echo\n")
+	tests := []struct {
+		form    string
+		status  int
+		message string
+	}{
+		// The local part is case sensitive, only the domain is lowercased
+		{"field.email=+Zoe@Example.COM+", http.StatusOK, `"email":"Zoe@example.com"`},
+		{"field.email=zoe", http.StatusBadRequest, "cannot parse field field.email to email address (value is zoe)"},
+		{"field.email=Zoe+%3Czoe@example.com%3E", http.StatusBadRequest, "cannot parse field field.email to email address"},
+		{"field.email=a@example.com,+b@example.com", http.StatusBadRequest, "cannot parse field field.email to email address"},
+		// Reserved domains never resolve
+		{"field.checked=zoe@example.invalid", http.StatusBadRequest, "field.checked domain example.invalid does not accept email"},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", tt.form)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, w.Code, w.Body.String(), tt.status, tt.message)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    fields: {a: {check_mx: true}}\n")
+	if expected := "receive[/e].fields.a.check_mx is only allowed on email fields"; !strings.Contains(msg, expected) {
+		t.Errorf("error %q, expected %q", msg, expected)
+	}
+}
+
+func TestFieldURL(t *testing.T) {
+	c := parseConfig(t, "receive:\n  /e:\n    fields: {site: {type: url}, repo: {type: url, schemes: [Git, SSH]}}\n    action: echo\n")
+	tests := []struct {
+		form    string
+		status  int
+		message string
+	}{
+		{"field.site=+https://Example.COM/A?b=c+", http.StatusOK, `"site":"https://example.com/A?b=c"`},
+		{"field.site=HTTP://example.com", http.StatusOK, `"site":"http://example.com"`},
+		{"field.repo=ssh://git@example.com/repo", http.StatusOK, `"repo":"ssh://git@example.com/repo"`},
+		{"field.site=example.com", http.StatusBadRequest, "cannot parse field field.site to URL (value is example.com)"},
+		{"field.site=javascript:alert(1)", http.StatusBadRequest, `field.site unexpected URL scheme "javascript", expected one of http, https`},
+		{"field.site=http:///path", http.StatusBadRequest, "field.site URL is missing a host"},
+		{"field.repo=https://example.com", http.StatusBadRequest, `field.repo unexpected URL scheme "https", expected one of git, ssh`},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", tt.form)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, w.Code, w.Body.String(), tt.status, tt.message)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    fields: {a: {schemes: [http]}}\n")
+	if expected := "receive[/e].fields.a.schemes is only allowed on url fields"; !strings.Contains(msg, expected) {
+		t.Errorf("error %q, expected %q", msg, expected)
+	}
+}
+
+func TestFieldMultipleSuffix(t *testing.T) {
+	c := parseConfig(t, "receive:\n  /e:\n    fields: {tags: {multiple: true}, name: {}}\n    action: echo\n")
+	tests := []struct {
+		form     string
+		expected string
+	}{
+		{"field.tags=a&field.tags=b", "a,b"},
+		// Checkbox groups named in the PHP style
+		{"field.tags[]=a&field.tags[]=b", "a,b"},
+		{"field.tags=a&field.tags[]=b", "a,b"},
+		{"field.name[]=a&field.tags=b", "b"},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != http.StatusOK {
+			t.Errorf("%s: status %d %q", tt.form, status, body)
+			continue
+		}
+		var values []string
+		for _, v := range fields["tags"].([]interface{}) {
+			values = append(values, v.(string))
+		}
+		if strings.Join(values, ",") != tt.expected {
+			t.Errorf("%s: tags %q, expected %q", tt.form, values, tt.expected)
+		}
+	}
+
+	// The suffix is only recognized on multiple fields
+	if _, fields, _ := echoFields(t, c, "/e", "field.name[]=a"); fields["name"] != nil {
+		t.Errorf("name = %#v, expected no value", fields["name"])
+	}
+}
+
+func TestFieldDefault(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      country: {default: FR}
+      count: {type: int, default: 1}
+      tags: {multiple: true, default: [new]}
+    action: echo
+`)
+	tests := []struct {
+		form     string
+		expected map[string]interface{}
+	}{
+		{"", map[string]interface{}{"country": "FR", "count": 1.0, "tags": []interface{}{"new"}}},
+		{"field.country=BE&field.count=3&field.tags=x", map[string]interface{}{"country": "BE", "count": 3.0, "tags": []interface{}{"x"}}},
+	}
+	for _, tt := range tests {
+		status, fields, body := echoFields(t, c, "/e", tt.form)
+		if status != http.StatusOK {
+			t.Errorf("%q: status %d %q", tt.form, status, body)
+		}
+		for name, value := range tt.expected {
+			if fmt.Sprint(fields[name]) != fmt.Sprint(value) {
+				t.Errorf("%q: field %s = %#v, expected %#v", tt.form, name, fields[name], value)
+			}
+		}
+	}
+
+	// The defaults are documented in the form schema
+	properties := c.Receive["/e"].formSchema()["properties"].(map[string]interface{})
+	for key, expected := range map[string]string{"field.country": `"FR"`, "field.count": "1", "field.tags": `["new"]`} {
+		if got, _ := json.Marshal(properties[key].(map[string]interface{})["default"]); string(got) != expected {
+			t.Errorf("%s default = %s, expected %s", key, got, expected)
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{default: x, required: true}", "receive[/e].fields.a.default is contradictory with required"},
+		{"{default: x, value: y}", "receive[/e].fields.a.default is only allowed on submitted fields without value or generate"},
+		{"{default: x, generate: uuid}", "receive[/e].fields.a.default is only allowed on submitted fields without value or generate"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestFieldPattern(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      code: {pattern: '[A-Z]{2}[0-9]+'}
+      zip: {pattern: '\d{5}|\d{4}', pattern_message: must be a postal code}
+    action: echo
+`)
+	tests := []struct {
+		form    string
+		status  int
+		message string
+	}{
+		{"field.code=AB12&field.zip=75001", http.StatusOK, `"code":"AB12"`},
+		// The whole value must match, as with the HTML pattern attribute
+		{"field.code=xAB12", http.StatusBadRequest, "field.code does not match pattern [A-Z]{2}[0-9]+ (value is xAB12)"},
+		{"field.code=AB12x", http.StatusBadRequest, "field.code does not match pattern"},
+		{"field.zip=1234", http.StatusOK, `"zip":"1234"`},
+		{"field.zip=123456", http.StatusBadRequest, "field.zip: must be a postal code"},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", tt.form)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, w.Code, w.Body.String(), tt.status, tt.message)
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{type: int, pattern: '[0-9]+'}", "receive[/e].fields.a.pattern is only allowed on string fields"},
+		{"{pattern: '[a-'}", "receive[/e].fields.a.pattern error"},
+		{"{pattern_message: wrong}", "receive[/e].fields.a.pattern_message requires pattern"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestFieldLength(t *testing.T) {
+	c := parseConfig(t, "receive:\n  /e:\n    fields: {title: {min_length: 2, max_length: 4}}\n    action: echo\n")
+	tests := []struct {
+		form    string
+		status  int
+		message string
+	}{
+		{"field.title=ab", http.StatusOK, `"title":"ab"`},
+		// The length counts characters rather than bytes
+		{"field.title=éééé", http.StatusOK, `"title":"éééé"`},
+		{"field.title=a", http.StatusBadRequest, "field.title must have at least 2 characters (got 1)"},
+		{"field.title=abcde", http.StatusBadRequest, "field.title must have at most 4 characters (got 5)"},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", tt.form)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.form, w.Code, w.Body.String(), tt.status, tt.message)
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{type: int, max_length: 2}", "receive[/e].fields.a.min_length and receive[/e].fields.a.max_length are only allowed on string fields"},
+		{"{min_length: -1}", "receive[/e].fields.a.min_length and receive[/e].fields.a.max_length must be positive"},
+		{"{min_length: 5, max_length: 2}", "receive[/e].fields.a.min_length 5 must be lower than max_length 2"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
+
+func TestHoneypot(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		form   string
+		status int
+		body   string
+		stored string
+	}{
+		{"empty", "", "field.name=a&field.website=+", http.StatusSeeOther, "", "name: a\n"},
+		{"accepted", "", "field.name=a&field.website=x", http.StatusSeeOther, "", ""},
+		{"accepted explicitly", "accept", "field.name=a&field.website=x", http.StatusSeeOther, "", ""},
+		{"rejected", "reject", "field.name=a&field.website=x", http.StatusBadRequest, "Submission rejected.\n", ""},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		policy := ""
+		if tt.policy != "" {
+			policy = ", honeypot_policy: " + tt.policy
+		}
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields:
+      name: {}
+      website: {honeypot: true%s}
+    create_file: {name: %s/rec.yaml}
+`, policy, dir))
+		w := submit(c, http.MethodPost, "/e", tt.form)
+		if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.name, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+		// The honeypot is never stored and the bots are not told they got caught
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "rec.yaml"))
+		if string(data) != tt.stored {
+			t.Errorf("%s: stored %q, expected %q", tt.name, data, tt.stored)
+		}
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{honeypot: true, honeypot_policy: ignore}", `receive[/e].fields.a.honeypot_policy unexpected policy ignore, expected "accept" or "reject"`},
+		{"{honeypot_policy: reject}", "receive[/e].fields.a.honeypot_policy requires honeypot"},
+		{"{honeypot: true, required: true}", "receive[/e].fields.a.honeypot is only allowed on optional form fields"},
+		{"{honeypot: true, source: 'header:X-Trap'}", "receive[/e].fields.a.honeypot is only allowed on optional form fields"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
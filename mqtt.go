@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/hashicorp/go-multierror"
+)
+
+const DefaultMQTTTimeout = 10 * time.Second
+
+// mqttClients are the broker connections, shared across configuration
+// reloads
+var mqttClients sync.Map
+
+// ConfigMQTT is the mqtt action, publishing the submission as JSON on a
+// topic rendered from the fields
+type ConfigMQTT struct {
+	Broker        string `yaml:"broker"`
+	ClientID      string `yaml:"client_id"`
+	Username      string `yaml:"username"`
+	PasswordEnv   string `yaml:"password_env"`
+	Topic         string `yaml:"topic"`
+	topicTemplate *template.Template
+	QoS           byte `yaml:"qos"`
+	Retain        bool `yaml:"retain"`
+	IncludeMeta   bool `yaml:"include_meta"`
+}
+
+func (c *ConfigMQTT) parse(key string) (err error) {
+	if c.Broker == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.broker is required", key)).ErrorOrNil()
+	}
+	if c.Topic == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.topic is required", key)).ErrorOrNil()
+	}
+	var e error
+	c.topicTemplate, e = parseProcessTemplate("mqtt.topic", c.Topic)
+	if e != nil {
+		err = multierror.Append(err, fmt.Errorf("%s.topic template error, %v", key, e)).ErrorOrNil()
+	}
+	if c.QoS > 2 {
+		err = multierror.Append(err, fmt.Errorf("%s.qos must be 0, 1 or 2", key)).ErrorOrNil()
+	}
+	if c.ClientID == "" {
+		host, _ := os.Hostname()
+		c.ClientID = fmt.Sprintf("datamgr-%s-%d", host, os.Getpid())
+	}
+	return err
+}
+
+// client returns the connected client of the broker
+func (c *ConfigMQTT) client() (mqtt.Client, error) {
+	key := c.Broker + "\x00" + c.ClientID + "\x00" + c.Username
+	if client, ok := mqttClients.Load(key); ok {
+		return client.(mqtt.Client), nil
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientID).
+		SetAutoReconnect(true).
+		SetConnectTimeout(DefaultMQTTTimeout)
+	if c.Username != "" {
+		opts.SetUsername(c.Username)
+		opts.SetPassword(os.Getenv(c.PasswordEnv))
+	}
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(DefaultMQTTTimeout) {
+		return nil, fmt.Errorf("connecting to %s timed out", c.Broker)
+	} else if token.Error() != nil {
+		return nil, token.Error()
+	}
+	if prev, loaded := mqttClients.LoadOrStore(key, client); loaded {
+		client.Disconnect(0)
+		return prev.(mqtt.Client), nil
+	}
+	return client, nil
+}
+
+// Perform publishes the submission, failing with 502 Bad Gateway if the
+// broker does not take it
+func (c *ConfigMQTT) Perform(w http.ResponseWriter, r *Process) bool {
+	topic, err := r.render(c.topicTemplate)
+	if err != nil {
+		logError("Failed to build topic from template %+v, %v", c.Topic, err)
+		http.Error(w, "Could not process request due to misconfiguration.", http.StatusInternalServerError)
+		return false
+	}
+	payload, err := json.Marshal(r.record(c.IncludeMeta))
+	if err != nil {
+		logError("Failed to encode message for topic %v, %v", topic, err)
+		http.Error(w, "Could not process request because of data error.", http.StatusInternalServerError)
+		return false
+	}
+
+	client, err := c.client()
+	if err == nil {
+		log.Printf("[DEBUG] Publish to %s on %s", topic, c.Broker)
+		token := client.Publish(topic, c.QoS, c.Retain, payload)
+		if !token.WaitTimeout(DefaultMQTTTimeout) {
+			err = fmt.Errorf("publishing timed out")
+		} else {
+			err = token.Error()
+		}
+	}
+	if err != nil {
+		logError("Failed to publish to %s on %s, %v", topic, c.Broker, err)
+		http.Error(w, "Could not publish the request, please try again later.", http.StatusBadGateway)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeBroker is an MQTT broker recording the connections and publications
+// it receives, refusing the connections with code if set
+type fakeBroker struct {
+	listener  net.Listener
+	code      byte
+	mu        sync.Mutex
+	connects  []*packets.ConnectPacket
+	publishes []*packets.PublishPacket
+}
+
+func newFakeBroker(t *testing.T, code byte) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{listener: l, code: code}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return b
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			b.connects = append(b.connects, p)
+			ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			ack.ReturnCode = b.code
+			ack.Write(conn)
+		case *packets.PublishPacket:
+			b.publishes = append(b.publishes, p)
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			}
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+	}
+}
+
+// publication waits for the nth publication to be received and returns it,
+// nil if it does not come
+func (b *fakeBroker) publication(n int) *packets.PublishPacket {
+	for i := 0; i < 100; i++ {
+		b.mu.Lock()
+		if len(b.publishes) >= n {
+			defer b.mu.Unlock()
+			return b.publishes[n-1]
+		}
+		b.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestMQTT(t *testing.T) {
+	t.Setenv("MQTT_PASSWORD", "secret")
+	tests := []struct {
+		name    string
+		options string
+		code    byte
+		status  int
+		topic   string
+		payload string
+		qos     byte
+		retain  bool
+	}{
+		{"qos 0", "{topic: 'forms/{{ field.name }}'}", packets.Accepted, http.StatusSeeOther, "forms/a", `{"name":"a"}`, 0, false},
+		{"qos 1 retained", "{topic: forms, qos: 1, retain: true}", packets.Accepted, http.StatusSeeOther, "forms", `{"name":"a"}`, 1, true},
+		{"meta", "{topic: forms, include_meta: true}", packets.Accepted, http.StatusSeeOther, "forms", `{"data":{"name":"a"},"meta":{"received_at":`, 0, false},
+		{"refused", "{topic: forms, username: user, password_env: MQTT_PASSWORD}", packets.ErrRefusedNotAuthorised, http.StatusBadGateway, "", "", 0, false},
+	}
+	for _, tt := range tests {
+		broker := newFakeBroker(t, tt.code)
+		options := strings.Replace(tt.options, "{", "{broker: 'tcp://"+broker.listener.Addr().String()+"', client_id: test, ", 1)
+		c := parseConfig(t, "receive:\n  /e:\n    fields: {name: {}}\n    mqtt: "+options+"\n")
+		if w := submit(c, http.MethodPost, "/e", "field.name=a"); w.Code != tt.status {
+			t.Fatalf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+		}
+		if tt.status != http.StatusSeeOther {
+			// The client also attempts the previous protocol version
+			broker.mu.Lock()
+			if len(broker.connects) == 0 {
+				t.Errorf("%s: no connection", tt.name)
+			}
+			for _, connect := range broker.connects {
+				if connect.Username != "user" || string(connect.Password) != "secret" {
+					t.Errorf("%s: connection %v", tt.name, connect)
+				}
+			}
+			broker.mu.Unlock()
+			continue
+		}
+
+		// The QoS 0 publications are not acknowledged, they may reach the
+		// broker after the response
+		p := broker.publication(1)
+		if p == nil {
+			t.Fatalf("%s: no publication", tt.name)
+		}
+		if client, ok := mqttClients.LoadAndDelete("tcp://" + broker.listener.Addr().String() + "\x00test\x00"); ok {
+			client.(mqtt.Client).Disconnect(0)
+		}
+		if p.TopicName != tt.topic || !strings.HasPrefix(string(p.Payload), tt.payload) || p.Qos != tt.qos || p.Retain != tt.retain {
+			t.Errorf("%s: published %s %q qos %d retain %v", tt.name, p.TopicName, p.Payload, p.Qos, p.Retain)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    mqtt: {qos: 3}\n")
+	for _, expected := range []string{"receive[/e].mqtt.broker is required", "receive[/e].mqtt.topic is required", "receive[/e].mqtt.qos must be 0, 1 or 2"} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q, expected %q", msg, expected)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultNATSTimeout bounds the flush of a published message when the
+// request has no deadline of its own
+const DefaultNATSTimeout = 10 * time.Second
+
+// natsConns are the server connections, shared across configuration reloads
+var natsConns sync.Map
+
+// ConfigNATS is the nats action, publishing the submission as a message on
+// a subject rendered from the fields
+type ConfigNATS struct {
+	URL             string `yaml:"url"`
+	Subject         string `yaml:"subject"`
+	subjectTemplate *template.Template
+	Encoding        string `yaml:"encoding"`
+	IncludeMeta     bool   `yaml:"include_meta"`
+}
+
+func (c *ConfigNATS) parse(key string) (err error) {
+	if c.URL == "" {
+		c.URL = nats.DefaultURL
+	}
+	if c.Subject == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.subject is required", key)).ErrorOrNil()
+	}
+	var e error
+	c.subjectTemplate, e = parseProcessTemplate("nats.subject", c.Subject)
+	if e != nil {
+		err = multierror.Append(err, fmt.Errorf("%s.subject template error, %v", key, e)).ErrorOrNil()
+	}
+	switch c.Encoding {
+	case "", "json", "yaml":
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.encoding unexpected encoding %v, expected \"json\" or \"yaml\"", key, c.Encoding)).ErrorOrNil()
+	}
+	return err
+}
+
+func (c *ConfigNATS) conn() (*nats.Conn, error) {
+	if nc, ok := natsConns.Load(c.URL); ok {
+		return nc.(*nats.Conn), nil
+	}
+	nc, err := nats.Connect(c.URL, nats.Name("datamgr"))
+	if err != nil {
+		return nil, err
+	}
+	if prev, loaded := natsConns.LoadOrStore(c.URL, nc); loaded {
+		nc.Close()
+		return prev.(*nats.Conn), nil
+	}
+	return nc, nil
+}
+
+func (c *ConfigNATS) encode(record Record) ([]byte, error) {
+	if c.Encoding == "yaml" {
+		var b bytes.Buffer
+		err := yaml.NewEncoder(&b).Encode(record)
+		return b.Bytes(), err
+	}
+	return json.Marshal(record)
+}
+
+// Perform publishes the message and flushes it to the server, failing with
+// 502 Bad Gateway if it cannot be delivered
+func (c *ConfigNATS) Perform(w http.ResponseWriter, r *Process) bool {
+	subject, err := r.render(c.subjectTemplate)
+	if err != nil {
+		logError("Failed to build subject from template %+v, %v", c.Subject, err)
+		http.Error(w, "Could not process request due to misconfiguration.", http.StatusInternalServerError)
+		return false
+	}
+	data, err := c.encode(r.record(c.IncludeMeta))
+	if err != nil {
+		logError("Failed to encode message for subject %v, %v", subject, err)
+		http.Error(w, "Could not process request because of data error.", http.StatusInternalServerError)
+		return false
+	}
+
+	nc, err := c.conn()
+	if err == nil {
+		log.Printf("[DEBUG] Publish to %s on %s", subject, c.URL)
+		err = nc.Publish(subject, data)
+	}
+	if err == nil {
+		// FlushWithContext refuses contexts without a deadline, such as the
+		// background context of queued writes
+		ctx, cancel := context.WithTimeout(r.ctx, DefaultNATSTimeout)
+		err = nc.FlushWithContext(ctx)
+		cancel()
+	}
+	if err != nil {
+		logError("Failed to publish to %s on %s, %v", subject, c.URL, err)
+		http.Error(w, "Could not publish the request, please try again later.", http.StatusBadGateway)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATS is a NATS server recording the published messages, it stops
+// answering the pings once silent is set
+type fakeNATS struct {
+	listener net.Listener
+	mu       sync.Mutex
+	silent   bool
+	messages []string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeNATS{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "PING":
+			s.mu.Lock()
+			silent := s.silent
+			s.mu.Unlock()
+			if !silent {
+				io.WriteString(conn, "PONG\r\n")
+			}
+		case "PUB":
+			size, _ := strconv.Atoi(args[len(args)-1])
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, args[1]+" "+string(payload[:size]))
+			s.mu.Unlock()
+		}
+	}
+}
+
+func TestNATS(t *testing.T) {
+	server := newFakeNATS(t)
+	url := "nats://" + server.listener.Addr().String()
+	tests := []struct {
+		name     string
+		options  string
+		expected string
+	}{
+		{"json", "{subject: 'forms.{{ field.name }}'}", `forms.a {"name":"a"}`},
+		{"yaml", "{subject: forms, encoding: yaml}", "forms name: a\n"},
+		{"meta", "{subject: forms, include_meta: true}", `forms {"data":{"name":"a"},"meta":{"received_at":`},
+	}
+	for _, tt := range tests {
+		options := strings.Replace(tt.options, "{", fmt.Sprintf("{url: '%s', ", url), 1)
+		c := parseConfig(t, "receive:\n  /e:\n    fields: {name: {}}\n    nats: "+options+"\n")
+		server.mu.Lock()
+		server.messages = nil
+		server.mu.Unlock()
+		if w := submit(c, http.MethodPost, "/e", "field.name=a"); w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: status %d, %s", tt.name, w.Code, w.Body.String())
+		}
+		// The message is flushed before the response
+		server.mu.Lock()
+		if len(server.messages) != 1 || !strings.HasPrefix(server.messages[0], tt.expected) {
+			t.Errorf("%s: published %q, expected %q", tt.name, server.messages, tt.expected)
+		}
+		server.mu.Unlock()
+	}
+
+	c := parseConfig(t, fmt.Sprintf("receive:\n  /e:\n    fields: {name: {}}\n    nats: {url: '%s', subject: forms}\n", url))
+	r := c.Receive["/e"]
+	p := &Process{ConfigReceive: r, Fields: map[string]ConfigField{"name": {Value: "a"}}}
+	deadline, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	contexts := []struct {
+		name   string
+		ctx    context.Context
+		silent bool
+		ok     bool
+	}{
+		// Queued writes run without a deadline
+		{"background", context.Background(), false, true},
+		{"deadline exceeded", deadline, true, false},
+	}
+	for _, tt := range contexts {
+		server.mu.Lock()
+		server.silent = tt.silent
+		server.mu.Unlock()
+		p.ctx = tt.ctx
+		w := httptest.NewRecorder()
+		if ok := r.NATS.Perform(w, p); ok != tt.ok {
+			t.Errorf("%s: performed %v, status %d", tt.name, ok, w.Code)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    nats: {encoding: xml}\n")
+	for _, expected := range []string{"receive[/e].nats.subject is required", `receive[/e].nats.encoding unexpected encoding xml, expected "json" or "yaml"`} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q, expected %q", msg, expected)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"text/template"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// ConfigNotify is the notify action, posting a message to a chat incoming
+// webhook. It is best effort and does not fail the submission.
+type ConfigNotify struct {
+	Webhook         string `yaml:"webhook"`
+	Service         string `yaml:"service"`
+	Message         string `yaml:"message"`
+	messageTemplate *template.Template
+	forward         ConfigForward
+}
+
+func (c *ConfigNotify) parse(key string) (err error) {
+	switch c.Service {
+	case "", "slack", "mattermost", "discord":
+	default:
+		err = multierror.Append(err, fmt.Errorf("%s.service unexpected service %v, expected \"slack\", \"mattermost\" or \"discord\"", key, c.Service)).ErrorOrNil()
+	}
+	if c.Message == "" {
+		c.Message = "New submission on {{ .Meta.Endpoint }}\n{{ range .OrderedFields }}{{ .Name }}: {{ .Value }}\n{{ end }}"
+	}
+	var e error
+	c.messageTemplate, e = parseProcessTemplate("notify.message", c.Message)
+	if e != nil {
+		err = multierror.Append(err, fmt.Errorf("%s.message template error, %v", key, e)).ErrorOrNil()
+	}
+	if u, e := url.Parse(c.Webhook); e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		err = multierror.Append(err, fmt.Errorf("%s.webhook %q is not an http(s) URL", key, c.Webhook)).ErrorOrNil()
+	}
+	c.forward = ConfigForward{URLs: []string{c.Webhook}, Timeout: DefaultForwardTimeout, Retries: 1}
+	return err
+}
+
+// Perform posts the message in the background so that a slow webhook does
+// not delay the response, errors are only logged
+func (c *ConfigNotify) Perform(r *Process) {
+	message, err := r.render(c.messageTemplate)
+	if err != nil {
+		logError("Failed to build notification from template %+v, %v", c.Message, err)
+		return
+	}
+	// Slack and Mattermost take the message as text, Discord as content
+	payload := map[string]string{"text": message}
+	if c.Service == "discord" {
+		payload = map[string]string{"content": message}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logError("Failed to encode notification, %v", err)
+		return
+	}
+	log.Printf("[DEBUG] Notify %s webhook", c.Service)
+	// The request context ends with the response, each attempt is bounded
+	// by the forward timeout instead. The write queue waits for the
+	// notification when draining.
+	r.options.Queue.Go(func() {
+		err := c.forward.post(context.Background(), c.Webhook, body, "application/json")
+		if err != nil {
+			logError("Failed to post notification, %v", err)
+		}
+	})
+}
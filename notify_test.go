@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  string
+		statuses []int
+		bodies   []string
+	}{
+		{"slack", "{message: 'Hello {{ field.name }}'}", nil, []string{`{"text":"Hello a"}`}},
+		{"discord", "{service: discord, message: 'Hello {{ field.name }}'}", nil, []string{`{"content":"Hello a"}`}},
+		{"default message", "{service: mattermost}", nil, []string{`{"text":"New submission on /e\nname: a\n"}`}},
+		// Server errors are retried once, the submission is accepted anyway
+		{"failed", "{}", []int{http.StatusBadGateway, http.StatusBadGateway}, []string{`{"text":"New submission on /e\nname: a\n"}`, `{"text":"New submission on /e\nname: a\n"}`}},
+	}
+	for _, tt := range tests {
+		d := &downstream{statuses: tt.statuses}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The response does not wait for the webhook
+			time.Sleep(50 * time.Millisecond)
+			d.ServeHTTP(w, r)
+		}))
+		queue := NewWriteQueue(0, 0)
+		options := strings.Replace(tt.options, "{", fmt.Sprintf("{webhook: '%s', ", server.URL), 1)
+		c := parseConfigWith(t, Options{Queue: queue}, "receive:\n  /e:\n    fields: {name: {}}\n    notify: "+options+"\n")
+		if w := submit(c, http.MethodPost, "/e", "field.name=a"); w.Code != http.StatusSeeOther {
+			t.Errorf("%s: status %d", tt.name, w.Code)
+		}
+		d.mu.Lock()
+		posted := len(d.bodies)
+		d.mu.Unlock()
+		if posted != 0 {
+			t.Errorf("%s: notification posted before the response", tt.name)
+		}
+
+		// Draining waits for the notifications in flight
+		err := queue.Drain(context.Background())
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(d.bodies, "\n") != strings.Join(tt.bodies, "\n") {
+			t.Errorf("%s: posted %q, expected %q", tt.name, d.bodies, tt.bodies)
+		}
+	}
+
+	errors := []struct {
+		options string
+		message string
+	}{
+		{"{}", `receive[/e].notify.webhook "" is not an http(s) URL`},
+		{"{webhook: 'http://x', service: teams}", `receive[/e].notify.service unexpected service teams, expected "slack", "mattermost" or "discord"`},
+		{"{webhook: 'http://x', message: '{{ .Nope'}", "receive[/e].notify.message template error"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    notify: "+tt.options+"\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.options, msg, tt.message)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// JWKSRefresh is the age past which the keys of an issuer are fetched
+	// again, unknown key ids are fetched at most every JWKSMinRefresh
+	JWKSRefresh    = time.Hour
+	JWKSMinRefresh = time.Minute
+	// JWTLeeway is the clock skew tolerated on the token times
+	JWTLeeway = time.Minute
+)
+
+// ConfigOIDC validates the bearer tokens signed by an OpenID Connect
+// issuer, the keys are discovered from the issuer unless jwks_url is set
+type ConfigOIDC struct {
+	Issuer   string `yaml:"issuer"`
+	JWKSURL  string `yaml:"jwks_url"`
+	Audience string `yaml:"audience"`
+	// discovered is the jwks_uri of the issuer, once discovered
+	discovered string
+	mu         sync.Mutex
+}
+
+func (c *ConfigOIDC) parse(key string) (err error) {
+	if !httpURL(c.Issuer) {
+		err = multierror.Append(err, fmt.Errorf("%s.issuer %q is not an http(s) URL", key, c.Issuer)).ErrorOrNil()
+	}
+	if c.Audience == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.audience is required", key)).ErrorOrNil()
+	}
+	if c.JWKSURL != "" && !httpURL(c.JWKSURL) {
+		err = multierror.Append(err, fmt.Errorf("%s.jwks_url %q is not an http(s) URL", key, c.JWKSURL)).ErrorOrNil()
+	}
+	return err
+}
+
+func httpURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// jwksCaches are the keys fetched for each JWKS URL, shared across
+// configuration reloads
+var jwksCaches sync.Map
+
+type jwksCache struct {
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// key returns the public key with the kid, fetching the keys if they are
+// stale or the kid is unknown
+func (c *ConfigOIDC) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	jwksURL, err := c.jwksURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := jwksCaches.LoadOrStore(jwksURL, &jwksCache{})
+	cache := v.(*jwksCache)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	key, ok := cache.keys[kid]
+	age := time.Since(cache.fetched)
+	if age > JWKSRefresh || (!ok && age > JWKSMinRefresh) {
+		keys, err := fetchJWKS(ctx, jwksURL)
+		if err != nil {
+			return nil, err
+		}
+		cache.keys, cache.fetched = keys, time.Now()
+		key, ok = keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// jwksURL returns jwks_url or the jwks_uri of the issuer discovery document
+func (c *ConfigOIDC) jwksURL(ctx context.Context) (string, error) {
+	if c.JWKSURL != "" {
+		return c.JWKSURL, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.discovered != "" {
+		return c.discovered, nil
+	}
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	err := getJSON(ctx, strings.TrimSuffix(c.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return "", fmt.Errorf("discovery: %v", err)
+	}
+	if discovery.JWKSURI == "" {
+		return "", errors.New("discovery: missing jwks_uri")
+	}
+	c.discovered = discovery.JWKSURI
+	return c.discovered, nil
+}
+
+func getJSON(ctx context.Context, target string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, DefaultForwardTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", target, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// fetchJWKS returns the RSA and EC keys of a JWK set by key id, the other
+// keys are ignored
+func fetchJWKS(ctx context.Context, jwksURL string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err := getJSON(ctx, jwksURL, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, e1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, e2 := base64.RawURLEncoding.DecodeString(k.E)
+			if e1 == nil && e2 == nil {
+				keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384()}
+			x, e1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, e2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if curve, ok := curves[k.Crv]; ok && e1 == nil && e2 == nil {
+				keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			}
+		}
+	}
+	return keys, nil
+}
+
+// jwtAlgorithms are the supported signature algorithms and their hash, the
+// ECDSA algorithms are bound to the curve of their key
+var jwtAlgorithms = map[string]struct {
+	hash  crypto.Hash
+	new   func() hash.Hash
+	curve elliptic.Curve
+}{
+	"RS256": {crypto.SHA256, sha256.New, nil},
+	"RS384": {crypto.SHA384, sha512.New384, nil},
+	"RS512": {crypto.SHA512, sha512.New, nil},
+	"ES256": {crypto.SHA256, sha256.New, elliptic.P256()},
+	"ES384": {crypto.SHA384, sha512.New384, elliptic.P384()},
+}
+
+// Verify checks the signature, issuer, audience and validity period of the
+// token and returns its claims
+func (c *ConfigOIDC) Verify(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %v", err)
+	}
+	key, err := c.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := alg.new()
+	digest.Write([]byte(parts[0] + "." + parts[1]))
+	sum := digest.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg.curve != nil || rsa.VerifyPKCS1v15(k, alg.hash, sum, signature) != nil {
+			return nil, errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg.curve != k.Curve || len(signature) != 2*size {
+			return nil, errors.New("invalid signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, sum, r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %v", err)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(JWTLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(JWTLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if iss, _ := claims["iss"].(string); iss != c.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !jwtAudience(claims["aud"], c.Audience) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtAudience tells if the aud claim, a string or an array, contains
+// audience
+func jwtAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, item := range a {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIssuer is an OpenID Connect issuer publishing an RSA and a P-256 key
+type fakeIssuer struct {
+	*httptest.Server
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &fakeIssuer{rsa: rsaKey, ec: ecKey}
+	b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	i.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": i.URL, "jwks_uri": i.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string][]map[string]string{"keys": {
+				{"kid": "rsa", "kty": "RSA", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+				{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+				{"kid": "oct", "kty": "oct", "k": "c2VjcmV0"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(i.Close)
+	return i
+}
+
+// sign returns a token of the claims signed by the key kid with the hash,
+// whatever the alg of the header
+func (i *fakeIssuer) sign(t *testing.T, alg, kid string, h crypto.Hash, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := h.New()
+	digest.Write([]byte(signed))
+	var signature []byte
+	var err error
+	if kid == "ec" {
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, i.ec, digest.Sum(nil))
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsa, h, digest.Sum(nil))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	c := &ConfigOIDC{Issuer: issuer.URL, Audience: "forms"}
+	now := time.Now().Unix()
+	valid := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"iss": issuer.URL, "aud": "forms", "sub": "alice", "exp": now + 60}
+		for k, v := range changes {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"RS256", issuer.sign(t, "RS256", "rsa", crypto.SHA256, valid(nil)), ""},
+		{"RS512", issuer.sign(t, "RS512", "rsa", crypto.SHA512, valid(nil)), ""},
+		{"ES256", issuer.sign(t, "ES256", "ec", crypto.SHA256, valid(nil)), ""},
+		{"audience array", issuer.sign(t, "RS256", "rsa", crypto.SHA256, valid(map[string]interface{}{"aud": []string{"other", "forms"}})), ""},
+		{"expired within leeway", issuer.sign(t, "RS256", "rsa", crypto.SHA256, valid(map[string]interface{}{"exp": now - 30})), ""},
+		// The curve of the key is bound to the algorithm, a P-256 key cannot
+		// verify an ES384 signature
+		{"ES384 with a P-256 key", issuer.sign(t, "ES384", "ec", crypto.SHA384, valid(nil)), "invalid signature"},
+		{"ES256 with an RSA key", issuer.sign(t, "ES256", "rsa", crypto.SHA256, valid(nil)), "invalid signature"},
+		{"RS256 with an EC key", issuer.sign(t, "RS256", "ec", crypto.SHA256, valid(nil)), "invalid signature"},
+		{"wrong hash", issuer.sign(t, "RS384", "rsa", crypto.SHA256, valid(nil)), "invalid signature"},
+		{"none", issuer.sign(t, "none", "rsa", crypto.SHA256, valid(nil)), `unsupported algorithm "none"`},
+		{"HS256", issuer.sign(t, "HS256", "oct", crypto.SHA256, valid(nil)), `unsupported algorithm "HS256"`},
+		{"unknown key", issuer.sign(t, "RS256", "other", crypto.SHA256, valid(nil)), `unknown key id "other"`},
+		{"expired", issuer.sign(t, "RS256", "rsa", crypto.SHA256, valid(map[string]interface{}{"exp": now - 120})), "token expired"},
+		{"no expiry", issuer.sign(t, "RS256", "rsa", crypto.SHA256, valid(map[string]interface{}{"exp": nil})), "token expired"},
+		{"not yet valid", issuer.sign(t, "RS256", "rsa", crypto.SHA256, valid(map[string]interface{}{"nbf": now + 120})), "token not yet valid"},
+		{"issuer", issuer.sign(t, "RS256", "rsa", crypto.SHA256, valid(map[string]interface{}{"iss": "https://evil.example.com"})), `unexpected issuer "https://evil.example.com"`},
+		{"audience", issuer.sign(t, "RS256", "rsa", crypto.SHA256, valid(map[string]interface{}{"aud": "other"})), "unexpected audience"},
+		{"malformed", "a.b", "malformed token"},
+	}
+	for _, tt := range tests {
+		claims, err := c.Verify(context.Background(), tt.token)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err == "" && claims["sub"] != "alice":
+			t.Errorf("%s: claims %v", tt.name, claims)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%s: error %v, expected %q", tt.name, err, tt.err)
+		}
+	}
+
+	// A tampered payload does not match the signature
+	token := issuer.sign(t, "RS256", "rsa", crypto.SHA256, valid(nil))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(valid(map[string]interface{}{"sub": "admin"}))
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := c.Verify(context.Background(), strings.Join(parts, ".")); err == nil || err.Error() != "invalid signature" {
+		t.Errorf("tampered payload: %v", err)
+	}
+}
+
+func TestOIDCAuth(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    auth: {oidc: {issuer: '%s', audience: forms}}
+    fields: {user: {source: 'claim:sub'}, groups: {source: 'claim:groups', multiple: true}}
+    action: echo
+`, issuer.URL))
+	claims := map[string]interface{}{"iss": issuer.URL, "aud": "forms", "sub": "alice", "groups": []string{"a", "b"}, "exp": time.Now().Unix() + 60}
+	status, fields, body := echoFields(t, c, "/e", "field.user=mallory", "Authorization", "Bearer "+issuer.sign(t, "ES256", "ec", crypto.SHA256, claims))
+	if status != http.StatusOK || fields["user"] != "alice" || fmt.Sprint(fields["groups"]) != "[a b]" {
+		t.Errorf("status %d, fields %v (%s)", status, fields, body)
+	}
+
+	delete(claims, "exp")
+	for _, authorization := range []string{"", "Bearer " + issuer.sign(t, "ES256", "ec", crypto.SHA256, claims), "Basic YTpi"} {
+		w := submit(c, http.MethodPost, "/e", "", "Authorization", authorization)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="datamgr"` {
+			t.Errorf("%q: status %d, WWW-Authenticate %q", authorization, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    auth: {oidc: {issuer: 'issuer', jwks_url: 'ftp://x'}}\n")
+	for _, expected := range []string{
+		`receive[/e].auth.oidc.issuer "issuer" is not an http(s) URL`,
+		"receive[/e].auth.oidc.audience is required",
+		`receive[/e].auth.oidc.jwks_url "ftp://x" is not an http(s) URL`,
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Errorf("error %q, expected %q", msg, expected)
+		}
+	}
+}
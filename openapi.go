@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OpenAPI builds an OpenAPI 3 document describing the receive endpoints
+func (c *Config) OpenAPI() map[string]interface{} {
+	paths := map[string]interface{}{}
+	for endpoint, r := range c.Receive {
+		schema := r.formSchema()
+		content := map[string]interface{}{
+			"application/x-www-form-urlencoded": map[string]interface{}{"schema": schema},
+			"multipart/form-data":               map[string]interface{}{"schema": schema},
+		}
+		methods := r.Methods
+		if len(methods) == 0 {
+			methods = []string{http.MethodPost}
+		}
+		operations := map[string]interface{}{}
+		for _, method := range methods {
+			operations[strings.ToLower(method)] = map[string]interface{}{
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content":  content,
+				},
+				"responses": r.responses(),
+			}
+		}
+		paths[endpoint] = operations
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "datamgr",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+	}
+}
+
+// responses lists the statuses serve may answer with the configuration of
+// the endpoint
+func (c *ConfigReceive) responses() map[string]interface{} {
+	reasons := map[int][]string{}
+	add := func(status int, reason string) {
+		reasons[status] = append(reasons[status], reason)
+	}
+
+	add(http.StatusOK, "Dry run, the submission is valid")
+	switch {
+	case c.actionCode == ActionCodeEcho:
+		add(http.StatusOK, "Submission parsed, the fields are returned")
+	case c.CreateFile != nil && c.CreateFile.Async:
+		add(http.StatusAccepted, "Submission queued, the request id is returned")
+	case c.CreateFile != nil && c.CreateFile.Rest:
+		add(http.StatusCreated, "Submission stored, redirect to the location of the record")
+	default:
+		if c.CreateFile != nil && c.CreateFile.ReportPath {
+			add(http.StatusOK, "Submission stored, the file is returned to JSON clients")
+		}
+		var targets []string
+		if *c.CallbackParam != "" {
+			targets = append(targets, "callback")
+		}
+		switch c.redirectCode {
+		case RedirectCodeNone:
+			add(http.StatusNoContent, "Submission accepted")
+		case RedirectCodeError:
+			add(http.StatusBadRequest, "Missing callback")
+		default:
+			targets = append(targets, "referer")
+		}
+		if len(targets) > 0 {
+			add(http.StatusSeeOther, "Submission accepted, redirect to the "+strings.Join(targets, " or "))
+		}
+	}
+
+	add(http.StatusBadRequest, "Invalid submission")
+	if c.Auth != nil {
+		add(http.StatusUnauthorized, "Missing or invalid credentials")
+	}
+	if len(c.AllowCIDRs) > 0 {
+		add(http.StatusForbidden, "Client address not allowed")
+	}
+	if c.CSRF != nil {
+		add(http.StatusForbidden, "Invalid CSRF token")
+	}
+	if c.Captcha != nil {
+		add(http.StatusForbidden, "Captcha verification failed")
+		add(http.StatusBadGateway, "Captcha provider error")
+	}
+	if c.CreateFile != nil && c.CreateFile.StoreRaw {
+		add(http.StatusRequestEntityTooLarge, "Request body too large to be stored")
+	}
+	if len(c.AcceptContentTypes) > 0 {
+		add(http.StatusUnsupportedMediaType, "Unsupported content type")
+	}
+	if c.RateLimit != nil || c.options.RateLimit != nil {
+		add(http.StatusTooManyRequests, "Rate limit exceeded")
+	}
+	add(http.StatusInternalServerError, "System error")
+	if c.Forward != nil || c.SendEmail != nil || c.MQTT != nil || c.NATS != nil {
+		add(http.StatusBadGateway, "Error from a downstream service")
+	}
+	add(http.StatusServiceUnavailable, "Server under maintenance")
+	if c.overflowCode == OverflowCodeReject && c.semaphore != nil {
+		add(http.StatusServiceUnavailable, "Too many concurrent requests")
+	}
+	if c.CreateFile != nil && c.CreateFile.Async {
+		add(http.StatusServiceUnavailable, "Too many pending writes")
+	}
+	if c.Timeout > 0 {
+		add(http.StatusGatewayTimeout, "Request processing timed out")
+	}
+	if c.CreateFile != nil || c.AppendFile != nil {
+		add(http.StatusInsufficientStorage, "Insufficient storage")
+	}
+
+	responses := map[string]interface{}{}
+	for status, r := range reasons {
+		responses[strconv.Itoa(status)] = map[string]interface{}{"description": strings.Join(r, "; ")}
+	}
+	return responses
+}
+
+// formSchema returns the schema of the form accepted by the endpoint, internal
+// fields and fields from other sources are not part of it as they cannot be
+// submitted in the form. Honeypot fields are left out not to reveal them.
+func (c *ConfigReceive) formSchema() map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for name, f := range c.Fields {
+		if f.Internal || f.Honeypot || f.sourceCode != SourceCodeForm {
+			continue
+		}
+		properties[c.formKey(name)] = f.schema()
+		if f.Required {
+			required = append(required, c.formKey(name))
+		}
+	}
+	sort.Strings(required)
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schema returns the JSON schema of a single field value
+func (f *ConfigField) schema() map[string]interface{} {
+	schema := map[string]interface{}{}
+	switch f.typeCode {
+	case TypeCodeString, TypeCodeDatetime:
+		schema["type"] = "string"
+	case TypeCodeBool:
+		schema["type"] = "boolean"
+	case TypeCodeInt:
+		schema["type"] = "integer"
+	case TypeCodeUint:
+		schema["type"] = "integer"
+		schema["minimum"] = 0
+	case TypeCodeFloat:
+		schema["type"] = "number"
+	case TypeCodeEmail:
+		schema["type"] = "string"
+		schema["format"] = "email"
+	case TypeCodeURL:
+		schema["type"] = "string"
+		schema["format"] = "uri"
+	case TypeCodeEnum:
+		schema["type"] = "string"
+		schema["enum"] = f.Allowed
+	case TypeCodeFile, TypeCodeFileContent:
+		schema["type"] = "string"
+		schema["format"] = "binary"
+	}
+	if f.MinLength > 0 {
+		schema["minLength"] = f.MinLength
+	}
+	if f.MaxLength > 0 {
+		schema["maxLength"] = f.MaxLength
+	}
+	if f.Pattern != "" {
+		schema["pattern"] = "^(?:" + f.Pattern + ")$"
+	}
+	if f.Min != nil {
+		schema["minimum"] = *f.Min
+	}
+	if f.Max != nil {
+		schema["maximum"] = *f.Max
+	}
+	if f.Multiple {
+		schema = map[string]interface{}{
+			"type":  "array",
+			"items": schema,
+		}
+		if f.MinItems > 0 {
+			schema["minItems"] = f.MinItems
+		}
+		if f.MaxItems > 0 {
+			schema["maxItems"] = f.MaxItems
+		}
+	}
+	if f.Default != nil {
+		// The default of multiple fields is the whole array
+		schema["default"] = jsonValue(f.Default)
+	}
+	return schema
+}
+
+// OpenAPIHandler serves the OpenAPI document of the live configuration as JSON
+func (h *ConfigHolder) OpenAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(h.Get().OpenAPI())
+		if err != nil {
+			log.Printf("[ERROR] Failed to encode OpenAPI document, %v", err)
+		}
+	})
+}
+
+// JSONSchema returns the JSON Schema document of the form accepted by the
+// endpoint
+func (c *ConfigReceive) JSONSchema(endpoint string) map[string]interface{} {
+	schema := c.formSchema()
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = endpoint
+	return schema
+}
+
+// serveSchema serves the JSON Schema of the endpoint
+func (c *ConfigReceive) serveSchema(w http.ResponseWriter, endpoint string) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	err := json.NewEncoder(w).Encode(c.JSONSchema(endpoint))
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode JSON Schema document, %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestOpenAPIFields(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /contact:
+    methods: [POST, PUT]
+    fields:
+      name: {required: true, min_length: 2, pattern: "[a-z]+"}
+      age: {type: int, min: 0, max: 150}
+      tags: {multiple: true, max_items: 3}
+      color: {type: enum, allowed: [red, blue]}
+      secret: {internal: true, value: x}
+      trap: {honeypot: true}
+      agent: {source: "header:User-Agent"}
+    action: echo
+`)
+	doc := c.OpenAPI()
+	ops := doc["paths"].(map[string]interface{})["/contact"].(map[string]interface{})
+	if _, ok := ops["post"]; !ok {
+		t.Errorf("missing post operation")
+	}
+	if _, ok := ops["put"]; !ok {
+		t.Errorf("missing put operation")
+	}
+	schema := c.Receive["/contact"].formSchema()
+	properties := schema["properties"].(map[string]interface{})
+	for _, key := range []string{"field.secret", "field.trap", "field.agent"} {
+		if _, ok := properties[key]; ok {
+			t.Errorf("%s is in the form schema", key)
+		}
+	}
+	tests := []struct {
+		key, property string
+		expected      interface{}
+	}{
+		{"field.name", "minLength", 2},
+		{"field.name", "pattern", "^(?:[a-z]+)$"},
+		{"field.age", "type", "integer"},
+		{"field.age", "maximum", 150.0},
+		{"field.tags", "type", "array"},
+		{"field.tags", "maxItems", 3},
+		{"field.color", "enum", []string{"red", "blue"}},
+	}
+	for _, tt := range tests {
+		got, _ := json.Marshal(properties[tt.key].(map[string]interface{})[tt.property])
+		expected, _ := json.Marshal(tt.expected)
+		if string(got) != string(expected) {
+			t.Errorf("%s %s = %s, expected %s", tt.key, tt.property, got, expected)
+		}
+	}
+	if required, _ := json.Marshal(schema["required"]); string(required) != `["field.name"]` {
+		t.Errorf("required = %s", required)
+	}
+}
+
+// TestOpenAPIResponses checks that the statuses answered by serve are
+// documented in the OpenAPI document of the endpoint
+func TestOpenAPIResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		options Options
+		setup   func(r *ConfigReceive)
+		form    string
+		headers []string
+		status  int
+	}{
+		{name: "dry run", config: "action: none", form: "dry_run=1", status: http.StatusOK},
+		{name: "echo", config: "action: echo", status: http.StatusOK},
+		{name: "redirect", config: "action: none", status: http.StatusSeeOther},
+		{name: "no content", config: "{action: none, redirect_fallback: none}", status: http.StatusNoContent},
+		{name: "missing callback", config: "{action: none, redirect_fallback: error}", status: http.StatusBadRequest},
+		{name: "invalid", config: "action: none", form: "field.n=x", status: http.StatusBadRequest},
+		{name: "rest", config: "create_file: {name: 'DIR/{{ .Meta.RequestID }}.yaml', rest: true, location: /x}", status: http.StatusCreated},
+		{
+			name:    "async",
+			config:  "create_file: {name: 'DIR/{{ .Meta.RequestID }}.yaml', async: true}",
+			options: Options{Queue: NewWriteQueue(1, 1)},
+			status:  http.StatusAccepted,
+		},
+		{
+			name:    "queue full",
+			config:  "create_file: {name: 'DIR/{{ .Meta.RequestID }}.yaml', async: true}",
+			options: Options{Queue: NewWriteQueue(0, 0)},
+			status:  http.StatusServiceUnavailable,
+		},
+		{name: "auth", config: "{action: none, auth: {api_keys: [k]}}", status: http.StatusUnauthorized},
+		{name: "client", config: "{action: none, allow_cidrs: [10.0.0.0/8]}", status: http.StatusForbidden},
+		{name: "csrf", config: "{action: none, csrf: {}}", status: http.StatusForbidden},
+		{
+			name:   "raw too large",
+			config: "create_file: {name: DIR/a.yaml, store_raw: true, max_raw_size: 4}",
+			form:   "field.n=12345",
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:    "content type",
+			config:  "{action: none, accept_content_types: [application/json]}",
+			status:  http.StatusUnsupportedMediaType,
+			headers: []string{"Content-Type", "text/plain"},
+		},
+		{name: "rate limit", config: "{action: none, rate_limit: {requests: 1, window: 1m}}", status: http.StatusTooManyRequests},
+		{
+			name:   "concurrency",
+			config: "{action: none, max_concurrent: 1, concurrent_overflow: reject}",
+			setup:  func(r *ConfigReceive) { r.semaphore <- struct{}{} },
+			status: http.StatusServiceUnavailable,
+		},
+		{name: "timeout", config: "{action: none, timeout: 1ns}", status: http.StatusGatewayTimeout},
+		{
+			name:   "disk full",
+			config: "create_file: {name: DIR/a.yaml}",
+			setup:  func(r *ConfigReceive) { r.CreateFile.storage = errStorage{err: syscall.ENOSPC} },
+			status: http.StatusInsufficientStorage,
+		},
+		{
+			name:   "system error",
+			config: "create_file: {name: DIR/a.yaml}",
+			setup:  func(r *ConfigReceive) { r.CreateFile.storage = errStorage{err: syscall.EACCES} },
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := strings.Replace(tt.config, "DIR", t.TempDir(), 1)
+			if !strings.HasPrefix(config, "{") {
+				config = "{" + config + "}"
+			}
+			config = strings.Replace(config, "{", "{fields: {n: {type: int}}, ", 1)
+			c := parseConfigWith(t, tt.options, "receive:\n  /e: "+config+"\n")
+			r := c.Receive["/e"]
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+			form := tt.form
+			if form == "" {
+				form = "field.n=1"
+			}
+			var w interface{ Result() *http.Response }
+			for i := 0; i < 2; i++ {
+				// The second request is the one rate limited
+				w = submit(c, http.MethodPost, "/e", form, tt.headers...)
+				if tt.status != http.StatusTooManyRequests {
+					break
+				}
+			}
+			if tt.options.Queue != nil {
+				tt.options.Queue.Drain(context.Background())
+			}
+			status := w.Result().StatusCode
+			if status != tt.status {
+				t.Fatalf("status %d, expected %d", status, tt.status)
+			}
+			responses := c.OpenAPI()["paths"].(map[string]interface{})["/e"].(map[string]interface{})["post"].(map[string]interface{})["responses"].(map[string]interface{})
+			if _, ok := responses[strconv.Itoa(status)]; !ok {
+				t.Errorf("status %d is not documented in %v", status, responses)
+			}
+		})
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	config := parseConfig(t, "receive:\n  /a: {action: none}\n  /b: {action: none, methods: [PUT]}\n")
+	h := &ConfigHolder{config: config}
+	w := submit(h.OpenAPIHandler(), http.MethodGet, "/openapi.json", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var doc struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("openapi %q", doc.OpenAPI)
+	}
+	for path, method := range map[string]string{"/a": "post", "/b": "put"} {
+		if _, ok := doc.Paths[path][method]; !ok || len(doc.Paths[path]) != 1 {
+			t.Errorf("%s: operations %v, expected %s", path, doc.Paths[path], method)
+		}
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /contact:
+    fields:
+      email: {type: email, required: true}
+      age: {type: uint}
+    auth: {api_keys: [k]}
+    create_file: {name: contact.yaml}
+`)
+	tests := []struct {
+		name    string
+		target  string
+		headers []string
+		status  int
+		schema  bool
+	}{
+		{"schema", "/contact?schema=1", []string{"X-API-Key", "k"}, http.StatusOK, true},
+		{"schema without auth", "/contact?schema=1", nil, http.StatusUnauthorized, false},
+		{"submission", "/contact?schema=0", []string{"X-API-Key", "k"}, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodGet, tt.target, "", tt.headers...)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d", tt.name, w.Code, tt.status)
+			continue
+		}
+		if !tt.schema {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/schema+json" {
+			t.Errorf("%s: content type %q", tt.name, ct)
+		}
+		var schema struct {
+			Schema     string                            `json:"$schema"`
+			Title      string                            `json:"title"`
+			Required   []string                          `json:"required"`
+			Properties map[string]map[string]interface{} `json:"properties"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if schema.Title != "/contact" || !strings.Contains(schema.Schema, "json-schema.org") {
+			t.Errorf("%s: unexpected document %s", tt.name, w.Body.String())
+		}
+		if len(schema.Required) != 1 || schema.Required[0] != "field.email" {
+			t.Errorf("%s: required %v", tt.name, schema.Required)
+		}
+		if schema.Properties["field.email"]["format"] != "email" || schema.Properties["field.age"]["type"] != "integer" {
+			t.Errorf("%s: properties %v", tt.name, schema.Properties)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPprofHandler(t *testing.T) {
+	tests := []struct {
+		target string
+		status int
+		body   string
+	}{
+		{"/debug/pprof/", http.StatusOK, "goroutine"},
+		{"/debug/pprof/goroutine?debug=1", http.StatusOK, "goroutine profile"},
+		{"/debug/pprof/cmdline", http.StatusOK, ""},
+		{"/debug/pprof/symbol", http.StatusOK, "num_symbols"},
+		{"/other", http.StatusNotFound, ""},
+	}
+	h := PprofHandler()
+	for _, tt := range tests {
+		w := submit(h, http.MethodGet, tt.target, "")
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s: status %d, expected %d with %q", tt.target, w.Code, tt.status, tt.body)
+		}
+	}
+
+	// The main handler does not serve the profiles
+	c := parseConfig(t, "receive:\n  /e: {action: none}\n")
+	if w := submit(c, http.MethodGet, "/debug/pprof/", ""); w.Code != http.StatusNotFound {
+		t.Errorf("main handler status %d for the profiles", w.Code)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultQueueSize    = 100
+	DefaultQueueWorkers = 4
+
+	// QueueRetries is the number of attempts of a queued write before it is
+	// given up
+	QueueRetries = 3
+	QueueBackoff = time.Second
+)
+
+// WriteQueue performs the actions of async endpoints in the background with a
+// bounded pool of workers
+type WriteQueue struct {
+	jobs chan *Process
+	wg   sync.WaitGroup
+	// mu guards closed so that no write is sent on the closed channel
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewWriteQueue(size, workers int) *WriteQueue {
+	q := &WriteQueue{jobs: make(chan *Process, size)}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue schedules the process write, it returns false if the queue is full
+// or drained
+func (q *WriteQueue) Enqueue(p *Process) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.jobs <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+// Go runs f in the background, Drain also waits for it to return. Without a
+// queue f is not waited for.
+func (q *WriteQueue) Go(f func()) {
+	if q == nil {
+		go f()
+		return
+	}
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		f()
+	}()
+}
+
+// Pending returns the number of writes waiting for a worker
+func (q *WriteQueue) Pending() int {
+	return len(q.jobs)
+}
+
+// Drain stops accepting writes and waits for the pending ones and the
+// functions started with Go to complete, or for ctx to be done. It can be called again to wait for the writes left.
+func (q *WriteQueue) Drain(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d pending writes left, %v", q.Pending(), ctx.Err())
+	}
+}
+
+func (q *WriteQueue) work() {
+	defer q.wg.Done()
+	for p := range q.jobs {
+		for attempt := 1; ; attempt++ {
+			res := &queueResponse{header: http.Header{}}
+			if p.perform(res) {
+				break
+			}
+			if attempt >= QueueRetries {
+				logError("Gave up queued write of request %s after %d attempts, last status %d", p.Meta.RequestID, attempt, res.status)
+				break
+			}
+			log.Printf("[DEBUG] Retry queued write of request %s, status %d", p.Meta.RequestID, res.status)
+			time.Sleep(QueueBackoff * time.Duration(attempt))
+		}
+	}
+}
+
+// perform runs the actions of a queued process, the request context is gone
+// by then
+func (p *Process) perform(w http.ResponseWriter) bool {
+	ctx := context.Background()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	p.ctx = ctx
+	return p.performActions(w)
+}
+
+// queueResponse collects the response of a queued write, only the status is
+// kept
+type queueResponse struct {
+	header http.Header
+	status int
+}
+
+func (r *queueResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *queueResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (r *queueResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// enqueue hands over the process to the write queue and answers 202 Accepted
+// with the request id
+func (c *ConfigReceive) enqueue(w http.ResponseWriter, p *Process) {
+	if !c.options.Queue.Enqueue(p) {
+		log.Printf("%s %s: 503 Write queue full or drained", p.Meta.Method, p.Meta.Path)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many pending writes, please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err := json.NewEncoder(w).Encode(map[string]string{"id": p.Meta.RequestID})
+	if err != nil {
+		logError("Failed to encode response, %v", err)
+	}
+}
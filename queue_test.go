@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// asyncConfig returns an endpoint writing to dir through the queue
+func asyncConfig(t *testing.T, queue *WriteQueue, dir string) *Config {
+	t.Helper()
+	return parseConfigWith(t, Options{Queue: queue}, fmt.Sprintf(`
+receive:
+  /e:
+    fields: {name: {}}
+    create_file: {name: '%s/{{ .Meta.RequestID }}.yaml', async: true}
+`, dir))
+}
+
+func TestWriteQueue(t *testing.T) {
+	dir := t.TempDir()
+	queue := NewWriteQueue(10, 2)
+	c := asyncConfig(t, queue, dir)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("req-%d", i)
+		w := submit(c, http.MethodPost, "/e", "field.name=x", "X-Request-Id", id)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("%s: status %d, %s", id, w.Code, w.Body.String())
+		}
+		var res map[string]string
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if res["id"] != id {
+			t.Errorf("%s: response %s", id, w.Body.String())
+		}
+		ids = append(ids, id)
+	}
+	err := queue.Drain(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if _, err := os.Stat(filepath.Join(dir, id+".yaml")); err != nil {
+			t.Errorf("%s: %v", id, err)
+		}
+	}
+}
+
+func TestWriteQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		drained bool
+		status  []int
+	}{
+		{"room", 2, false, []int{http.StatusAccepted, http.StatusAccepted}},
+		{"full", 1, false, []int{http.StatusAccepted, http.StatusServiceUnavailable}},
+		{"drained", 2, true, []int{http.StatusServiceUnavailable}},
+	}
+	for _, tt := range tests {
+		// Without workers, the writes stay in the queue
+		queue := NewWriteQueue(tt.size, 0)
+		if tt.drained {
+			queue.Drain(context.Background())
+		}
+		c := asyncConfig(t, queue, t.TempDir())
+		for i, status := range tt.status {
+			w := submit(c, http.MethodPost, "/e", "field.name=x")
+			if w.Code != status {
+				t.Errorf("%s: request %d status %d, expected %d", tt.name, i, w.Code, status)
+			}
+			if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+				t.Errorf("%s: request %d without Retry-After", tt.name, i)
+			}
+		}
+	}
+}
+
+func TestWriteQueueDrain(t *testing.T) {
+	dir := t.TempDir()
+	queue := NewWriteQueue(10, 1)
+	c := asyncConfig(t, queue, dir)
+	c.Receive["/e"].CreateFile.storage = slowStorage{delay: 200 * time.Millisecond}
+	if w := submit(c, http.MethodPost, "/e", "field.name=x", "X-Request-Id", "slow"); w.Code != http.StatusAccepted {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	err := queue.Drain(ctx)
+	cancel()
+	if err == nil || !strings.Contains(err.Error(), "pending writes left") {
+		t.Errorf("first drain error %v, expected a deadline", err)
+	}
+	if queue.Enqueue(&Process{}) {
+		t.Errorf("write enqueued after drain")
+	}
+
+	// Draining again waits for the writes left
+	err = queue.Drain(context.Background())
+	if err != nil {
+		t.Errorf("second drain error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "slow.yaml")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket per client address, refilled with requests
+// tokens per window up to burst
+type RateLimiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	pruned  time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ConfigRateLimit is the rate_limit of an endpoint, in addition to the server
+// wide -rate-limit
+type ConfigRateLimit struct {
+	Requests int           `yaml:"requests"`
+	Window   time.Duration `yaml:"window"`
+	Burst    int           `yaml:"burst"`
+	limiter  *RateLimiter
+}
+
+func (c *ConfigRateLimit) parse(key string) error {
+	if c.Requests <= 0 || c.Window <= 0 {
+		return fmt.Errorf("%s.requests and %s.window must be positive", key, key)
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("%s.burst must be positive", key)
+	}
+	c.limiter = NewRateLimiter(c.Requests, c.Window, c.Burst)
+	return nil
+}
+
+// NewRateLimiter allows requests per window to each client, burst defaults
+// to requests
+func NewRateLimiter(requests int, window time.Duration, burst int) *RateLimiter {
+	if burst == 0 {
+		burst = requests
+	}
+	return &RateLimiter{
+		rate:    float64(requests) / window.Seconds(),
+		burst:   float64(burst),
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// Allow takes a token for the client, if none is left it returns false and
+// the delay until the next one
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+	b := l.buckets[client]
+	if b == nil {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets the clients whose bucket is full again, at most once a
+// minute, to bound the memory used
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimited checks the server wide and endpoint rate limits of the client,
+// on excess it responds 429 and returns true
+func (c *ConfigReceive) rateLimited(w http.ResponseWriter, r *http.Request) bool {
+	client := clientIP(r, c.options)
+	for _, l := range []*RateLimiter{c.options.RateLimit, c.rateLimiter()} {
+		if l == nil {
+			continue
+		}
+		if ok, wait := l.Allow(client); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ConfigReceive) rateLimiter() *RateLimiter {
+	if c.RateLimit == nil {
+		return nil
+	}
+	return c.RateLimit.limiter
+}
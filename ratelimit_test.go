@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(2, time.Minute, 3)
+	for i, expected := range []bool{true, true, true, false} {
+		if ok, _ := l.Allow("a"); ok != expected {
+			t.Errorf("request %d: allowed %v, expected %v", i+1, ok, expected)
+		}
+	}
+	if ok, wait := l.Allow("a"); ok || wait <= 29*time.Second || wait > 30*time.Second {
+		t.Errorf("allowed %v, wait %v, expected 30s", ok, wait)
+	}
+	// The clients have their own bucket
+	if ok, _ := l.Allow("b"); !ok {
+		t.Errorf("other client limited")
+	}
+
+	// The bucket refills with time up to the burst
+	l.buckets["a"].last = l.buckets["a"].last.Add(-time.Hour)
+	for i, expected := range []bool{true, true, true, false} {
+		if ok, _ := l.Allow("a"); ok != expected {
+			t.Errorf("refilled request %d: allowed %v, expected %v", i+1, ok, expected)
+		}
+	}
+
+	// The full buckets are forgotten
+	l.buckets["b"].last = l.buckets["b"].last.Add(-time.Hour)
+	l.pruned = time.Time{}
+	l.Allow("a")
+	if _, ok := l.buckets["b"]; ok {
+		t.Errorf("full bucket not pruned")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c := parseConfigWith(t, Options{RateLimit: NewRateLimiter(3, time.Minute, 0)}, `
+receive:
+  /a:
+    rate_limit: {requests: 1, window: 10s}
+    action: echo
+  /b:
+    action: echo
+`)
+	tests := []struct {
+		target     string
+		client     string
+		status     int
+		retryAfter string
+	}{
+		{"/a", "192.0.2.1", http.StatusOK, ""},
+		{"/a", "192.0.2.1", http.StatusTooManyRequests, "10"},
+		{"/a", "192.0.2.2", http.StatusOK, ""},
+		// The server wide limit counts the requests to all endpoints
+		{"/b", "192.0.2.1", http.StatusOK, ""},
+		{"/b", "192.0.2.1", http.StatusTooManyRequests, "20"},
+		{"/b", "192.0.2.2", http.StatusOK, ""},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(""))
+		r.RemoteAddr = tt.client + ":1234"
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, r)
+		if w.Code != tt.status || w.Header().Get("Retry-After") != tt.retryAfter {
+			t.Errorf("request %d to %s from %s: status %d, retry after %q, expected %d %q", i+1, tt.target, tt.client, w.Code, w.Header().Get("Retry-After"), tt.status, tt.retryAfter)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    rate_limit: {requests: 0, window: 1m}\n")
+	if expected := "receive[/e].rate_limit.requests and receive[/e].rate_limit.window must be positive"; !strings.Contains(msg, expected) {
+		t.Errorf("error %q, expected %q", msg, expected)
+	}
+}
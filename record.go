@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Record is a document whose keys are kept in order when encoded to YAML or
+// JSON
+type Record yaml.MapSlice
+
+func (r Record) MarshalYAML() (interface{}, error) {
+	return yaml.MapSlice(r), nil
+}
+
+func (r Record) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, item := range r {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, err := json.Marshal(fmt.Sprintf("%v", item.Key))
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(jsonValue(item.Value))
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// jsonValue converts the values decoded from YAML that JSON cannot encode
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		return Record(v)
+	case map[interface{}]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			res[fmt.Sprintf("%v", k)] = jsonValue(item)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			res[i] = jsonValue(item)
+		}
+		return res
+	default:
+		return value
+	}
+}
+
+// Get returns the value for key
+func (r Record) Get(key string) (interface{}, bool) {
+	for _, item := range r {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Set replaces the value for key, appending it if it is missing
+func (r Record) Set(key string, value interface{}) Record {
+	for i, item := range r {
+		if item.Key == key {
+			r[i].Value = value
+			return r
+		}
+	}
+	return append(r, yaml.MapItem{Key: key, Value: value})
+}
+
+// fieldNames returns the field names in configuration order, followed by
+// the undeclared fields such as the sub path in sorted order
+func (c *Process) fieldNames() []string {
+	names := make([]string, 0, len(c.Fields))
+	declared := map[string]bool{}
+	for _, name := range c.fieldOrder {
+		if _, ok := c.Fields[name]; ok {
+			names = append(names, name)
+			declared[name] = true
+		}
+	}
+	var extra []string
+	for name := range c.Fields {
+		if !declared[name] {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	return append(names, extra...)
+}
+
+// declaredFieldNames returns the names of the endpoint fields in declaration
+// order, whether they were set or not
+func (c *ConfigReceive) declaredFieldNames() []string {
+	return (&Process{ConfigReceive: c, Fields: c.Fields}).fieldNames()
+}
+
+// fieldRecord returns the field values in configuration order, with
+// nested_fields the dotted names are assembled into nested records
+func (c *Process) fieldRecord() Record {
+	res := make(Record, 0, len(c.Fields))
+	for _, name := range c.fieldNames() {
+		if c.NestedFields && name != SubPathField {
+			res = res.setPath(strings.Split(name, "."), c.Fields[name].Value)
+			continue
+		}
+		res = append(res, yaml.MapItem{Key: name, Value: c.Fields[name].Value})
+	}
+	return res
+}
+
+// setPath sets the value below the nested records named by keys, creating
+// them as needed
+func (r Record) setPath(keys []string, value interface{}) Record {
+	if len(keys) == 1 {
+		return r.Set(keys[0], value)
+	}
+	existing, _ := r.Get(keys[0])
+	sub, _ := existing.(Record)
+	return r.Set(keys[0], sub.setPath(keys[1:], value))
+}
+
+// checkNestedField rejects the dotted names that cannot be nested, either
+// with an empty component or being the parent of another field
+func (c *ConfigReceive) checkNestedField(key, name string) error {
+	for _, part := range strings.Split(name, ".") {
+		if part == "" {
+			return fmt.Errorf("%s has an empty name component", key)
+		}
+	}
+	for other := range c.Fields {
+		if strings.HasPrefix(other, name+".") {
+			return fmt.Errorf("%s conflicts with the nested field %s", key, other)
+		}
+	}
+	return nil
+}
+
+// record returns the document to store, the field map optionally nested
+// alongside the request metadata
+func (c *Process) record(includeMeta bool) Record {
+	if !includeMeta {
+		return c.fieldRecord()
+	}
+	return Record{
+		{Key: "data", Value: c.fieldRecord()},
+		{Key: "meta", Value: c.Meta},
+	}
+}
+
+// readRecord reads the record stored in an existing file, a missing file is
+// an empty record
+func (c *ConfigCreateFile) readRecord(ctx context.Context, fileName string) (Record, error) {
+	f, err := c.storage.Open(ctx, fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return Record{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return c.decodeRecord(f)
+}
+
+// mergeRecords updates existing with the values of record, recursing into
+// nested maps. Unset values in record do not override existing ones.
+func mergeRecords(existing, record Record) Record {
+	for _, item := range record {
+		if item.Value == nil {
+			continue
+		}
+		key := fmt.Sprintf("%v", item.Key)
+		old, _ := existing.Get(key)
+		oldRecord, oldOk := asRecord(old)
+		newRecord, newOk := asRecord(item.Value)
+		if oldOk && newOk {
+			existing = existing.Set(key, mergeRecords(oldRecord, newRecord))
+		} else {
+			existing = existing.Set(key, item.Value)
+		}
+	}
+	return existing
+}
+
+// asRecord converts the maps found in records, including those decoded from
+// YAML
+func asRecord(value interface{}) (Record, bool) {
+	switch m := value.(type) {
+	case Record:
+		return m, true
+	case yaml.MapSlice:
+		return Record(m), true
+	default:
+		return nil, false
+	}
+}
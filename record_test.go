@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRecordEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		record Record
+		yaml   string
+		json   string
+	}{
+		{
+			name:   "order",
+			record: Record{{Key: "z", Value: 1}, {Key: "a", Value: "x"}, {Key: "m", Value: true}},
+			yaml:   "z: 1\na: x\nm: true\n",
+			json:   `{"z":1,"a":"x","m":true}`,
+		},
+		{
+			name:   "nested",
+			record: Record{{Key: "b", Value: Record{{Key: "y", Value: 1}, {Key: "x", Value: 2}}}, {Key: "a", Value: nil}},
+			yaml:   "b:\n  \"y\": 1\n  x: 2\na: null\n",
+			json:   `{"b":{"y":1,"x":2},"a":null}`,
+		},
+		{
+			name:   "decoded map",
+			record: Record{{Key: "list", Value: []interface{}{map[interface{}]interface{}{1: "one"}}}},
+			yaml:   "list:\n- 1: one\n",
+			json:   `{"list":[{"1":"one"}]}`,
+		},
+		{name: "empty", record: Record{}, yaml: "{}\n", json: `{}`},
+	}
+	for _, tt := range tests {
+		y, err := yaml.Marshal(tt.record)
+		if err != nil || string(y) != tt.yaml {
+			t.Errorf("%s: yaml %q %v, expected %q", tt.name, y, err, tt.yaml)
+		}
+		j, err := json.Marshal(tt.record)
+		if err != nil || string(j) != tt.json {
+			t.Errorf("%s: json %s %v, expected %s", tt.name, j, err, tt.json)
+		}
+	}
+}
+
+func TestRecordFieldOrder(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"yaml", "zeta: \"1\"\nalpha: \"2\"\nmid: \"3\"\n"},
+		{"json", "{\n  \"zeta\": \"1\",\n  \"alpha\": \"2\",\n  \"mid\": \"3\"\n}\n"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields:
+      zeta: {}
+      alpha: {}
+      mid: {}
+    create_file: {name: %s/rec, format: %s}
+`, dir, tt.format))
+		for i := 0; i < 5; i++ {
+			w := submit(c, http.MethodPost, "/e", "field.mid=3&field.alpha=2&field.zeta=1")
+			if w.Code != http.StatusSeeOther {
+				t.Fatalf("%s: status %d, %s", tt.format, w.Code, w.Body.String())
+			}
+			data, _ := ioutil.ReadFile(filepath.Join(dir, "rec"))
+			if string(data) != tt.expected {
+				t.Fatalf("%s: file %q, expected %q", tt.format, data, tt.expected)
+			}
+		}
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing Record
+		record   Record
+		expected string
+	}{
+		{
+			name:     "update and append",
+			existing: Record{{Key: "a", Value: 1}, {Key: "b", Value: 2}},
+			record:   Record{{Key: "c", Value: 3}, {Key: "a", Value: 4}},
+			expected: `{"a":4,"b":2,"c":3}`,
+		},
+		{
+			name:     "unset values",
+			existing: Record{{Key: "a", Value: 1}},
+			record:   Record{{Key: "a", Value: nil}},
+			expected: `{"a":1}`,
+		},
+		{
+			name:     "nested",
+			existing: Record{{Key: "n", Value: yaml.MapSlice{{Key: "x", Value: 1}, {Key: "y", Value: 2}}}},
+			record:   Record{{Key: "n", Value: Record{{Key: "y", Value: 3}}}},
+			expected: `{"n":{"x":1,"y":3}}`,
+		},
+		{
+			name:     "replace scalar with nested",
+			existing: Record{{Key: "n", Value: "x"}},
+			record:   Record{{Key: "n", Value: Record{{Key: "y", Value: 3}}}},
+			expected: `{"n":{"y":3}}`,
+		},
+	}
+	for _, tt := range tests {
+		merged, _ := json.Marshal(mergeRecords(tt.existing, tt.record))
+		if string(merged) != tt.expected {
+			t.Errorf("%s: merged %s, expected %s", tt.name, merged, tt.expected)
+		}
+	}
+}
+
+func TestNestedFields(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"yaml", "name: a\naddress:\n  city: Paris\n  geo:\n    lat: \"48.8\"\n  zip: \"75001\"\n"},
+		{"json", "{\n  \"name\": \"a\",\n  \"address\": {\n    \"city\": \"Paris\",\n    \"geo\": {\n      \"lat\": \"48.8\"\n    },\n    \"zip\": \"75001\"\n  }\n}\n"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    nested_fields: true
+    fields:
+      name: {}
+      address.city: {}
+      address.geo.lat: {}
+      address.zip: {}
+    create_file: {name: %s/rec, format: %s}
+`, dir, tt.format))
+		w := submit(c, http.MethodPost, "/e", "field.name=a&field.address.city=Paris&field.address.zip=75001&field.address.geo.lat=48.8")
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: status %d, %s", tt.format, w.Code, w.Body.String())
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "rec"))
+		if string(data) != tt.expected {
+			t.Errorf("%s: file %q, expected %q", tt.format, data, tt.expected)
+		}
+	}
+
+	errors := []struct {
+		fields  string
+		message string
+	}{
+		{"{a..b: {}}", "receive[/e].fields.a..b has an empty name component"},
+		{"{a: {}, a.b: {}}", "receive[/e].fields.a conflicts with the nested field a.b"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    nested_fields: true\n    fields: "+tt.fields+"\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.fields, msg, tt.message)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// ConfigS3 sends the files of create_file to an S3 compatible bucket, the
+// credentials are taken from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+type ConfigS3 struct {
+	Endpoint string `yaml:"endpoint"`
+	Bucket   string `yaml:"bucket"`
+	Region   string `yaml:"region"`
+}
+
+func (c *ConfigS3) storage(key string) (Storage, error) {
+	var err error
+	if c.Endpoint == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.endpoint is required", key)).ErrorOrNil()
+	}
+	endpoint, e := url.Parse(c.Endpoint)
+	if e != nil {
+		err = multierror.Append(err, fmt.Errorf("%s.endpoint %v", key, e)).ErrorOrNil()
+	}
+	if c.Bucket == "" {
+		err = multierror.Append(err, fmt.Errorf("%s.bucket is required", key)).ErrorOrNil()
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	s := &s3Storage{
+		endpoint:     endpoint,
+		bucket:       c.Bucket,
+		region:       c.Region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		err = multierror.Append(err, fmt.Errorf("%s requires the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables", key)).ErrorOrNil()
+	}
+	return s, err
+}
+
+// s3Storage is the Storage writing objects to a bucket with path style
+// requests signed with AWS Signature Version 4
+type s3Storage struct {
+	endpoint     *url.URL
+	bucket       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// objectKey turns a file name into the object key
+func objectKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// MkdirAll does nothing, buckets have no directories
+func (s *s3Storage) MkdirAll(ctx context.Context, dir string, perm os.FileMode) error {
+	return ctx.Err()
+}
+
+type s3Writer struct {
+	bytes.Buffer
+	ctx     context.Context
+	storage *s3Storage
+	key     string
+}
+
+// Close uploads the object written so far
+func (w *s3Writer) Close() error {
+	res, err := w.storage.do(w.ctx, http.MethodPut, w.key, w.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &s3Writer{ctx: ctx, storage: s, key: objectKey(name)}, nil
+}
+
+// Abort drops the object instead of uploading it, PUT being atomic the
+// objects need no temporary key
+func (s *s3Storage) Abort(f io.WriteCloser) {
+	f.(*s3Writer).Reset()
+}
+
+func (s *s3Storage) Append(ctx context.Context, name string) (io.WriteCloser, int64, error) {
+	return nil, 0, fmt.Errorf("append to %s: not supported by S3 storage", name)
+}
+
+func (s *s3Storage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, objectKey(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Rename copies the object then deletes the original, S3 has no rename
+func (s *s3Storage) Rename(ctx context.Context, oldName, newName string) error {
+	source := "/" + s.bucket + "/" + s3Escape(objectKey(oldName))
+	res, err := s.do(ctx, http.MethodPut, objectKey(newName), nil, map[string]string{"x-amz-copy-source": source})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return s.Remove(ctx, oldName)
+}
+
+func (s *s3Storage) Remove(ctx context.Context, name string) error {
+	res, err := s.do(ctx, http.MethodDelete, objectKey(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// do sends a signed request for the object key. Missing objects are reported
+// as os.ErrNotExist and other failed statuses as errors.
+func (s *s3Storage) do(ctx context.Context, method, key string, body []byte, headers map[string]string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + "/" + s3Escape(s.bucket) + "/" + s3Escape(key)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+	}
+	if res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", method, key, res.Status, bytes.TrimSpace(msg))
+	}
+	return res, nil
+}
+
+// sign adds the AWS Signature Version 4 authorization to the request
+func (s *s3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape encodes an object key as required by the signature, keeping the
+// slashes
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
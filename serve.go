@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Serve starts serving handler on every address, over HTTPS if tlsConfig is
+// not nil. All addresses are bound before any is served so that startup
+// fails if one cannot be bound.
+func Serve(addrs []string, handler http.Handler, tlsConfig *tls.Config) ([]*http.Server, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listening on %s: %v", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	var servers []*http.Server
+	for _, l := range listeners {
+		server := &http.Server{Addr: l.Addr().String(), Handler: handler, TLSConfig: tlsConfig}
+		servers = append(servers, server)
+		go func(l net.Listener) {
+			var err error
+			if tlsConfig != nil {
+				log.Printf("Listening on %s with TLS", l.Addr())
+				err = server.ServeTLS(l, "", "")
+			} else {
+				log.Printf("Listening on %s", l.Addr())
+				err = server.Serve(l)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Error serving on %s: %v", l.Addr(), err)
+			}
+		}(l)
+	}
+	return servers, nil
+}
+
+// Shutdown gracefully shuts down all the servers
+func Shutdown(ctx context.Context, servers []*http.Server) error {
+	var err error
+	for _, server := range servers {
+		e := server.Shutdown(ctx)
+		if e != nil {
+			err = multierror.Append(err, fmt.Errorf("shutting down %s: %v", server.Addr, e)).ErrorOrNil()
+		}
+	}
+	return err
+}
+
+// Drain stops the servers, then flushes the write queue. Each stage is given
+// its own deadline, none if zero. It returns false if a deadline was
+// exceeded.
+func Drain(servers []*http.Server, queue *WriteQueue, httpTimeout, queueTimeout time.Duration) bool {
+	ok := true
+
+	log.Printf("Draining %d HTTP servers", len(servers))
+	ctx, cancel := withOptionalTimeout(httpTimeout)
+	err := Shutdown(ctx, servers)
+	cancel()
+	if err != nil {
+		logError("Failed to drain HTTP servers, %v", err)
+		ok = false
+	}
+
+	log.Printf("Draining write queue, %d pending writes", queue.Pending())
+	ctx, cancel = withOptionalTimeout(queueTimeout)
+	err = queue.Drain(ctx)
+	cancel()
+	if err != nil {
+		logError("Failed to drain write queue, %v", err)
+		ok = false
+	}
+	return ok
+}
+
+func withOptionalTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	servers, err := Serve([]string{"127.0.0.1:0", "127.0.0.1:0"}, handler, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 || servers[0].Addr == servers[1].Addr {
+		t.Fatalf("unexpected servers %v", servers)
+	}
+	for _, server := range servers {
+		res, err := http.Get("http://" + server.Addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("%s: body %q", server.Addr, body)
+		}
+	}
+	err = Shutdown(context.Background(), servers)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err := http.Get("http://" + servers[0].Addr + "/"); err == nil {
+		t.Errorf("%s still served after shutdown", servers[0].Addr)
+	}
+}
+
+func TestServeBindFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	_, err = Serve([]string{freeAddr, busy.Addr().String()}, http.NotFoundHandler(), nil)
+	if err == nil || !strings.Contains(err.Error(), "listening on "+busy.Addr().String()) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("%s not released after the failure: %v", freeAddr, err)
+	}
+	l.Close()
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name         string
+		slowRequest  bool
+		slowWrite    bool
+		httpTimeout  time.Duration
+		queueTimeout time.Duration
+		ok           bool
+	}{
+		{"idle", false, false, 0, 0, true},
+		{"within deadlines", false, true, time.Second, time.Second, true},
+		{"no queue deadline", false, true, 0, 0, true},
+		{"slow write", false, true, 0, 20 * time.Millisecond, false},
+		{"slow request", true, false, 20 * time.Millisecond, 0, false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		queue := NewWriteQueue(10, 1)
+		c := asyncConfig(t, queue, dir)
+		if tt.slowWrite {
+			c.Receive["/e"].CreateFile.storage = slowStorage{delay: 100 * time.Millisecond}
+		}
+		release := make(chan struct{})
+		started := make(chan struct{})
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(started)
+				<-release
+			}
+			c.ServeHTTP(w, r)
+		})
+		servers, err := Serve([]string{"127.0.0.1:0"}, handler, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.Post("http://"+servers[0].Addr+"/e", "application/x-www-form-urlencoded", strings.NewReader("field.name=x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("%s: status %d", tt.name, res.StatusCode)
+		}
+		if tt.slowRequest {
+			go http.Get("http://" + servers[0].Addr + "/slow")
+			<-started
+		}
+
+		ok := Drain(servers, queue, tt.httpTimeout, tt.queueTimeout)
+		if ok != tt.ok {
+			t.Errorf("%s: drained %v, expected %v", tt.name, ok, tt.ok)
+		}
+		close(release)
+		queue.Drain(context.Background())
+		entries, _ := ioutil.ReadDir(dir)
+		if len(entries) != 1 {
+			t.Errorf("%s: %d files written, expected the queued one", tt.name, len(entries))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// endpointStats holds the counters of a receive endpoint, updated atomically
+// from the request handlers
+type endpointStats struct {
+	requests     uint64
+	filesCreated uint64
+}
+
+type lastError struct {
+	at      time.Time
+	message string
+}
+
+// lastErrorValue holds the *lastError most recently reported by logError
+var lastErrorValue atomic.Value
+
+// logError logs an error and records it as the last error for the stats
+// summary
+func logError(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	lastErrorValue.Store(&lastError{at: time.Now().UTC(), message: message})
+	log.Printf("[ERROR] %s", message)
+}
+
+// LogStats logs a summary of the configured endpoints and their counters
+func (c *Config) LogStats() {
+	endpoints := make([]string, 0, len(c.Receive))
+	for endpoint := range c.Receive {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	log.Printf("[STATS] %d endpoints configured", len(endpoints))
+	for _, endpoint := range endpoints {
+		r := c.Receive[endpoint]
+		log.Printf("[STATS] %s: %d requests, %d files created", endpoint,
+			atomic.LoadUint64(&r.stats.requests),
+			atomic.LoadUint64(&r.stats.filesCreated))
+	}
+	if e, ok := lastErrorValue.Load().(*lastError); ok {
+		log.Printf("[STATS] Last error at %s: %s", e.at.Format(time.RFC3339), e.message)
+	} else {
+		log.Printf("[STATS] No error")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLogStats(t *testing.T) {
+	dir := t.TempDir()
+	c := parseConfig(t, `
+receive:
+  /a:
+    fields: {n: {type: int}}
+    create_file: {name: '`+dir+`/{{ .Meta.RequestID }}.yaml'}
+  /b: {action: none}
+`)
+	for _, form := range []string{"field.n=1", "field.n=2", "field.n=x"} {
+		submit(c, http.MethodPost, "/a", form)
+	}
+	logError("disk on fire")
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	c.LogStats()
+	log.SetOutput(ioutil.Discard)
+
+	for _, expected := range []string{
+		"[STATS] 2 endpoints configured",
+		"[STATS] /a: 3 requests, 2 files created",
+		"[STATS] /b: 0 requests, 0 files created",
+		": disk on fire",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("missing %q in\n%s", expected, out.String())
+		}
+	}
+	if strings.Index(out.String(), "/a:") > strings.Index(out.String(), "/b:") {
+		t.Errorf("endpoints not sorted\n%s", out.String())
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/mildred/datamgr/util"
+)
+
+// Storage is the filesystem used by actions to write their files. The context
+// carries the request deadline and implementations should give up when it is
+// done.
+type Storage interface {
+	MkdirAll(ctx context.Context, dir string, perm os.FileMode) error
+	Create(ctx context.Context, name string) (io.WriteCloser, error)
+	// Append opens name for appending, creating it if needed, and returns
+	// its current size
+	Append(ctx context.Context, name string) (io.WriteCloser, int64, error)
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	Rename(ctx context.Context, oldName, newName string) error
+	Remove(ctx context.Context, name string) error
+}
+
+// osStorage is the Storage writing to the local filesystem
+type osStorage struct{}
+
+func (osStorage) MkdirAll(ctx context.Context, dir string, perm os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, perm)
+}
+
+func (osStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Create(name)
+}
+
+func (osStorage) Append(ctx context.Context, name string) (io.WriteCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The lock is released when the file is closed
+	err = util.LockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, st.Size(), nil
+}
+
+func (osStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+func (osStorage) Rename(ctx context.Context, oldName, newName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(oldName, newName)
+}
+
+func (osStorage) Remove(ctx context.Context, name string) error {
+	return os.Remove(name)
+}
+
+// TempPrefix starts the name of the temporary files written before being
+// renamed to their final name
+const TempPrefix = ".tmp-"
+
+// tempName returns a temporary file name in the same directory as fileName
+func tempName(fileName string) string {
+	var b [8]byte
+	rand.Read(b[:])
+	return path.Join(path.Dir(fileName), TempPrefix+path.Base(fileName)+"-"+hex.EncodeToString(b[:]))
+}
+
+// atomicStorage is implemented by the storages whose files only appear once
+// written and closed, they need no temporary file
+type atomicStorage interface {
+	Storage
+	// Abort discards a file being written instead of closing it
+	Abort(f io.WriteCloser)
+}
+
+// writeName returns the name of the file to create to write fileName, a
+// temporary name unless the storage is atomic
+func writeName(storage Storage, fileName string) string {
+	if _, ok := storage.(atomicStorage); ok {
+		return fileName
+	}
+	return tempName(fileName)
+}
+
+// finishWrite closes the file created with writeName and renames it to
+// fileName. If the write failed with err the file is discarded. It returns
+// the failed step on error.
+func finishWrite(ctx context.Context, storage Storage, f io.WriteCloser, tmp, fileName string, err error) (string, error) {
+	if s, ok := storage.(atomicStorage); ok && err != nil {
+		s.Abort(f)
+		return "", err
+	}
+	step := ""
+	if e := f.Close(); err == nil && e != nil {
+		step, err = "close", e
+	}
+	if err == nil && tmp != fileName {
+		step, err = "rename", storage.Rename(ctx, tmp, fileName)
+	}
+	if err != nil && tmp != fileName {
+		if e := storage.Remove(context.Background(), tmp); e != nil {
+			logError("Failed to remove aborted file %v, %v", tmp, e)
+		}
+	}
+	return step, err
+}
+
+// writeAtomic writes data to fileName through a temporary file
+func writeAtomic(ctx context.Context, storage Storage, fileName string, data []byte) error {
+	tmp := writeName(storage, fileName)
+	f, err := storage.Create(ctx, tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = ctx.Err()
+	}
+	_, err = finishWrite(ctx, storage, f, tmp, fileName, err)
+	return err
+}
+
+// transientErrors are the system errors worth retrying, typically seen on
+// network filesystems
+var transientErrors = []error{syscall.EAGAIN, syscall.ESTALE, syscall.EINTR, syscall.EBUSY}
+
+// transientError tells if the storage operation may succeed on retry
+func transientError(err error) bool {
+	for _, e := range transientErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// storageError reports a failed storage operation to the client, using 507
+// Insufficient Storage when the disk is full so it can be told apart from
+// other system errors
+func storageError(w http.ResponseWriter, what string, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		timeoutError(w, what)
+		return
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		logError("No space left on device: failed to %s, %v", what, err)
+		http.Error(w, "Could not process request due to insufficient storage, please try again later.", http.StatusInsufficientStorage)
+		return
+	}
+	logError("Failed to %s, %v", what, err)
+	http.Error(w, "Could not process request due to a system error, please try again later.", http.StatusInternalServerError)
+}
+
+// timeoutError reports to the client that the request deadline was exceeded
+func timeoutError(w http.ResponseWriter, what string) {
+	logError("Timeout exceeded: failed to %s", what)
+	http.Error(w, "Request processing timed out, please try again later.", http.StatusGatewayTimeout)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestStorageError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{syscall.ENOSPC, http.StatusInsufficientStorage},
+		{&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, http.StatusInsufficientStorage},
+		{fmt.Errorf("encode: %w", syscall.ENOSPC), http.StatusInsufficientStorage},
+		{syscall.EACCES, http.StatusInternalServerError},
+		{errors.New("boom"), http.StatusInternalServerError},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		storageError(w, "write", tt.err)
+		if w.Code != tt.status {
+			t.Errorf("%v: status %d, expected %d", tt.err, w.Code, tt.status)
+		}
+	}
+}
+
+func TestCreateFileStorageError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{syscall.ENOSPC, http.StatusInsufficientStorage},
+		{syscall.EACCES, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		c := parseConfig(t, "receive:\n  /e:\n    create_file: {name: "+t.TempDir()+"/rec.yaml}\n")
+		c.Receive["/e"].CreateFile.storage = errStorage{err: tt.err}
+		w := submit(c, http.MethodPost, "/e", "")
+		if w.Code != tt.status {
+			t.Errorf("%v: status %d, expected %d", tt.err, w.Code, tt.status)
+		}
+	}
+}
+
+// flakyStorage is the local filesystem failing the first creates with err
+type flakyStorage struct {
+	osStorage
+	err      error
+	failures int
+	attempts *int
+}
+
+func (s flakyStorage) Create(ctx context.Context, name string) (io.WriteCloser, error) {
+	*s.attempts++
+	if *s.attempts <= s.failures {
+		return nil, &os.PathError{Op: "open", Path: name, Err: s.err}
+	}
+	return s.osStorage.Create(ctx, name)
+}
+
+func TestTransientError(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{syscall.EAGAIN, true},
+		{syscall.ESTALE, true},
+		{&os.PathError{Op: "open", Path: "x", Err: syscall.EBUSY}, true},
+		{fmt.Errorf("rename: %w", syscall.EINTR), true},
+		{syscall.ENOSPC, false},
+		{syscall.EACCES, false},
+		{errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if transient := transientError(tt.err); transient != tt.transient {
+			t.Errorf("%v: transient %v, expected %v", tt.err, transient, tt.transient)
+		}
+	}
+}
+
+func TestCreateFileRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		err      error
+		failures int
+		status   int
+		attempts int
+	}{
+		{"no retries", 0, syscall.EAGAIN, 1, http.StatusInternalServerError, 1},
+		{"recovered", 2, syscall.EAGAIN, 2, http.StatusSeeOther, 3},
+		{"exhausted", 1, syscall.ESTALE, 2, http.StatusInternalServerError, 2},
+		{"permanent", 3, syscall.EACCES, 1, http.StatusInternalServerError, 1},
+		{"disk full", 3, syscall.ENOSPC, 1, http.StatusInsufficientStorage, 1},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    create_file: {name: %s/rec.yaml, retries: %d, retry_backoff: 1ms}
+`, dir, tt.retries))
+		attempts := 0
+		c.Receive["/e"].CreateFile.storage = flakyStorage{err: tt.err, failures: tt.failures, attempts: &attempts}
+		w := submit(c, http.MethodPost, "/e", "")
+		if w.Code != tt.status || attempts != tt.attempts {
+			t.Errorf("%s: status %d after %d attempts, expected %d after %d", tt.name, w.Code, attempts, tt.status, tt.attempts)
+		}
+		_, err := os.Stat(filepath.Join(dir, "rec.yaml"))
+		if written := err == nil; written != (tt.status == http.StatusSeeOther) {
+			t.Errorf("%s: file written %v", tt.name, written)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    create_file: {name: x.yaml, retries: -1}\n")
+	if !strings.Contains(msg, "receive[/e].create_file.retries must be positive") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConfigTLS is the tls block of the configuration, the -tls-cert, -tls-key
+// and -tls-redirect flags take precedence over it. It is only read at
+// startup, a reload does not change the listeners.
+type ConfigTLS struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	Redirect string `yaml:"redirect"`
+}
+
+func (c *ConfigTLS) parse(key string) error {
+	if c.Cert == "" || c.Key == "" {
+		return fmt.Errorf("%s.cert and %s.key are required", key, key)
+	}
+	return nil
+}
+
+// certificateLoader serves the key pair from the files, loading it again when
+// a file is modified so that renewed certificates are used without restart
+type certificateLoader struct {
+	certFile, keyFile string
+	mu                sync.Mutex
+	cert              *tls.Certificate
+	modTime           time.Time
+	checked           time.Time
+}
+
+func (l *certificateLoader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (l *certificateLoader) load() error {
+	modTime, err := l.modified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert = &cert
+	l.modTime = modTime
+	return nil
+}
+
+// GetCertificate checks the files at most once a minute and keeps the
+// previous key pair if the new one cannot be loaded
+func (l *certificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.checked) >= time.Minute {
+		l.checked = now
+		if modTime, err := l.modified(); err == nil && modTime.After(l.modTime) {
+			err = l.load()
+			if err != nil {
+				logError("Failed to reload TLS certificate, %v", err)
+			} else {
+				log.Printf("Reloaded TLS certificate %s", l.certFile)
+			}
+		}
+	}
+	return l.cert, nil
+}
+
+// NewTLSConfig loads the key pair and restricts the connections to TLS 1.2
+// or later with forward secret AEAD cipher suites
+func NewTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	loader := &certificateLoader{certFile: certFile, keyFile: keyFile, checked: time.Now()}
+	err := loader.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		GetCertificate: loader.GetCertificate,
+	}, nil
+}
+
+// RedirectHandler redirects the plain HTTP requests to the same URL over
+// HTTPS, on the port of the TLS listen address
+func RedirectHandler(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		w.Header().Set("Connection", "close")
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed key pair for the common name to
+// cert.pem and key.pem in dir
+func writeCertificate(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		tlsAddr  string
+		host     string
+		target   string
+		expected string
+	}{
+		{":443", "example.com", "/e?a=1&b=%2F", "https://example.com/e?a=1&b=%2F"},
+		{":443", "example.com:80", "/", "https://example.com/"},
+		{":8443", "example.com:8080", "/a/b", "https://example.com:8443/a/b"},
+		{"127.0.0.1:8443", "example.com", "/", "https://example.com:8443/"},
+		{":8443", "[::1]:80", "/e", "https://[::1]:8443/e"},
+		{"", "example.com", "/e", "https://example.com/e"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		RedirectHandler(tt.tlsAddr).ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tt.expected {
+			t.Errorf("%s on %s: status %d to %s, expected %s", tt.host+tt.target, tt.tlsAddr, w.Code, w.Header().Get("Location"), tt.expected)
+		}
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "first")
+	config, err := NewTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old protocol versions are refused
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "first" {
+		t.Errorf("served %s", name)
+	}
+	conn.Close()
+	if conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}); err == nil {
+		conn.Close()
+		t.Errorf("TLS 1.1 accepted")
+	}
+
+	loader := &certificateLoader{certFile: certFile, keyFile: keyFile}
+	if err := loader.load(); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	certFile, keyFile = writeCertificate(t, dir, "second")
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	// The files are checked at most once a minute
+	loader.checked = time.Now()
+	if cert, _ := loader.GetCertificate(nil); commonName(t, cert) != "first" {
+		t.Errorf("reloaded within the minute")
+	}
+	loader.checked = time.Time{}
+	if cert, _ := loader.GetCertificate(nil); commonName(t, cert) != "second" {
+		t.Errorf("renewed certificate not served")
+	}
+
+	// A broken renewal keeps the previous key pair
+	ioutil.WriteFile(certFile, []byte("broken"), 0644)
+	later = later.Add(time.Hour)
+	os.Chtimes(certFile, later, later)
+	loader.checked = time.Time{}
+	if cert, err := loader.GetCertificate(nil); err != nil || commonName(t, cert) != "second" {
+		t.Errorf("broken certificate: %v", err)
+	}
+
+	if _, err := NewTLSConfig(certFile, keyFile); err == nil {
+		t.Errorf("broken certificate loaded")
+	}
+	if _, err := NewTLSConfig(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Errorf("missing certificate loaded")
+	}
+	msg := parseError(t, "tls: {cert: cert.pem}\n")
+	if !strings.Contains(msg, "tls.cert and tls.key are required") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
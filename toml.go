@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var tomlBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// encodeTOML writes the record as a TOML document. Nested records become
+// tables and nil values are left out as TOML has no null.
+func encodeTOML(out io.Writer, record Record) error {
+	var b strings.Builder
+	err := writeTOMLTable(&b, nil, record)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, b.String())
+	return err
+}
+
+func writeTOMLTable(b *strings.Builder, path []string, record Record) error {
+	var tables []yaml.MapItem
+	for _, item := range record {
+		value := tomlNormalize(item.Value)
+		if value == nil {
+			continue
+		}
+		if _, ok := value.(Record); ok {
+			tables = append(tables, yaml.MapItem{Key: item.Key, Value: value})
+			continue
+		}
+		s, err := tomlValue(value)
+		if err != nil {
+			return fmt.Errorf("%v: %v", item.Key, err)
+		}
+		fmt.Fprintf(b, "%s = %s\n", tomlKey(item.Key), s)
+	}
+	for _, item := range tables {
+		sub := append(append([]string{}, path...), tomlKey(item.Key))
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		fmt.Fprintf(b, "[%s]\n", strings.Join(sub, "."))
+		err := writeTOMLTable(b, sub, item.Value.(Record))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tomlNormalize turns the maps of a value into records
+func tomlNormalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case Record, string, bool, int, int64, uint, uint64, float64, time.Time, []interface{}, nil:
+		return v
+	case yaml.MapSlice:
+		return Record(v)
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(v))
+		values := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			key := fmt.Sprintf("%v", k)
+			keys = append(keys, key)
+			values[key] = item
+		}
+		sort.Strings(keys)
+		res := make(Record, 0, len(keys))
+		for _, key := range keys {
+			res = append(res, yaml.MapItem{Key: key, Value: values[key]})
+		}
+		return res
+	default:
+		// Structs such as the metadata are converted through their YAML form
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		var m yaml.MapSlice
+		if yaml.Unmarshal(data, &m) == nil {
+			return Record(m)
+		}
+		var res interface{}
+		err = yaml.Unmarshal(data, &res)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return tomlNormalize(res)
+	}
+}
+
+func tomlValue(value interface{}) (string, error) {
+	switch v := tomlNormalize(value).(type) {
+	case string:
+		return tomlString(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "nan", nil
+		case math.IsInf(v, 1):
+			return "inf", nil
+		case math.IsInf(v, -1):
+			return "-inf", nil
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEn") {
+			s += ".0"
+		}
+		return s, nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if item == nil {
+				continue
+			}
+			s, err := tomlValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case Record:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			if item.Value == nil {
+				continue
+			}
+			s, err := tomlValue(item.Value)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, tomlKey(item.Key)+" = "+s)
+		}
+		return "{" + strings.Join(items, ", ") + "}", nil
+	default:
+		return "", fmt.Errorf("unsupported TOML value %T", v)
+	}
+}
+
+func tomlKey(key interface{}) string {
+	s := fmt.Sprintf("%v", key)
+	if tomlBareKey.MatchString(s) {
+		return s
+	}
+	return tomlString(s)
+}
+
+// tomlString quotes s as a TOML basic string
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestEncodeTOML(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   Record
+		expected string
+	}{
+		{"scalars", Record{{Key: "s", Value: "x"}, {Key: "b", Value: true}, {Key: "i", Value: int64(-3)}, {Key: "u", Value: uint(4)}}, "s = \"x\"\nb = true\ni = -3\nu = 4\n"},
+		{"floats", Record{{Key: "a", Value: 1.0}, {Key: "b", Value: 0.5}, {Key: "c", Value: math.Inf(-1)}, {Key: "d", Value: math.NaN()}}, "a = 1.0\nb = 0.5\nc = -inf\nd = nan\n"},
+		{"escapes", Record{{Key: "s", Value: "a\"b\\c\nd\x01"}}, "s = \"a\\\"b\\\\c\\nd\\u0001\"\n"},
+		{"quoted key", Record{{Key: "a b", Value: 1}, {Key: "é", Value: 2}}, "\"a b\" = 1\n\"é\" = 2\n"},
+		{"nil left out", Record{{Key: "a", Value: nil}, {Key: "b", Value: []interface{}{1, nil, "x"}}}, "b = [1, \"x\"]\n"},
+		{"time", Record{{Key: "t", Value: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}}, "t = 2020-01-02T03:04:05Z\n"},
+		{
+			name:     "tables after values",
+			record:   Record{{Key: "data", Value: Record{{Key: "x", Value: 1}, {Key: "sub", Value: yaml.MapSlice{{Key: "y", Value: 2}}}}}, {Key: "top", Value: "v"}},
+			expected: "top = \"v\"\n\n[data]\nx = 1\n\n[data.sub]\ny = 2\n",
+		},
+		{"sorted map", Record{{Key: "m", Value: map[interface{}]interface{}{"b": 2, "a": 1}}}, "[m]\na = 1\nb = 2\n"},
+		{"inline table in array", Record{{Key: "l", Value: []interface{}{Record{{Key: "k", Value: "v"}, {Key: "n", Value: nil}}}}}, "l = [{k = \"v\"}]\n"},
+		// The metadata goes through its YAML form, the times become strings
+		{"struct", Record{{Key: "meta", Value: ProcessMeta{Method: "POST", ReceivedAt: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}}}, "[meta]\nreceived_at = \"2020-01-02T00:00:00Z\"\nmethod = \"POST\"\npath = \"\"\nremote_addr = \"\"\nendpoint = \"\"\nrequest_id = \"\"\n"},
+	}
+	for _, tt := range tests {
+		var b bytes.Buffer
+		err := encodeTOML(&b, tt.record)
+		if err != nil || b.String() != tt.expected {
+			t.Errorf("%s: encoded %q %v, expected %q", tt.name, b.String(), err, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// sanitizeFileName reduces a client supplied file name to a safe base name,
+// without directory components and with unusual characters replaced
+func sanitizeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "upload"
+	}
+	return name
+}
+
+// uploadedFile returns the file submitted for the field, nil if none
+func (f *ConfigField) uploadedFile(name string, p *Process) (*multipart.FileHeader, error) {
+	var files []*multipart.FileHeader
+	if p.request.MultipartForm != nil {
+		files = p.request.MultipartForm.File[p.formKey(name)]
+	}
+	if len(files) == 0 {
+		if f.Required {
+			return nil, fmt.Errorf("required field field.%s not set", name)
+		}
+		log.Printf("[DEBUG] Empty field.%s", name)
+		return nil, nil
+	}
+	if len(files) > 1 && f.Multi {
+		return nil, fmt.Errorf("field.%s received multiple values", name)
+	}
+	return files[len(files)-1], nil
+}
+
+// fetchFile takes the uploaded file of a file field after checking its size
+// and content type. It is only saved by saveUpload once the submission is
+// validated.
+func (f *ConfigField) fetchFile(name string, p *Process) error {
+	upload, err := f.uploadedFile(name, p)
+	if upload == nil {
+		return err
+	}
+	if f.MaxSize > 0 && upload.Size > f.MaxSize {
+		return fmt.Errorf("field.%s file exceeds %d bytes (got %d)", name, f.MaxSize, upload.Size)
+	}
+	src, err := upload.Open()
+	if err != nil {
+		return fmt.Errorf("field.%s: %v", name, err)
+	}
+	defer src.Close()
+	var head [512]byte
+	n, err := io.ReadFull(src, head[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("field.%s: %v", name, err)
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if !f.allowsMimeType(contentType) {
+		return fmt.Errorf("field.%s unexpected file type %s, expected %s", name, contentType, strings.Join(f.MimeTypes, ", "))
+	}
+	sum := sha256.New()
+	sum.Write(head[:n])
+	size, err := io.Copy(sum, src)
+	if err != nil {
+		return fmt.Errorf("field.%s: %v", name, err)
+	}
+	f.upload = upload
+
+	var b [8]byte
+	rand.Read(b[:])
+	fileName := sanitizeFileName(f.upload.Filename)
+	f.Value = Record{
+		{Key: "filename", Value: fileName},
+		{Key: "path", Value: path.Join(f.UploadDir, hex.EncodeToString(b[:])+"-"+fileName)},
+		{Key: "size", Value: int64(n) + size},
+		{Key: "content_type", Value: contentType},
+		{Key: "sha256", Value: hex.EncodeToString(sum.Sum(nil))},
+	}
+	log.Printf("[DEBUG] Upload field.%s=%#v", name, f.upload.Filename)
+	return nil
+}
+
+// allowsMimeType matches the sniffed content type against mime_types, which
+// may contain wildcards such as image/*
+func (f *ConfigField) allowsMimeType(contentType string) bool {
+	if len(f.MimeTypes) == 0 {
+		return true
+	}
+	for _, allowed := range f.MimeTypes {
+		if allowed == contentType || allowed == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadPath renders upload_name below upload_dir. The template sees the
+// process along with the sanitized .Filename of the upload.
+func (f *ConfigField) uploadPath(p *Process, fileName string) (string, error) {
+	t, err := f.uploadName.Clone()
+	if err != nil {
+		return "", err
+	}
+	t.Funcs(p.templateFuncs())
+	var b bytes.Buffer
+	err = t.Execute(&b, struct {
+		*Process
+		Filename string
+	}{p, fileName})
+	if err != nil {
+		return "", err
+	}
+	name := path.Clean("/" + b.String())
+	if name == "/" {
+		return "", fmt.Errorf("upload_name rendered an empty path")
+	}
+	return path.Join(f.UploadDir, name), nil
+}
+
+// fetchFileContent reads the uploaded file of a file_content field inline as
+// the field value
+func (f *ConfigField) fetchFileContent(name string, p *Process) error {
+	upload, err := f.uploadedFile(name, p)
+	if upload == nil {
+		return err
+	}
+	if upload.Size > f.MaxSize {
+		return fmt.Errorf("field.%s file exceeds %d bytes (got %d)", name, f.MaxSize, upload.Size)
+	}
+	src, err := upload.Open()
+	if err != nil {
+		return fmt.Errorf("field.%s: %v", name, err)
+	}
+	defer src.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(src, f.MaxSize))
+	if err != nil {
+		return fmt.Errorf("field.%s: %v", name, err)
+	}
+	if f.ContentEncoding == "base64" {
+		f.Value = base64.StdEncoding.EncodeToString(data)
+	} else if !utf8.Valid(data) {
+		return fmt.Errorf("field.%s file is not valid UTF-8 text", name)
+	} else {
+		f.Value = string(data)
+	}
+	log.Printf("[DEBUG] Read field.%s from %#v", name, upload.Filename)
+	return nil
+}
+
+// saveUpload stores the uploaded file at the path recorded in the field value
+func (f *ConfigField) saveUpload(p *Process) error {
+	ctx, storage := p.ctx, p.storage
+	if f.upload == nil {
+		return nil
+	}
+	record, _ := f.Value.(Record)
+	value, _ := record.Get("path")
+	fileName, _ := value.(string)
+	if f.uploadName != nil {
+		value, _ := record.Get("filename")
+		name, _ := value.(string)
+		var err error
+		fileName, err = f.uploadPath(p, name)
+		if err != nil {
+			return err
+		}
+		record.Set("path", fileName)
+	}
+
+	err := storage.MkdirAll(ctx, path.Dir(fileName), 0755)
+	if err != nil {
+		return err
+	}
+	src, err := f.upload.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := storage.Create(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// saveUploads stores the uploaded files of the process
+func (c *Process) saveUploads() error {
+	for name, field := range c.Fields {
+		err := field.saveUpload(c)
+		if err != nil {
+			return fmt.Errorf("field.%s: %v", name, err)
+		}
+	}
+	return nil
+}
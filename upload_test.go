@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"../../etc/passwd", "passwd"},
+		{"C:\\Users\\me\\report.pdf", "report.pdf"},
+		{"my file (1).txt", "my_file__1_.txt"},
+		{"..hidden", "hidden"},
+		{"été.png", "_t_.png"},
+		{"", "upload"},
+		{"/", "_"},
+		{"...", "upload"},
+	}
+	for _, tt := range tests {
+		if name := sanitizeFileName(tt.name); name != tt.expected {
+			t.Errorf("%q: sanitized to %q, expected %q", tt.name, name, tt.expected)
+		}
+	}
+}
+
+// submitFile sends a multipart form with a file under key to the handler
+func submitFile(h http.Handler, target, key, fileName string, content []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile(key, fileName)
+	part.Write(content)
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestFileUpload(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+	tests := []struct {
+		name     string
+		fileName string
+		content  []byte
+		status   int
+		stored   string
+		message  string
+	}{
+		{"image", "../avatar.png", png, http.StatusSeeOther, "avatar.png", ""},
+		{"type", "avatar.png", []byte("plain text"), http.StatusBadRequest, "", "field.avatar unexpected file type text/plain, expected image/*"},
+		{"size", "avatar.png", append(png, make([]byte, 100)...), http.StatusBadRequest, "", "field.avatar file exceeds 100 bytes"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields:
+      avatar: {type: file, upload_dir: %s/uploads, mime_types: [image/*], max_size: 100}
+    create_file: {name: %s/rec.yaml}
+`, dir, dir))
+		w := submitFile(c, "/e", "field.avatar", tt.fileName, tt.content)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.message) {
+			t.Errorf("%s: status %d %q, expected %d %q", tt.name, w.Code, w.Body.String(), tt.status, tt.message)
+			continue
+		}
+		uploads, _ := ioutil.ReadDir(filepath.Join(dir, "uploads"))
+		if tt.stored == "" {
+			if len(uploads) != 0 {
+				t.Errorf("%s: rejected upload stored", tt.name)
+			}
+			continue
+		}
+
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "rec.yaml"))
+		var record struct {
+			Avatar struct {
+				Filename    string `yaml:"filename"`
+				Path        string `yaml:"path"`
+				Size        int    `yaml:"size"`
+				ContentType string `yaml:"content_type"`
+				SHA256      string `yaml:"sha256"`
+			} `yaml:"avatar"`
+		}
+		yaml.Unmarshal(data, &record)
+		sum := sha256.Sum256(tt.content)
+		if record.Avatar.Filename != tt.stored || record.Avatar.Size != len(tt.content) || record.Avatar.ContentType != "image/png" || record.Avatar.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: unexpected record %q", tt.name, data)
+		}
+		if filepath.Dir(record.Avatar.Path) != filepath.Join(dir, "uploads") || !strings.HasSuffix(record.Avatar.Path, "-"+tt.stored) {
+			t.Errorf("%s: unexpected path %s", tt.name, record.Avatar.Path)
+		}
+		stored, err := ioutil.ReadFile(record.Avatar.Path)
+		if err != nil || !bytes.Equal(stored, tt.content) {
+			t.Errorf("%s: stored %d bytes, %v", tt.name, len(stored), err)
+		}
+	}
+}
+
+func TestFileContent(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      text: {type: file_content, max_size: 16}
+      blob: {type: file_content, content_encoding: base64}
+    action: echo
+`)
+	tests := []struct {
+		key      string
+		content  []byte
+		status   int
+		expected string
+	}{
+		{"field.text", []byte("hello\nworld\n"), http.StatusOK, `"hello\nworld\n"`},
+		{"field.text", []byte("\xff\xfe"), http.StatusBadRequest, "field.text file is not valid UTF-8 text"},
+		{"field.text", bytes.Repeat([]byte("x"), 17), http.StatusBadRequest, "field.text file exceeds 16 bytes (got 17)"},
+		{"field.blob", []byte{0, 1, 0xff}, http.StatusOK, `"AAH/"`},
+	}
+	for _, tt := range tests {
+		w := submitFile(c, "/e", tt.key, "data.bin", tt.content)
+		if w.Code != tt.status {
+			t.Errorf("%s %q: status %d, expected %d (%s)", tt.key, tt.content, w.Code, tt.status, w.Body.String())
+			continue
+		}
+		if tt.status != http.StatusOK {
+			if !strings.Contains(w.Body.String(), tt.expected) {
+				t.Errorf("%s %q: body %q, expected %q", tt.key, tt.content, w.Body.String(), tt.expected)
+			}
+			continue
+		}
+		var fields map[string]json.RawMessage
+		json.Unmarshal(w.Body.Bytes(), &fields)
+		if got := string(fields[strings.TrimPrefix(tt.key, "field.")]); got != tt.expected {
+			t.Errorf("%s %q: value %s, expected %s", tt.key, tt.content, got, tt.expected)
+		}
+	}
+
+	msg := parseError(t, "receive:\n  /e:\n    action: none\n    fields: {a: {content_encoding: base64}}\n")
+	if !strings.Contains(msg, "receive[/e].fields.a.content_encoding is only allowed on file_content fields") {
+		t.Errorf("unexpected error %q", msg)
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	mimeTypes := []struct {
+		allowed     []string
+		contentType string
+		expected    bool
+	}{
+		{nil, "application/octet-stream", true},
+		{[]string{"image/png"}, "image/png", true},
+		{[]string{"image/png"}, "image/gif", false},
+		{[]string{"image/*"}, "image/gif", true},
+		{[]string{"image/*"}, "imagex/gif", false},
+		{[]string{"text/plain", "application/pdf"}, "application/pdf", true},
+		{[]string{"*/*"}, "video/mp4", true},
+	}
+	for _, tt := range mimeTypes {
+		f := &ConfigField{MimeTypes: tt.allowed}
+		if ok := f.allowsMimeType(tt.contentType); ok != tt.expected {
+			t.Errorf("%s allowed by %q: %v, expected %v", tt.contentType, tt.allowed, ok, tt.expected)
+		}
+	}
+
+	// The upload is stored below upload_dir whatever upload_name renders
+	dir := t.TempDir()
+	c := parseConfig(t, fmt.Sprintf(`
+receive:
+  /e:
+    fields:
+      doc: {type: file, upload_dir: %s/uploads, upload_name: '../{{ .Filename }}.bin'}
+    create_file: {name: %s/rec.yaml}
+`, dir, dir))
+	if w := submitFile(c, "/e", "field.doc", "report.pdf", []byte("%PDF-1.4")); w.Code != http.StatusSeeOther {
+		t.Errorf("status %d %q", w.Code, w.Body.String())
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(dir, "uploads", "report.pdf.bin")); err != nil {
+		t.Error(err)
+	}
+
+	errors := []struct {
+		field   string
+		message string
+	}{
+		{"{max_size: 10}", "receive[/e].fields.a.max_size is only allowed on file and file_content fields"},
+		{"{mime_types: [image/png]}", "receive[/e].fields.a.upload_dir, receive[/e].fields.a.upload_name and receive[/e].fields.a.mime_types are only allowed on file fields"},
+		{"{type: file, content_encoding: base64}", "receive[/e].fields.a.content_encoding is only allowed on file_content fields"},
+		{"{type: file, upload_name: '{{ .Nope'}", "receive[/e].fields.a.upload_name"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: "+tt.field+"}\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.field, msg, tt.message)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		cidrs    []string
+		ip       string
+		contains bool
+		err      bool
+	}{
+		{[]string{"10.0.0.0/8"}, "10.1.2.3", true, false},
+		{[]string{"10.0.0.0/8"}, "11.1.2.3", false, false},
+		{[]string{"192.0.2.1"}, "192.0.2.1", true, false},
+		{[]string{"192.0.2.1"}, "192.0.2.2", false, false},
+		{[]string{"2001:db8::1"}, "2001:db8::1", true, false},
+		{[]string{"2001:db8::/32", "10.0.0.0/8"}, "2001:db8::42", true, false},
+		{nil, "10.1.2.3", false, false},
+		{[]string{"not an ip"}, "", false, true},
+		{[]string{"10.0.0.0/99"}, "", false, true},
+	}
+	for _, tt := range tests {
+		nets, err := ParseCIDRs(tt.cidrs)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v", tt.cidrs, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if contains := ContainsIP(nets, net.ParseIP(tt.ip)); contains != tt.contains {
+			t.Errorf("%q contains %s: %v, expected %v", tt.cidrs, tt.ip, contains, tt.contains)
+		}
+	}
+}
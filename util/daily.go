@@ -0,0 +1,52 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DailyFile is a writer appending to a file of Dir named after the current
+// UTC day, a new file is opened when the day changes
+type DailyFile struct {
+	Dir    string
+	Prefix string
+	Suffix string
+
+	mu   sync.Mutex
+	day  string
+	file *os.File
+}
+
+// Write writes p to the file of the day, opening it first if needed
+func (f *DailyFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	day := time.Now().UTC().Format("2006-01-02")
+	if f.file == nil || day != f.day {
+		if f.file != nil {
+			f.file.Close()
+			f.file = nil
+		}
+		name := filepath.Join(f.Dir, f.Prefix+day+f.Suffix)
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, err
+		}
+		f.file = file
+		f.day = day
+	}
+	return f.file.Write(p)
+}
+
+func (f *DailyFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
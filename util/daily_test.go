@@ -0,0 +1,59 @@
+package util
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDailyFile(t *testing.T) {
+	tests := []struct {
+		prefix, suffix string
+		writes         []string
+		expected       string
+	}{
+		{"audit-", ".jsonl", []string{"a\n", "b\n"}, "a\nb\n"},
+		{"", ".log", []string{"x"}, "x"},
+		{"p-", "", nil, ""},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		f := &DailyFile{Dir: dir, Prefix: tt.prefix, Suffix: tt.suffix}
+		for _, w := range tt.writes {
+			_, err := f.Write([]byte(w))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := f.Close()
+		if err != nil {
+			t.Errorf("%s: close %v", tt.prefix, err)
+		}
+		entries, _ := ioutil.ReadDir(dir)
+		if len(tt.writes) == 0 {
+			if len(entries) != 0 {
+				t.Errorf("%s: file created without writes", tt.prefix)
+			}
+			continue
+		}
+		name := filepath.Join(dir, tt.prefix+time.Now().UTC().Format("2006-01-02")+tt.suffix)
+		data, err := ioutil.ReadFile(name)
+		if err != nil || string(data) != tt.expected || len(entries) != 1 {
+			t.Errorf("%s: file %q %v, expected %q in %s", tt.prefix, data, err, tt.expected, name)
+		}
+	}
+}
+
+func TestDailyFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	f := &DailyFile{Dir: dir, Suffix: ".log"}
+	f.Write([]byte("a\n"))
+	f.Close()
+	f.Write([]byte("b\n"))
+	f.Close()
+	data, _ := ioutil.ReadFile(filepath.Join(dir, time.Now().UTC().Format("2006-01-02")+".log"))
+	if string(data) != "a\nb\n" {
+		t.Errorf("file %q, expected the writes appended", data)
+	}
+}
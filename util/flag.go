@@ -0,0 +1,21 @@
+package util
+
+import (
+	"strings"
+)
+
+// StringList is a flag that can be repeated or given a comma separated list
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStringList(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected StringList
+	}{
+		{[]string{":8080"}, StringList{":8080"}},
+		{[]string{":8080", "127.0.0.1:8081"}, StringList{":8080", "127.0.0.1:8081"}},
+		{[]string{":8080, :8081,,"}, StringList{":8080", ":8081"}},
+		{[]string{""}, nil},
+	}
+	for _, tt := range tests {
+		var l StringList
+		for _, v := range tt.values {
+			l.Set(v)
+		}
+		if !reflect.DeepEqual(l, tt.expected) {
+			t.Errorf("%q: list %q, expected %q", tt.values, l, tt.expected)
+		}
+	}
+}
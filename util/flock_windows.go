@@ -0,0 +1,13 @@
+//go:build windows
+
+package util
+
+import (
+	"os"
+)
+
+// LockFile does nothing on this platform, appends are only serialized within
+// the process
+func LockFile(f *os.File) error {
+	return nil
+}
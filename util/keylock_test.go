@@ -0,0 +1,59 @@
+package util
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var m KeyedMutex
+
+	// The same key is exclusive, with several goroutines either counting
+	// in the critical section or waiting for it
+	const n = 20
+	var wg sync.WaitGroup
+	inside, max := 0, 0
+	var counter sync.Mutex
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := m.Lock("a")
+			counter.Lock()
+			inside++
+			if inside > max {
+				max = inside
+			}
+			counter.Unlock()
+			time.Sleep(time.Millisecond)
+			counter.Lock()
+			inside--
+			counter.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if max != 1 {
+		t.Errorf("%d goroutines held key a at once", max)
+	}
+
+	// Other keys are not blocked
+	unlock := m.Lock("a")
+	done := make(chan struct{})
+	go func() {
+		m.Lock("b")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("key b blocked by key a")
+	}
+	unlock()
+
+	// The released keys are dropped
+	if len(m.locks) != 0 {
+		t.Errorf("%d keys left after release", len(m.locks))
+	}
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a writer appending to a file, renaming it with a timestamp
+// suffix and opening a fresh one when it grows past MaxSize
+type RotatingFile struct {
+	Path    string
+	MaxSize int64 // Do not rotate if zero
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending, rotating it past maxSize
+func OpenRotatingFile(path string, maxSize int64) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = st.Size()
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", f.Path, time.Now().UTC().Format("20060102T150405.000000000"))
+	err = os.Rename(f.Path, rotated)
+	if err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Write writes p to the file, rotating beforehand if the write would grow
+// the file past MaxSize
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		err := f.rotate()
+		if err != nil {
+			return 0, fmt.Errorf("rotating %s: %v", f.Path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		writes  []string
+		files   int
+		current string
+	}{
+		{"no rotation", 0, []string{"aaaa\n", "bbbb\n", "cccc\n"}, 1, "aaaa\nbbbb\ncccc\n"},
+		{"rotation", 10, []string{"aaaa\n", "bbbb\n", "cccc\n"}, 2, "cccc\n"},
+		{"line larger than max", 4, []string{"aaaa\n", "bbbb\n"}, 2, "bbbb\n"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "access.log")
+		f, err := OpenRotatingFile(path, tt.maxSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range tt.writes {
+			_, err = f.Write([]byte(w))
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		f.Close()
+
+		entries, _ := ioutil.ReadDir(dir)
+		if len(entries) != tt.files {
+			t.Errorf("%s: %d files, expected %d", tt.name, len(entries), tt.files)
+		}
+		var all strings.Builder
+		for _, e := range entries {
+			data, _ := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+			all.Write(data)
+			if e.Name() != "access.log" && !strings.HasPrefix(e.Name(), "access.log.") {
+				t.Errorf("%s: unexpected file %s", tt.name, e.Name())
+			}
+		}
+		if current, _ := ioutil.ReadFile(path); string(current) != tt.current {
+			t.Errorf("%s: current file %q, expected %q", tt.name, current, tt.current)
+		}
+		if all.Len() != len(strings.Join(tt.writes, "")) {
+			t.Errorf("%s: %d bytes kept, expected %d", tt.name, all.Len(), len(strings.Join(tt.writes, "")))
+		}
+	}
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	ioutil.WriteFile(path, []byte("before\n"), 0644)
+	f, err := OpenRotatingFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("after\n"))
+	f.Close()
+	if data, _ := ioutil.ReadFile(path); string(data) != "after\n" {
+		t.Errorf("existing size not accounted, file %q", data)
+	}
+}
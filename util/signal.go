@@ -24,3 +24,25 @@ func CancelSignals(ctx context.Context, cancelContext context.CancelFunc, signal
 		}
 	}()
 }
+
+// HandleSignals calls handler each time one of the signals is received, until
+// the context is done. Unlike CancelSignals, the context is left untouched.
+func HandleSignals(ctx context.Context, handler func(os.Signal), signals ...os.Signal) {
+	if len(signals) == 0 {
+		return
+	}
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, signals...)
+	go func() {
+		defer signal.Stop(signalChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-signalChan:
+				log.Printf("Captured %v", s)
+				handler(s)
+			}
+		}
+	}()
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+var StatsSignals = []os.Signal{syscall.SIGUSR1}
+
+var ReloadSignals = []os.Signal{syscall.SIGHUP}
+
+var MaintenanceSignals = []os.Signal{syscall.SIGUSR2}
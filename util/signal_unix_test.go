@@ -0,0 +1,33 @@
+//go:build !windows
+
+package util
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSignals(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan os.Signal, 2)
+	HandleSignals(ctx, func(s os.Signal) { received <- s }, syscall.SIGUSR1)
+
+	for i := 0; i < 2; i++ {
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		select {
+		case s := <-received:
+			if s != syscall.SIGUSR1 {
+				t.Errorf("received %v", s)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("signal %d not handled", i+1)
+		}
+	}
+	if ctx.Err() != nil {
+		t.Errorf("context cancelled by the handled signal")
+	}
+	cancel()
+}
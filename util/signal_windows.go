@@ -0,0 +1,13 @@
+//go:build windows
+
+package util
+
+import (
+	"os"
+)
+
+var StatsSignals = []os.Signal{}
+
+var ReloadSignals = []os.Signal{}
+
+var MaintenanceSignals = []os.Signal{}
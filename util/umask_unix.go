@@ -0,0 +1,15 @@
+//go:build !windows
+
+package util
+
+import (
+	"syscall"
+)
+
+// UmaskSupported tells if SetUmask has an effect on this platform
+const UmaskSupported = true
+
+// SetUmask sets the process umask and returns the previous one
+func SetUmask(mask int) int {
+	return syscall.Umask(mask)
+}
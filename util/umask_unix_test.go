@@ -0,0 +1,49 @@
+//go:build !windows
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetUmask(t *testing.T) {
+	tests := []struct {
+		mask int
+		file os.FileMode
+		dir  os.FileMode
+	}{
+		{0022, 0644, 0755},
+		{0027, 0640, 0750},
+		{0077, 0600, 0700},
+	}
+	old := SetUmask(0022)
+	defer SetUmask(old)
+	for _, tt := range tests {
+		SetUmask(tt.mask)
+		dir := filepath.Join(t.TempDir(), "dir")
+		err := os.Mkdir(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, "file")
+		err = ioutil.WriteFile(file, nil, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, expected := range map[string]os.FileMode{file: tt.file, dir: tt.dir} {
+			info, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := info.Mode().Perm(); perm != expected {
+				t.Errorf("umask %04o: %s mode %04o, expected %04o", tt.mask, filepath.Base(name), perm, expected)
+			}
+		}
+	}
+	if previous := SetUmask(0022); previous != 0077 {
+		t.Errorf("previous umask %04o, expected 0077", previous)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package util
+
+// UmaskSupported tells if SetUmask has an effect on this platform
+const UmaskSupported = false
+
+// SetUmask does nothing on this platform
+func SetUmask(mask int) int {
+	return 0
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// ConfigValidate is a cross-field rule, a template expression over the field
+// values that must evaluate to true such as "gt .end_date .start_date"
+type ConfigValidate struct {
+	Rule     string `yaml:"rule"`
+	Message  string `yaml:"message"`
+	template *template.Template
+}
+
+func (v *ConfigValidate) parse(key string, fields map[string]ConfigField) (err error) {
+	if v.Rule == "" {
+		return fmt.Errorf("%s.rule is required", key)
+	}
+	text := v.Rule
+	if !strings.Contains(text, "{{") {
+		text = "{{ " + text + " }}"
+	}
+	v.template, err = parseFieldTemplate(key+".rule", text, "", fields)
+	return err
+}
+
+// validate evaluates the validate rules once the fields are computed
+func (c *Process) validate() (err error) {
+	for _, v := range c.Validate {
+		res, e := c.renderFieldTemplate(v.template)
+		switch {
+		case e != nil:
+			err = multierror.Append(err, fmt.Errorf("cannot evaluate rule %s, %v", v.Rule, e)).ErrorOrNil()
+		case strings.TrimSpace(res) == "true":
+		case strings.TrimSpace(res) != "false":
+			err = multierror.Append(err, fmt.Errorf("rule %s is not a boolean (got %q)", v.Rule, res)).ErrorOrNil()
+		case v.Message != "":
+			err = multierror.Append(err, fmt.Errorf("%s", v.Message)).ErrorOrNil()
+		default:
+			err = multierror.Append(err, fmt.Errorf("rule %s is not satisfied", v.Rule)).ErrorOrNil()
+		}
+	}
+	return err
+}
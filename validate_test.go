@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	c := parseConfig(t, `
+receive:
+  /e:
+    fields:
+      start: {type: datetime, format: '2006-01-02'}
+      end: {type: datetime, format: '2006-01-02'}
+      guests: {type: int}
+      label: {}
+    validate:
+      - rule: gt .end .start
+        message: the end must follow the start
+      - rule: "{{ le .guests 10 }}"
+      - rule: .label
+    action: echo
+`)
+	tests := []struct {
+		name     string
+		form     string
+		status   int
+		messages []string
+	}{
+		{"satisfied", "field.start=2024-01-01&field.end=2024-01-02&field.guests=2&field.label=true", http.StatusOK, nil},
+		{"message", "field.start=2024-01-02&field.end=2024-01-01&field.guests=2&field.label=true", http.StatusBadRequest, []string{"the end must follow the start"}},
+		{"default message", "field.start=2024-01-01&field.end=2024-01-02&field.guests=11&field.label=true", http.StatusBadRequest, []string{"rule {{ le .guests 10 }} is not satisfied"}},
+		{"not a boolean", "field.start=2024-01-01&field.end=2024-01-02&field.guests=2&field.label=maybe", http.StatusBadRequest, []string{`rule .label is not a boolean (got "maybe")`}},
+		// The rules are all evaluated, unset fields are empty strings
+		{"evaluation error", "field.label=true", http.StatusBadRequest, []string{"the end must follow the start", "cannot evaluate rule {{ le .guests 10 }}"}},
+	}
+	for _, tt := range tests {
+		w := submit(c, http.MethodPost, "/e", tt.form)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, expected %d (%s)", tt.name, w.Code, tt.status, w.Body.String())
+		}
+		for _, message := range tt.messages {
+			if !strings.Contains(w.Body.String(), message) {
+				t.Errorf("%s: body %q, expected %q", tt.name, w.Body.String(), message)
+			}
+		}
+	}
+
+	errors := []struct {
+		rule    string
+		message string
+	}{
+		{"{message: x}", "receive[/e].validate[0].rule is required"},
+		{"{rule: gt .missing 1}", "receive[/e].validate[0].rule references undeclared field missing"},
+		{"{rule: '{{ gt .a'}", "receive[/e].validate[0].rule error"},
+	}
+	for _, tt := range errors {
+		msg := parseError(t, "receive:\n  /e:\n    fields: {a: {}}\n    validate: ["+tt.rule+"]\n")
+		if !strings.Contains(msg, tt.message) {
+			t.Errorf("%s: error %q, expected %q", tt.rule, msg, tt.message)
+		}
+	}
+}